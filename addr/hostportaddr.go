@@ -1,6 +1,7 @@
 package addr
 
 import (
+	"errors"
 	"net"
 	"strconv"
 	"strings"
@@ -67,3 +68,32 @@ func ParseAddr(s string, defaultPort int) (HostPortAddr, error) {
 	}
 	return HostPortAddr{Host: strings.ToLower(host), Port: nPort}, nil
 }
+
+// UnixAddr is a net.Addr that contains the path of a Unix socket. Like
+// HostPortAddr, it is a value type that can be used as a map key.
+type UnixAddr string
+
+// Network returns the network type for this address, which is
+// always "unix".
+func (a UnixAddr) Network() string {
+	return "unix"
+}
+
+// String returns the path of the socket.
+func (a UnixAddr) String() string {
+	return string(a)
+}
+
+// ParseRemoteAddr parses s into a UnixAddr if it has the format
+// unix:/path/to/socket, or into a HostPortAddr with a required port
+// otherwise.
+func ParseRemoteAddr(s string) (net.Addr, error) {
+	if strings.HasPrefix(s, "unix:") {
+		path := s[len("unix:"):]
+		if path == "" {
+			return nil, errors.New("missing unix socket path")
+		}
+		return UnixAddr(path), nil
+	}
+	return ParseAddr(s, 0)
+}
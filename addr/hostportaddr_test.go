@@ -32,3 +32,28 @@ func TestHostPortAddrEquality(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRemoteAddr(t *testing.T) {
+	cases := []struct {
+		in   string
+		want net.Addr
+		err  bool
+	}{
+		{"unix:/var/run/redis.sock", UnixAddr("/var/run/redis.sock"), false},
+		{"unix:", nil, true},
+		{"Redis:6379", HostPortAddr{Host: "redis", Port: 6379}, false},
+		{"redis", nil, true},
+		{"[::1]:6379", HostPortAddr{Host: "::1", Port: 6379}, false},
+	}
+
+	for _, c := range cases {
+		got, err := ParseRemoteAddr(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("%s: want error %t, got %v", c.in, c.err, err)
+			continue
+		}
+		if err == nil && got != c.want {
+			t.Errorf("%s: want %#v, got %#v", c.in, c.want, got)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package addr
 
-import "net"
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
 
 // ListenFunc is a variable that holds the reference to
 // the Listen function to use, so that it can be mocked
@@ -15,7 +21,19 @@ var ListenFunc = Listen
 // select a free TCP port, and then get that port number back.
 // The returned Listener should then be passed to a server's Serve
 // method to start accepting connections.
+//
+// If addr is a Unix socket address, a stale socket file at that
+// path is removed first, and the socket is made accessible only
+// by its owner.
 func Listen(addr net.Addr) (l net.Listener, port int, err error) {
+	if addr.Network() == "unix" {
+		if err := removeStaleSocket(addr.String()); err != nil {
+			return nil, 0, err
+		}
+		l, err := listenUnix(addr.String())
+		return l, 0, err
+	}
+
 	l, err = net.Listen(addr.Network(), addr.String())
 	if err != nil {
 		return nil, 0, err
@@ -25,3 +43,70 @@ func Listen(addr net.Addr) (l net.Listener, port int, err error) {
 	}
 	return l, port, nil
 }
+
+// listenUnix listens on a Unix socket at path that only its owner can
+// access. The socket is created in a private directory and its
+// permissions are set before it is linked at path, so that no other
+// user can connect in between. As net.Listen, it fails if path
+// already exists.
+func listenUnix(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the temporary path is removed with dir, path is removed on Close
+	l.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Link(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixListener is a Unix socket listener created by listenUnix, that
+// reports its final address and removes it when it is closed.
+type unixListener struct {
+	*net.UnixListener
+	addr   *net.UnixAddr
+	unlink sync.Once
+}
+
+// Addr returns the address of the socket at its final path.
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close closes the listener and removes its socket file.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.unlink.Do(func() { os.Remove(l.addr.Name) })
+	return err
+}
+
+// removeStaleSocket removes the Unix socket file at path if no server
+// listens on it anymore, typically after a crash.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		// let Listen report the error, if any
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		// in use
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
@@ -1,6 +1,12 @@
 package addr
 
-import "testing"
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestListen(t *testing.T) {
 	l, port, err := Listen(HostPortAddr{Host: "localhost", Port: 0})
@@ -13,3 +19,67 @@ func TestListen(t *testing.T) {
 	}
 	t.Logf("got port %d", port)
 }
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.sock")
+	unixAddr := &net.UnixAddr{Name: path, Net: "unix"}
+
+	// a stale socket file is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, port, err := Listen(unixAddr)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	defer l.Close()
+	if port != 0 {
+		t.Errorf("want port 0, got %d", port)
+	}
+	if got := l.Addr().String(); got != path {
+		t.Errorf("want address %s, got %s", path, got)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("want permissions 0600, got %#o", perm)
+	}
+	// the socket is only created in a private directory
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("want only the socket file, got %d files", len(files))
+	}
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("want connection, got %v", err)
+	}
+	conn.Close()
+
+	// a socket in use is not replaced
+	if _, _, err := Listen(unixAddr); err == nil {
+		t.Errorf("want address in use error, got none")
+	}
+
+	// the socket file is removed on close
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("want socket file removed, got %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+
+	"github.com/pkg/errors"
+)
+
+// Doer runs commands and returns their reply, as Conn and Pool do.
+type Doer interface {
+	Do(args ...string) (interface{}, error)
+}
+
+// TunnelOptions are the options of GETTUNNELADDR. See the server
+// package for their meaning.
+type TunnelOptions struct {
+	// The jump hosts to reach the SSH server, in order.
+	Jump []string
+	// The remote server is a Redis Cluster node.
+	Cluster bool
+	// The tunnel listens on a Unix socket instead of a TCP port.
+	Unix bool
+
+	// The connections to the remote server use TLS. It is implied by
+	// the other TLS options.
+	TLS        bool
+	ServerName string
+	CACert     string
+	Cert       string
+	Key        string
+	Insecure   bool
+
+	// The reply is delayed until the tunnel is ready: its SSH connection
+	// is established and a test connection to the remote server
+	// succeeds. WaitTimeout overrides the default timeout of the Server
+	// if positive.
+	Wait        bool
+	WaitTimeout time.Duration
+}
+
+// args returns the arguments of GETTUNNELADDR for the options.
+func (o *TunnelOptions) args() []string {
+	if o == nil {
+		return nil
+	}
+
+	var args []string
+	if len(o.Jump) > 0 {
+		args = append(args, "JUMP", strings.Join(o.Jump, ","))
+	}
+	if o.Cluster {
+		args = append(args, "CLUSTER")
+	}
+	if o.Unix {
+		args = append(args, "UNIX")
+	}
+	if o.TLS {
+		args = append(args, "TLS")
+	}
+	for _, opt := range []struct{ name, value string }{
+		{"SERVERNAME", o.ServerName},
+		{"CACERT", o.CACert},
+		{"CERT", o.Cert},
+		{"KEY", o.Key},
+	} {
+		if opt.value != "" {
+			args = append(args, opt.name, opt.value)
+		}
+	}
+	if o.Insecure {
+		args = append(args, "INSECURE")
+	}
+	if o.Wait {
+		args = append(args, "WAIT")
+		if o.WaitTimeout > 0 {
+			args = append(args, formatSeconds(o.WaitTimeout))
+		}
+	}
+	return args
+}
+
+// TunnelInfo is the description of a tunnel returned by LISTTUNNELS.
+type TunnelInfo struct {
+	ID        string `resp:"id"`
+	User      string `resp:"user"`
+	SSHServer string `resp:"ssh_server"`
+	Remote    string `resp:"remote"`
+	Local     string `resp:"local"`
+	// State is "prepared", "started" or "closed".
+	State string `resp:"state"`
+	// The times are Unix timestamps in seconds.
+	CreatedAt      int64 `resp:"created_at"`
+	LastActivityAt int64 `resp:"last_activity_at"`
+	// IdleRemaining is the number of seconds before the tunnel closes if
+	// there is no activity.
+	IdleRemaining int64 `resp:"idle_remaining"`
+	Conns         int64 `resp:"conns"`
+	BytesIn       int64 `resp:"bytes_in"`
+	BytesOut      int64 `resp:"bytes_out"`
+}
+
+// TunnelExit is the description of a stopped tunnel returned by
+// TUNNELHISTORY.
+type TunnelExit struct {
+	ID        string `resp:"id"`
+	User      string `resp:"user"`
+	SSHServer string `resp:"ssh_server"`
+	Remote    string `resp:"remote"`
+	Local     string `resp:"local"`
+	// Reason is "idle", "killed", "dial error" or "serve error", and
+	// Error the error the tunnel stopped with.
+	Reason string `resp:"reason"`
+	Error  string `resp:"error"`
+	// The times are Unix timestamps in seconds.
+	CreatedAt int64 `resp:"created_at"`
+	ExitedAt  int64 `resp:"exited_at"`
+	BytesIn   int64 `resp:"bytes_in"`
+	BytesOut  int64 `resp:"bytes_out"`
+}
+
+// Info is the information returned by INFO, the fields of each section
+// by the lowercase name of the section.
+type Info map[string]map[string]string
+
+// Companion is a client of the regis-companion Server, that runs its
+// commands via a Conn or a Pool.
+type Companion struct {
+	Doer Doer
+}
+
+// Ping checks that the Server replies.
+func (c *Companion) Ping() error {
+	v, err := c.Doer.Do("PING")
+	if err != nil {
+		return err
+	}
+	if v != resp.SimpleString("PONG") {
+		return errors.Errorf("client: unexpected reply to PING %v", v)
+	}
+	return nil
+}
+
+// GetTunnelAddr returns the local address of a tunnel to remote via the
+// SSH server, in the forms accepted by GETTUNNELADDR, starting the
+// tunnel if needed. The address is a host:port, or the path of a Unix
+// socket with the Unix option.
+func (c *Companion) GetTunnelAddr(server, remote string, opts *TunnelOptions) (string, error) {
+	args := append([]string{"GETTUNNELADDR", server, remote}, opts.args()...)
+	v, err := c.Doer.Do(args...)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.Errorf("client: unexpected reply to GETTUNNELADDR %v", v)
+	}
+	return s, nil
+}
+
+// KillTunnel stops the tunnels to remote via the SSH server.
+func (c *Companion) KillTunnel(server, remote string) error {
+	return c.ok("KILLTUNNEL", server, remote)
+}
+
+// WaitTunnel waits until the tunnel with that ID, as returned by
+// ListTunnels, is ready, and returns its local address. The timeout
+// overrides the default timeout of the Server if positive.
+//
+// A failure is returned as a *resp.ReplyError, its message starts with
+// the category of the failure: AUTH, HOSTKEY, NETWORK, REMOTE or TLS.
+func (c *Companion) WaitTunnel(id string, timeout time.Duration) (string, error) {
+	args := []string{"WAITTUNNEL", id}
+	if timeout > 0 {
+		args = append(args, formatSeconds(timeout))
+	}
+	v, err := c.Doer.Do(args...)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.Errorf("client: unexpected reply to WAITTUNNEL %v", v)
+	}
+	return s, nil
+}
+
+// formatSeconds returns d as a number of seconds.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// KillTunnelID stops the tunnel with that ID, as returned by
+// ListTunnels.
+func (c *Companion) KillTunnelID(id string) error {
+	return c.ok("KILLTUNNEL", id)
+}
+
+// ListTunnels returns the tunnels of the Server, or only those with an
+// ID, user@server, remote or local address that matches the glob-style
+// pattern if it is not empty.
+func (c *Companion) ListTunnels(pattern string) ([]TunnelInfo, error) {
+	args := []string{"LISTTUNNELS"}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+	v, err := c.Doer.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	var infos []TunnelInfo
+	if err := resp.UnmarshalValue(v, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// TunnelHistory returns the last stopped tunnels, the most recent
+// first, at most count of them if count is positive.
+func (c *Companion) TunnelHistory(count int) ([]TunnelExit, error) {
+	args := []string{"TUNNELHISTORY"}
+	if count > 0 {
+		args = append(args, strconv.Itoa(count))
+	}
+	v, err := c.Doer.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	var exits []TunnelExit
+	if err := resp.UnmarshalValue(v, &exits); err != nil {
+		return nil, err
+	}
+	return exits, nil
+}
+
+// Info returns the information about the Server, of all sections if
+// section is empty.
+func (c *Companion) Info(section string) (Info, error) {
+	args := []string{"INFO"}
+	if section != "" {
+		args = append(args, section)
+	}
+	v, err := c.Doer.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return parseInfo(v), nil
+	case resp.Map:
+		// the sections in RESP3
+		info := make(Info, len(v))
+		for _, kv := range v {
+			name, _ := kv.Key.(string)
+			fields, _ := kv.Value.(resp.Map)
+			sec := make(map[string]string, len(fields))
+			for _, f := range fields {
+				k, _ := f.Key.(string)
+				sec[k] = resp.ValueOf(f.Value).Str()
+			}
+			info[name] = sec
+		}
+		return info, nil
+	}
+	return nil, errors.Errorf("client: unexpected reply to INFO %v", v)
+}
+
+// parseInfo parses the text of INFO in RESP2.
+func parseInfo(text string) Info {
+	info := make(Info)
+	var sec map[string]string
+	for _, line := range strings.Split(text, "\r\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# "):
+			sec = make(map[string]string)
+			info[strings.ToLower(strings.TrimPrefix(line, "# "))] = sec
+		case sec != nil:
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) == 2 {
+				sec[kv[0]] = kv[1]
+			}
+		}
+	}
+	return info
+}
+
+// CheckUpdates returns true if a new version of the Server is
+// available.
+func (c *Companion) CheckUpdates() (bool, error) {
+	v, err := c.Doer.Do("CHECKUPDATES")
+	if err != nil {
+		return false, err
+	}
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		// booleans are integers in RESP2
+		return v != 0, nil
+	}
+	return false, errors.Errorf("client: unexpected reply to CHECKUPDATES %v", v)
+}
+
+// ok runs the command made of args, that replies with OK.
+func (c *Companion) ok(args ...string) error {
+	v, err := c.Doer.Do(args...)
+	if err != nil {
+		return err
+	}
+	if v != resp.SimpleString("OK") {
+		return errors.Errorf("client: unexpected reply to %s %v", args[0], v)
+	}
+	return nil
+}
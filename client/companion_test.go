@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/server"
+)
+
+func TestTunnelOptionsArgs(t *testing.T) {
+	cases := []struct {
+		opts *TunnelOptions
+		want []string
+	}{
+		{nil, nil},
+		{&TunnelOptions{}, nil},
+		{&TunnelOptions{Jump: []string{"a", "b@c:2"}, Cluster: true}, []string{"JUMP", "a,b@c:2", "CLUSTER"}},
+		{&TunnelOptions{Unix: true, TLS: true, CACert: "ca.pem", Insecure: true}, []string{"UNIX", "TLS", "CACERT", "ca.pem", "INSECURE"}},
+		{&TunnelOptions{ServerName: "redis", Cert: "c.pem", Key: "k.pem"}, []string{"SERVERNAME", "redis", "CERT", "c.pem", "KEY", "k.pem"}},
+		{&TunnelOptions{Wait: true}, []string{"WAIT"}},
+		{&TunnelOptions{Wait: true, WaitTimeout: 1500 * time.Millisecond}, []string{"WAIT", "1.5"}},
+	}
+	for _, c := range cases {
+		if got := c.opts.args(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: want %q, got %q", c.opts, c.want, got)
+		}
+	}
+}
+
+func TestCompanionGetTunnelAddr(t *testing.T) {
+	var got []string
+	c := fakeConn(func(req []string) []interface{} {
+		got = req
+		return []interface{}{"127.0.0.1:1234"}
+	})
+	defer c.Close()
+
+	comp := &Companion{Doer: c}
+	a, err := comp.GetTunnelAddr("root@ssh", "redis:6379", &TunnelOptions{Cluster: true})
+	if err != nil || a != "127.0.0.1:1234" {
+		t.Errorf("want address, got %q and %v", a, err)
+	}
+	if want := []string{"GETTUNNELADDR", "root@ssh", "redis:6379", "CLUSTER"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want request %q, got %q", want, got)
+	}
+}
+
+func TestCompanionListTunnels(t *testing.T) {
+	for _, proto := range []int{resp.RESP2, resp.RESP3} {
+		c := fakeConn(func(req []string) []interface{} {
+			if req[0] == "HELLO" {
+				return []interface{}{resp.Map{}}
+			}
+			return []interface{}{[]resp.Map{{
+				{Key: "id", Value: "3"},
+				{Key: "remote", Value: "redis:6379"},
+				{Key: "state", Value: "started"},
+				{Key: "bytes_in", Value: int64(12)},
+			}}}
+		})
+		if _, err := c.Hello(proto, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		infos, err := (&Companion{Doer: c}).ListTunnels("*")
+		want := []TunnelInfo{{ID: "3", Remote: "redis:6379", State: "started", BytesIn: 12}}
+		if err != nil || !reflect.DeepEqual(infos, want) {
+			t.Errorf("RESP%d: want %+v, got %+v and %v", proto, want, infos, err)
+		}
+		c.Close()
+	}
+}
+
+func TestCompanionCheckUpdates(t *testing.T) {
+	for _, reply := range []interface{}{true, int64(1)} {
+		c := fakeConn(func(req []string) []interface{} {
+			return []interface{}{reply}
+		})
+		ok, err := (&Companion{Doer: c}).CheckUpdates()
+		if err != nil || !ok {
+			t.Errorf("%#v: want true, got %v and %v", reply, ok, err)
+		}
+		c.Close()
+	}
+}
+
+// startServer starts a Server that requires token on a Unix socket,
+// and returns the path of the socket and the func to stop the Server.
+func startServer(t *testing.T, token string) (string, func()) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "companion.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &server.Server{
+		Addr:       &net.UnixAddr{Name: sock, Net: "unix"},
+		MetaConfig: &server.MetaConfig{KnownHostsFile: "/dev/null"},
+		AuthToken:  token,
+		ErrChan:    make(chan error, 100),
+	}
+	go srv.ListenAndServe(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return sock, func() {
+		cancel()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCompanion(t *testing.T) {
+	sock, stop := startServer(t, "secret")
+	defer stop()
+
+	for _, proto := range []int{resp.RESP2, resp.RESP3} {
+		d := &Dialer{Timeout: 5 * time.Second, AuthToken: "secret", Protocol: proto}
+		p := &Pool{Dial: func() (*Conn, error) { return d.Dial("unix", sock) }}
+		comp := &Companion{Doer: p}
+
+		if err := comp.Ping(); err != nil {
+			t.Errorf("RESP%d: want PONG, got %v", proto, err)
+		}
+		info, err := comp.Info("server")
+		if err != nil {
+			t.Errorf("RESP%d: want info, got %v", proto, err)
+		} else if _, ok := info["server"]["process_id"]; !ok {
+			t.Errorf("RESP%d: want process_id in server section, got %v", proto, info)
+		}
+		if err := comp.KillTunnel("root@127.0.0.1", "remote:7000"); err != nil {
+			t.Errorf("RESP%d: want OK, got %v", proto, err)
+		}
+		if infos, err := comp.ListTunnels(""); err != nil || len(infos) != 0 {
+			t.Errorf("RESP%d: want no tunnel, got %v and %v", proto, infos, err)
+		}
+		if exits, err := comp.TunnelHistory(10); err != nil || len(exits) != 0 {
+			t.Errorf("RESP%d: want no stopped tunnel, got %v and %v", proto, exits, err)
+		}
+		_, err = comp.WaitTunnel("1", time.Second)
+		if rerr, ok := err.(*resp.ReplyError); !ok || rerr.Msg != "ERR no tunnel with ID 1" {
+			t.Errorf("RESP%d: want unknown tunnel error, got %v", proto, err)
+		}
+		err = comp.KillTunnelID("1")
+		if rerr, ok := err.(*resp.ReplyError); !ok || !strings.HasPrefix(rerr.Msg, "ERR no tunnel") {
+			t.Errorf("RESP%d: want unknown tunnel error, got %v", proto, err)
+		}
+		_, err = comp.GetTunnelAddr("root@127.0.0.1", "remote", nil)
+		if rerr, ok := err.(*resp.ReplyError); !ok || !strings.HasPrefix(rerr.Msg, "ERR invalid remote server address") {
+			t.Errorf("RESP%d: want invalid address error, got %v", proto, err)
+		}
+		p.Close()
+	}
+
+	// the token is required
+	p := &Pool{Dial: func() (*Conn, error) { return Dial("unix", sock) }}
+	defer p.Close()
+	_, err := (&Companion{Doer: p}).Info("")
+	if rerr, ok := err.(*resp.ReplyError); !ok || !strings.HasPrefix(rerr.Msg, "NOAUTH") {
+		t.Errorf("want NOAUTH error, got %v", err)
+	}
+}
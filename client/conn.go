@@ -0,0 +1,269 @@
+// Package client implements a client for the Redis serialization
+// protocol (RESP), and a typed client for the commands of the
+// regis-companion Server.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrPendingReplies is returned by Do if the replies to pipelined
+	// commands have not all been received.
+	ErrPendingReplies = errors.New("client: pending replies to pipelined commands")
+
+	// ErrNoPendingReply is returned by Receive if there is no reply to
+	// receive.
+	ErrNoPendingReply = errors.New("client: no pending reply")
+)
+
+// Dialer contains the options to connect to a server.
+type Dialer struct {
+	// Timeout is the maximum duration to connect, including the TLS and
+	// HELLO handshakes. No timeout if zero.
+	Timeout time.Duration
+	// If not nil, the connection uses TLS with this configuration.
+	TLSConfig *tls.Config
+	// If not empty, the connection is authenticated with this token.
+	AuthToken string
+	// The version of the protocol to use, resp.RESP2 or resp.RESP3. If
+	// it is RESP3, or if AuthToken is set, the connection starts with a
+	// HELLO command. Defaults to RESP2.
+	Protocol int
+}
+
+// Dial connects to the server at address on the named network, e.g.
+// "tcp" or "unix", using the default options.
+func Dial(network, address string) (*Conn, error) {
+	var d Dialer
+	return d.Dial(network, address)
+}
+
+// Dial connects to the server at address on the named network, using
+// the options of the Dialer.
+func (d *Dialer) Dial(network, address string) (*Conn, error) {
+	nd := &net.Dialer{Timeout: d.Timeout}
+	var nc net.Conn
+	var err error
+	if d.TLSConfig != nil {
+		nc, err = tls.DialWithDialer(nd, network, address, d.TLSConfig)
+	} else {
+		nc, err = nd.Dial(network, address)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+
+	c := NewConn(nc)
+	if d.Protocol == resp.RESP3 || d.AuthToken != "" {
+		if d.Timeout > 0 {
+			if err := nc.SetDeadline(time.Now().Add(d.Timeout)); err != nil {
+				nc.Close()
+				return nil, errors.Wrap(err, "set deadline")
+			}
+		}
+
+		proto := d.Protocol
+		if proto == 0 {
+			proto = resp.RESP2
+		}
+		if _, err := c.Hello(proto, d.AuthToken); err != nil {
+			nc.Close()
+			return nil, err
+		}
+
+		if d.Timeout > 0 {
+			if err := nc.SetDeadline(time.Time{}); err != nil {
+				nc.Close()
+				return nil, errors.Wrap(err, "set deadline")
+			}
+		}
+	}
+	return c, nil
+}
+
+// Conn is a connection to a server. It supports the pipelining of
+// commands with Send, Flush and Receive, and the RESP3 protocol. It is
+// not safe for concurrent use.
+type Conn struct {
+	// PushFunc is called with the out-of-band data received in RESP3,
+	// that is not a reply to a command. If nil, the data is dropped.
+	PushFunc func(resp.Push)
+
+	conn  net.Conn
+	enc   *resp.Encoder
+	dec   *resp.Decoder
+	proto int
+
+	// the commands are encoded in buf until they are flushed
+	buf bytes.Buffer
+	// the number of commands sent for which the reply is not received
+	pending int
+
+	mu  sync.Mutex // protects err, which is set by Close
+	err error
+}
+
+// NewConn returns a Conn that uses the RESP2 protocol over the
+// connection nc.
+func NewConn(nc net.Conn) *Conn {
+	c := &Conn{
+		conn:  nc,
+		dec:   resp.NewDecoder(nc),
+		proto: resp.RESP2,
+	}
+	c.enc = resp.NewEncoder(&c.buf)
+	return c
+}
+
+// Protocol returns the version of the protocol used by the connection.
+func (c *Conn) Protocol() int {
+	return c.proto
+}
+
+// SetDeadline sets the read and write deadline of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Err returns the error that made the connection unusable, if any. A
+// connection is unusable once closed, or after a network or protocol
+// error.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) fatal(err error) error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	return err
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	c.err = errors.New("client: connection closed")
+	return c.conn.Close()
+}
+
+// Do sends the command made of args and returns its reply. An error
+// reply is returned as a *resp.ReplyError. It returns
+// ErrPendingReplies if the replies to pipelined commands are not all
+// received.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	if c.pending > 0 || c.buf.Len() > 0 {
+		return nil, ErrPendingReplies
+	}
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+// Send buffers the command made of args, to be sent by Flush.
+func (c *Conn) Send(args ...string) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(args); err != nil {
+		return errors.Wrap(err, "encode command")
+	}
+	c.pending++
+	return nil
+}
+
+// Flush sends the buffered commands.
+func (c *Conn) Flush() error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if _, err := c.buf.WriteTo(c.conn); err != nil {
+		return c.fatal(errors.Wrap(err, "write commands"))
+	}
+	return nil
+}
+
+// Receive returns the reply to the oldest command sent with Send. An
+// error reply is returned as a *resp.ReplyError. In RESP3, the
+// out-of-band data received before the reply is passed to PushFunc.
+func (c *Conn) Receive() (interface{}, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if c.pending == 0 {
+		return nil, ErrNoPendingReply
+	}
+
+	for {
+		v, err := c.dec.Decode()
+		if err != nil {
+			return nil, c.fatal(errors.Wrap(err, "read reply"))
+		}
+		if p, ok := v.(resp.Push); ok && c.proto == resp.RESP3 {
+			if c.PushFunc != nil {
+				c.PushFunc(p)
+			}
+			continue
+		}
+
+		c.pending--
+		switch v := v.(type) {
+		case resp.Error:
+			return nil, &resp.ReplyError{Msg: string(v)}
+		case resp.BlobError:
+			return nil, &resp.ReplyError{Msg: string(v)}
+		}
+		return v, nil
+	}
+}
+
+// Hello switches the connection to the protocol version proto, and
+// authenticates it with token if it is not empty. It returns the
+// information about the server sent in reply, as a Map in both
+// versions of the protocol.
+func (c *Conn) Hello(proto int, token string) (resp.Map, error) {
+	args := []string{"HELLO", strconv.Itoa(proto)}
+	if token != "" {
+		args = append(args, "AUTH", "default", token)
+	}
+	v, err := c.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	c.proto = proto
+
+	switch v := v.(type) {
+	case resp.Map:
+		return v, nil
+	case resp.Array:
+		// a flat array of keys and values in RESP2
+		m := make(resp.Map, len(v)/2)
+		for i := range m {
+			m[i] = resp.KeyValue{Key: v[2*i], Value: v[2*i+1]}
+		}
+		return m, nil
+	}
+	return nil, errors.Errorf("client: unexpected reply to HELLO %v", v)
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+// fakeServer serves the connection nc: it replies to each request
+// with the values returned by reply, in the protocol version set by
+// the HELLO requests, until nc is closed.
+func fakeServer(nc net.Conn, reply func(req []string) []interface{}) {
+	defer nc.Close()
+
+	dec := resp.NewDecoder(nc)
+	enc := resp.NewEncoder(nc)
+	for {
+		req, err := dec.DecodeRequest()
+		if err != nil {
+			return
+		}
+		if req[0] == "HELLO" && req[1] == "3" {
+			enc.SetProtocol(resp.RESP3)
+		}
+		for _, v := range reply(req) {
+			if err := enc.Encode(v); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// fakeConn returns a Conn to a fakeServer.
+func fakeConn(reply func(req []string) []interface{}) *Conn {
+	client, server := net.Pipe()
+	go fakeServer(server, reply)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return NewConn(client)
+}
+
+// echo replies with the arguments of the request, or with an error if
+// the command is ERR.
+func echo(req []string) []interface{} {
+	if req[0] == "ERR" {
+		return []interface{}{resp.Error("ERR failed")}
+	}
+	return []interface{}{req[1:]}
+}
+
+func TestConnDo(t *testing.T) {
+	c := fakeConn(echo)
+	defer c.Close()
+
+	v, err := c.Do("ECHO", "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (resp.Array{"a", "b"}); !reflect.DeepEqual(v, want) {
+		t.Errorf("want %v, got %v", want, v)
+	}
+
+	_, err = c.Do("ERR")
+	if rerr, ok := err.(*resp.ReplyError); !ok || rerr.Msg != "ERR failed" {
+		t.Errorf("want reply error, got %#v", err)
+	}
+	if err := c.Err(); err != nil {
+		t.Errorf("want usable connection after a reply error, got %v", err)
+	}
+
+	c.Close()
+	if _, err := c.Do("ECHO"); err == nil {
+		t.Errorf("want error on closed connection")
+	}
+}
+
+func TestConnPipeline(t *testing.T) {
+	c := fakeConn(echo)
+	defer c.Close()
+
+	for _, arg := range []string{"a", "b", "c"} {
+		if err := c.Send("ECHO", arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Do("ECHO"); err != ErrPendingReplies {
+		t.Errorf("want %v, got %v", ErrPendingReplies, err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"a", "b", "c"} {
+		v, err := c.Receive()
+		if want := (resp.Array{arg}); err != nil || !reflect.DeepEqual(v, want) {
+			t.Errorf("want %v, got %v and %v", want, v, err)
+		}
+	}
+	if _, err := c.Receive(); err != ErrNoPendingReply {
+		t.Errorf("want %v, got %v", ErrNoPendingReply, err)
+	}
+}
+
+func TestConnRESP3(t *testing.T) {
+	c := fakeConn(func(req []string) []interface{} {
+		switch req[0] {
+		case "HELLO":
+			return []interface{}{resp.Map{{Key: "proto", Value: int64(3)}}}
+		case "PUSH":
+			// out-of-band data before the reply
+			return []interface{}{resp.Push{"message", "chan", "hi"}, true}
+		}
+		return nil
+	})
+	defer c.Close()
+
+	m, err := c.Hello(resp.RESP3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0].Value != int64(3) {
+		t.Errorf("want HELLO reply with proto 3, got %v", m)
+	}
+	if p := c.Protocol(); p != resp.RESP3 {
+		t.Errorf("want protocol 3, got %d", p)
+	}
+
+	var pushed []resp.Push
+	c.PushFunc = func(p resp.Push) { pushed = append(pushed, p) }
+	v, err := c.Do("PUSH")
+	if err != nil || v != true {
+		t.Errorf("want true, got %v and %v", v, err)
+	}
+	if want := []resp.Push{{"message", "chan", "hi"}}; !reflect.DeepEqual(pushed, want) {
+		t.Errorf("want pushed %v, got %v", want, pushed)
+	}
+}
+
+func TestConnHelloRESP2(t *testing.T) {
+	c := fakeConn(func(req []string) []interface{} {
+		return []interface{}{resp.Array{"server", "regis-companion", "proto", int64(2)}}
+	})
+	defer c.Close()
+
+	m, err := c.Hello(resp.RESP2, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := resp.Map{{Key: "server", Value: "regis-companion"}, {Key: "proto", Value: int64(2)}}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("want %v, got %v", want, m)
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const defaultMaxIdle = 2
+
+var (
+	// ErrPoolClosed is returned by Get if the Pool is closed.
+	ErrPoolClosed = errors.New("client: pool closed")
+
+	// ErrPoolExhausted is returned by Get if the Pool has MaxActive
+	// connections in use.
+	ErrPoolExhausted = errors.New("client: connection pool exhausted")
+)
+
+// Pool is a pool of connections, that is safe for concurrent use. The
+// connections are created on demand with Dial, and kept for reuse once
+// returned with Put.
+type Pool struct {
+	// Dial connects a new connection.
+	Dial func() (*Conn, error)
+	// MaxIdle is the maximum number of idle connections kept for reuse.
+	// Defaults to 2.
+	MaxIdle int
+	// MaxActive is the maximum number of connections in use, including
+	// the idle ones. If zero, there is no limit.
+	MaxActive int
+
+	mu     sync.Mutex
+	idle   []*Conn // the most recently used is last
+	active int
+	closed bool
+}
+
+// Get returns an idle connection, or a new one if there is none. The
+// connection must be returned with Put once done.
+func (p *Pool) Get() (*Conn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if c.Err() == nil {
+			p.mu.Unlock()
+			return c, nil
+		}
+		p.active--
+	}
+	if p.MaxActive > 0 && p.active >= p.MaxActive {
+		p.mu.Unlock()
+		return nil, ErrPoolExhausted
+	}
+	p.active++
+	p.mu.Unlock()
+
+	c, err := p.Dial()
+	if err != nil {
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Put returns the connection c obtained with Get to the Pool. It is
+// closed instead if it is unusable, if it has pending replies to
+// pipelined commands, or if the Pool has enough idle connections.
+func (p *Pool) Put(c *Conn) {
+	maxIdle := p.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdle
+	}
+
+	p.mu.Lock()
+	if !p.closed && c.Err() == nil && c.pending == 0 && c.buf.Len() == 0 && len(p.idle) < maxIdle {
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+		return
+	}
+	p.active--
+	p.mu.Unlock()
+	c.Close()
+}
+
+// Do runs the command made of args on a connection of the Pool, and
+// returns its reply, as Conn.Do does.
+func (p *Pool) Do(args ...string) (interface{}, error) {
+	c, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(c)
+	return c.Do(args...)
+}
+
+// Close closes the idle connections, and the connections in use as
+// they are returned with Put.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.active -= len(idle)
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
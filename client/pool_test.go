@@ -0,0 +1,77 @@
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	var dials int
+	p := &Pool{
+		Dial: func() (*Conn, error) {
+			dials++
+			return fakeConn(echo), nil
+		},
+		MaxIdle:   1,
+		MaxActive: 2,
+	}
+
+	c1, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(); err != ErrPoolExhausted {
+		t.Errorf("want %v, got %v", ErrPoolExhausted, err)
+	}
+
+	// c1 is kept idle, c2 is closed as MaxIdle is reached
+	p.Put(c1)
+	p.Put(c2)
+	if c1.Err() != nil || c2.Err() == nil {
+		t.Errorf("want only the second connection closed, got %v and %v", c1.Err(), c2.Err())
+	}
+
+	// the idle connection is reused
+	if v, err := p.Do("ECHO", "a"); err != nil || dials != 2 {
+		t.Errorf("want reply from the idle connection, got %v and %v after %d dials", v, err, dials)
+	}
+
+	// a connection with pending replies is not reused
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != c1 {
+		t.Errorf("want the idle connection")
+	}
+	c.Send("ECHO")
+	p.Put(c)
+	if c.Err() == nil {
+		t.Errorf("want the connection with pending replies closed")
+	}
+
+	if _, err := p.Do("ECHO", "b"); err != nil || dials != 3 {
+		t.Errorf("want reply from a new connection, got %v after %d dials", err, dials)
+	}
+	p.Close()
+	if _, err := p.Get(); err != ErrPoolClosed {
+		t.Errorf("want %v, got %v", ErrPoolClosed, err)
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	dialErr := errors.New("dial")
+	p := &Pool{
+		Dial:      func() (*Conn, error) { return nil, dialErr },
+		MaxActive: 1,
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.Get(); err != dialErr {
+			t.Errorf("%d: want %v, got %v", i, dialErr, err)
+		}
+	}
+}
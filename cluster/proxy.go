@@ -0,0 +1,389 @@
+// Package cluster implements a Redis Cluster aware filter for the SSH
+// tunnels, that rewrites the addresses of the cluster nodes advertised
+// by the servers so that they point to local tunnels to those nodes.
+package cluster
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/harfangapps/regis-companion/common"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+
+	"github.com/pkg/errors"
+)
+
+// kinds of the requests whose replies are rewritten
+const (
+	other = iota
+	clusterSlots
+	clusterShards
+	clusterNodes
+)
+
+// ResolveFunc returns the local address of the tunnel to the cluster
+// node at the address host:port.
+type ResolveFunc func(host string, port int) (localHost string, localPort int, err error)
+
+// Proxy is a tunnel.Filter that rewrites the addresses of the cluster
+// nodes in the replies of a Redis Cluster node: in the -MOVED and -ASK
+// redirection errors, and in the replies to the CLUSTER SLOTS, CLUSTER
+// SHARDS and CLUSTER NODES commands. It supports the RESP2 and RESP3
+// protocols.
+type Proxy struct {
+	// DefaultHost is the host of the node the tunnel connects to. It is
+	// used for the node addresses with an empty or unknown host, which
+	// Redis uses for the node that sends the reply.
+	DefaultHost string
+
+	// Resolve returns the local address to use for a node address.
+	Resolve ResolveFunc
+
+	// The channel to send errors to. If nil, the errors are logged.
+	// If the send would block, the error is dropped.
+	ErrChan chan<- error
+}
+
+// NewConn implements tunnel.Filter.
+func (p *Proxy) NewConn() (toRemote, toLocal tunnel.CopyFunc) {
+	c := &conn{p: p}
+	c.cond = sync.NewCond(&c.mu)
+	return c.copyRequests, c.copyReplies
+}
+
+// conn holds the state of a forwarded connection.
+type conn struct {
+	p *Proxy
+
+	// out is held while writing to the local side, so that an error
+	// reply to a request is not mixed with the replies.
+	out sync.Mutex
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when the following fields change
+	pending []int      // kinds of the requests waiting for a reply
+	untrack bool       // true if replies cannot be matched with requests
+	local   *stream    // the replies stream, once they are copied
+	stopped bool       // true once the replies are not copied anymore
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// copyRequests copies the requests from src to dst, keeping track of
+// the ones whose replies must be rewritten.
+func (c *conn) copyRequests(dst io.Writer, src io.Reader) (int64, error) {
+	cw := &countingWriter{w: dst}
+	s := newStream(cw, src)
+
+	for {
+		args, err := c.copyRequest(s)
+		if err != nil {
+			switch err {
+			case io.EOF:
+				err = s.w.Flush()
+			case resp.ErrInlineTooLong:
+				// reply and close the connection as Redis does, after
+				// the previous requests
+				if err := s.w.Flush(); err != nil {
+					return cw.n, err
+				}
+				c.replyError(resp.Error("ERR Protocol error: too big inline request"))
+			}
+			return cw.n, err
+		}
+		c.track(args)
+
+		// flush when there are no more pipelined requests
+		if s.r.Buffered() == 0 {
+			if err := s.w.Flush(); err != nil {
+				return cw.n, err
+			}
+		}
+	}
+}
+
+// copyRequest copies a request, and returns its first two arguments in
+// lowercase.
+func (c *conn) copyRequest(s *stream) ([]string, error) {
+	b, err := s.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	if b[0] != '*' {
+		// inline command, copied as is
+		line, err := s.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, resp.ErrInlineTooLong
+		}
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		args = strings.Fields(string(line))
+		if _, err := s.w.Write(line); err != nil {
+			return nil, err
+		}
+	} else {
+		if args, err = s.dec.DecodeRequest(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err := s.enc.Encode(args); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) > 2 {
+		args = args[:2]
+	}
+	for i, arg := range args {
+		args[i] = strings.ToLower(arg)
+	}
+	return args, nil
+}
+
+// replyError writes the error reply e to the local side once the
+// replies to the previous requests are copied, unless they cannot be
+// matched with the requests anymore. Nothing is written if the replies
+// are not copied anymore.
+func (c *conn) replyError(e resp.Error) {
+	c.mu.Lock()
+	for !c.stopped && (c.local == nil || (!c.untrack && len(c.pending) > 0)) {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	c.mu.Lock()
+	local, stopped := c.local, c.stopped
+	c.mu.Unlock()
+	if stopped {
+		return
+	}
+	if err := local.enc.Encode(e); err == nil {
+		local.w.Flush()
+	}
+}
+
+// track registers the kind of the request with the args.
+func (c *conn) track(args []string) {
+	kind := other
+	if len(args) == 2 && args[0] == "cluster" {
+		switch args[1] {
+		case "slots":
+			kind = clusterSlots
+		case "shards":
+			kind = clusterShards
+		case "nodes":
+			kind = clusterNodes
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.untrack {
+		return
+	}
+	if len(args) > 0 {
+		switch args[0] {
+		case "subscribe", "psubscribe", "ssubscribe", "monitor":
+			// the replies do not match the requests anymore
+			c.untrack = true
+			c.pending = nil
+			return
+		}
+	}
+	c.pending = append(c.pending, kind)
+}
+
+// next returns the kind of the request for the next reply.
+func (c *conn) next() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		return other
+	}
+	kind := c.pending[0]
+	c.pending = c.pending[1:]
+	c.cond.Broadcast()
+	return kind
+}
+
+// copyReplies copies the replies from src to dst, rewriting the cluster
+// nodes addresses.
+func (c *conn) copyReplies(dst io.Writer, src io.Reader) (int64, error) {
+	cw := &countingWriter{w: dst}
+	s := newStream(cw, src)
+
+	c.mu.Lock()
+	c.local = s
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	var err error
+	for {
+		// wait for the next replies without holding the local side, the
+		// previous ones are flushed
+		if _, err = s.r.Peek(1); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		c.out.Lock()
+		err = c.copyPipelinedReplies(s)
+		c.out.Unlock()
+		if err != nil {
+			break
+		}
+	}
+
+	// no error reply is written to the local side from now on
+	c.out.Lock()
+	c.mu.Lock()
+	c.stopped = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.out.Unlock()
+	return cw.n, err
+}
+
+// copyPipelinedReplies copies the replies up to the end of the buffered
+// data, and flushes them.
+func (c *conn) copyPipelinedReplies(s *stream) error {
+	for {
+		if err := c.copyReply(s); err != nil {
+			return err
+		}
+		if s.r.Buffered() == 0 {
+			return s.w.Flush()
+		}
+	}
+}
+
+// copyReply copies a reply, rewriting it if required.
+func (c *conn) copyReply(s *stream) error {
+	b, err := s.r.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	switch b[0] {
+	case '>':
+		// push messages are not replies to requests
+		return s.dec.CopyValue(s.w)
+
+	case '-':
+		c.next()
+		v, err := s.dec.Decode()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		return s.encode(resp.Error(c.rewriteRedirect(string(v.(resp.Error)))))
+	}
+
+	kind := c.next()
+	if kind == other {
+		return s.dec.CopyValue(s.w)
+	}
+
+	v, err := s.dec.Decode()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	// the attributes precede the actual reply
+	reply := v
+	a, attributed := v.(resp.Attributed)
+	if attributed {
+		reply = a.Value
+	}
+	switch kind {
+	case clusterSlots:
+		c.rewriteSlots(reply)
+	case clusterShards:
+		c.rewriteShards(reply)
+	case clusterNodes:
+		reply = c.rewriteNodes(reply)
+	}
+	if attributed {
+		a.Value = reply
+		reply = a
+	}
+	return s.encode(reply)
+}
+
+// rewriteRedirect rewrites the address of a MOVED or ASK error, e.g.
+// "MOVED 3999 10.0.0.1:6381".
+func (c *conn) rewriteRedirect(msg string) string {
+	if !strings.HasPrefix(msg, "MOVED ") && !strings.HasPrefix(msg, "ASK ") {
+		return msg
+	}
+	fields := strings.Fields(msg)
+	if len(fields) != 3 {
+		return msg
+	}
+	addr, ok := c.localAddr(fields[2])
+	if !ok {
+		return msg
+	}
+	fields[2] = addr
+	return strings.Join(fields, " ")
+}
+
+// localAddr returns the local address to use for the node address
+// host:port.
+func (c *conn) localAddr(addr string) (string, bool) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return "", false
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr[:i], "["), "]")
+	port, err := strconv.Atoi(addr[i+1:])
+	if err != nil {
+		return "", false
+	}
+
+	localHost, localPort, ok := c.resolve(host, int64(port))
+	if !ok {
+		return "", false
+	}
+	return net.JoinHostPort(localHost, strconv.FormatInt(localPort, 10)), true
+}
+
+// resolve returns the local host and port to use for the node address
+// host:port.
+func (c *conn) resolve(host string, port int64) (string, int64, bool) {
+	if port <= 0 || port > 65535 {
+		return "", 0, false
+	}
+	if host == "" || host == "?" {
+		host = c.p.DefaultHost
+	}
+
+	localHost, localPort, err := c.p.Resolve(host, int(port))
+	if err != nil {
+		err = errors.Wrapf(err, "cluster node %s:%d", host, port)
+		common.HandleError(err, c.p.ErrChan)
+		return "", 0, false
+	}
+	return localHost, int64(localPort), true
+}
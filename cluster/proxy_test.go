@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+// resolve maps the node 10.0.0.N:P to 127.0.0.1:(N*10000+P%10000).
+func resolve(host string, port int) (string, int, error) {
+	var n int
+	if _, err := fmt.Sscanf(host, "10.0.0.%d", &n); err != nil {
+		return "", 0, fmt.Errorf("unknown host %s", host)
+	}
+	return "127.0.0.1", n*10000 + port%10000, nil
+}
+
+func TestProxy(t *testing.T) {
+	cases := []struct {
+		desc string
+		req  string
+		rep  string
+		want string // if empty, the replies are unchanged
+	}{
+		{"ping", "*1\r\n$4\r\nPING\r\n", "+PONG\r\n", ""},
+		{"error", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "-ERR wrong type\r\n", ""},
+		{"moved", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "-MOVED 3999 10.0.0.2:6380\r\n",
+			"-MOVED 3999 127.0.0.1:26380\r\n"},
+		{"ask", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "-ASK 3999 10.0.0.3:6379\r\n",
+			"-ASK 3999 127.0.0.1:36379\r\n"},
+		{"moved unknown host", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "-MOVED 3999 :6380\r\n",
+			"-MOVED 3999 127.0.0.1:16380\r\n"},
+		{"moved unresolved", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "-MOVED 3999 192.168.1.1:6380\r\n", ""},
+		{"get cluster-like", "*2\r\n$3\r\nGET\r\n$5\r\nslots\r\n",
+			"*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n$8\r\n10.0.0.2\r\n:6379\r\n", ""},
+
+		{"slots", "*2\r\n$7\r\ncluster\r\n$5\r\nSLOTS\r\n",
+			"*2\r\n" +
+				"*4\r\n:0\r\n:5460\r\n*3\r\n$8\r\n10.0.0.2\r\n:6379\r\n$2\r\nid\r\n*2\r\n$8\r\n10.0.0.3\r\n:6380\r\n" +
+				"*3\r\n:5461\r\n:16383\r\n*3\r\n$0\r\n\r\n:6381\r\n$2\r\nid\r\n",
+			"*2\r\n" +
+				"*4\r\n:0\r\n:5460\r\n*3\r\n$9\r\n127.0.0.1\r\n:26379\r\n$2\r\nid\r\n*2\r\n$9\r\n127.0.0.1\r\n:36380\r\n" +
+				"*3\r\n:5461\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:16381\r\n$2\r\nid\r\n"},
+
+		{"shards resp2", "*2\r\n$7\r\nCLUSTER\r\n$6\r\nSHARDS\r\n",
+			"*1\r\n*4\r\n$5\r\nslots\r\n*2\r\n:0\r\n:10\r\n$5\r\nnodes\r\n*1\r\n" +
+				"*8\r\n$2\r\nid\r\n$1\r\na\r\n$4\r\nport\r\n:6379\r\n$2\r\nip\r\n$8\r\n10.0.0.2\r\n$8\r\nendpoint\r\n$8\r\n10.0.0.2\r\n",
+			"*1\r\n*4\r\n$5\r\nslots\r\n*2\r\n:0\r\n:10\r\n$5\r\nnodes\r\n*1\r\n" +
+				"*8\r\n$2\r\nid\r\n$1\r\na\r\n$4\r\nport\r\n:26379\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n$8\r\nendpoint\r\n$9\r\n127.0.0.1\r\n"},
+
+		{"shards resp3", "*2\r\n$7\r\nCLUSTER\r\n$6\r\nSHARDS\r\n",
+			"*1\r\n%1\r\n+nodes\r\n*1\r\n%3\r\n+ip\r\n+10.0.0.4\r\n+port\r\n:7000\r\n+tls-port\r\n:7001\r\n",
+			"*1\r\n%1\r\n+nodes\r\n*1\r\n%3\r\n+ip\r\n+127.0.0.1\r\n+port\r\n:47000\r\n+tls-port\r\n:47001\r\n"},
+
+		{"nodes", "*2\r\n$7\r\nCLUSTER\r\n$5\r\nNODES\r\n",
+			bulk("a1 10.0.0.2:6379@16379 myself,master - 0 0 1 connected 0-5460\n" +
+				"b2 10.0.0.3:6379@16379,host.example master - 0 0 2 connected 5461-16383\n"),
+			bulk("a1 127.0.0.1:26379@16379 myself,master - 0 0 1 connected 0-5460\n" +
+				"b2 127.0.0.1:36379@16379,host.example master - 0 0 2 connected 5461-16383\n")},
+
+		{"nodes verbatim", "*2\r\n$7\r\nCLUSTER\r\n$5\r\nNODES\r\n",
+			"=" + bulk("txt:a1 10.0.0.2:6379@16379 myself,master - 0 0 1 connected\n")[1:],
+			"=" + bulk("txt:a1 127.0.0.1:26379@16379 myself,master - 0 0 1 connected\n")[1:]},
+
+		{"slots nil resp2", "*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n",
+			"*2\r\n*-1\r\n*3\r\n:0\r\n:10\r\n*3\r\n$8\r\n10.0.0.2\r\n:6379\r\n$-1\r\n",
+			"*2\r\n*-1\r\n*3\r\n:0\r\n:10\r\n*3\r\n$9\r\n127.0.0.1\r\n:26379\r\n$-1\r\n"},
+
+		{"slots null resp3", "*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n",
+			"*2\r\n_\r\n*3\r\n:0\r\n:10\r\n*4\r\n$8\r\n10.0.0.2\r\n:6379\r\n_\r\n%1\r\n+hostname\r\n$0\r\n\r\n",
+			"*2\r\n_\r\n*3\r\n:0\r\n:10\r\n*4\r\n$9\r\n127.0.0.1\r\n:26379\r\n_\r\n%1\r\n+hostname\r\n$0\r\n\r\n"},
+
+		{"inline", "cluster slots\r\n",
+			"*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n$8\r\n10.0.0.2\r\n:6379\r\n",
+			"*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n$9\r\n127.0.0.1\r\n:26379\r\n"},
+
+		{"pipeline", "*1\r\n$4\r\nPING\r\n*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\nb\r\n",
+			"+PONG\r\n*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n+10.0.0.2\r\n:6379\r\n-MOVED 1 10.0.0.2:6379\r\n",
+			"+PONG\r\n*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n+127.0.0.1\r\n:26379\r\n-MOVED 1 127.0.0.1:26379\r\n"},
+
+		{"push", "*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n",
+			">2\r\n+invalidate\r\n*1\r\n$1\r\na\r\n*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n+10.0.0.2\r\n:6379\r\n",
+			">2\r\n+invalidate\r\n*1\r\n$1\r\na\r\n*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n+127.0.0.1\r\n:26379\r\n"},
+
+		{"attribute", "*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n",
+			"|1\r\n+key\r\n:1\r\n*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n+10.0.0.2\r\n:6379\r\n",
+			"|1\r\n+key\r\n:1\r\n*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n+127.0.0.1\r\n:26379\r\n"},
+
+		{"subscribe", "*2\r\n$9\r\nSUBSCRIBE\r\n$1\r\nc\r\n*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n",
+			"*3\r\n$9\r\nsubscribe\r\n$1\r\nc\r\n:1\r\n*1\r\n*3\r\n:0\r\n:10\r\n*2\r\n+10.0.0.2\r\n:6379\r\n", ""},
+
+		{"passthrough", "*1\r\n$5\r\nHELLO\r\n",
+			"%2\r\n+server\r\n$5\r\nredis\r\n+proto\r\n:3\r\n_\r\n,1.5\r\n#t\r\n(123\r\n~1\r\n!3\r\nerr\r\n$-1\r\n*-1\r\n", ""},
+	}
+
+	for _, c := range cases {
+		p := &Proxy{DefaultHost: "10.0.0.1", Resolve: resolve, ErrChan: make(chan error, 10)}
+		toRemote, toLocal := p.NewConn()
+
+		var reqBuf, repBuf bytes.Buffer
+		n, err := toRemote(&reqBuf, strings.NewReader(c.req))
+		if err != nil {
+			t.Errorf("%s: want no request error, got %v", c.desc, err)
+			continue
+		}
+		if n != int64(len(c.req)) {
+			t.Errorf("%s: want %d request bytes, got %d", c.desc, len(c.req), n)
+		}
+		if got := reqBuf.String(); got != c.req {
+			t.Errorf("%s: want request %q, got %q", c.desc, c.req, got)
+		}
+
+		if _, err := toLocal(&repBuf, strings.NewReader(c.rep)); err != nil {
+			t.Errorf("%s: want no reply error, got %v", c.desc, err)
+			continue
+		}
+		want := c.want
+		if want == "" {
+			want = c.rep
+		}
+		if got := repBuf.String(); got != want {
+			t.Errorf("%s: want reply %q, got %q", c.desc, want, got)
+		}
+	}
+}
+
+func TestProxyInvalid(t *testing.T) {
+	cases := []struct {
+		req string
+		rep string
+		err error
+	}{
+		{"*1\r\n$4\r\nPING\r\n", "!x\r\n", resp.ErrInvalidInteger},
+		{"*1\r\n$4\r\nPING\r\n", "?x\r\n", resp.ErrInvalidPrefix},
+		{"*1\r\n$4\r\nPING\r\n", "+OK\rx", resp.ErrMissingCRLF},
+		{"*1\r\n$4\r\nPING\r\n", "+OK\n", io.ErrUnexpectedEOF},
+		{"*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n", "*2\r\n:1\r\n", io.ErrUnexpectedEOF},
+		{"*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n", strings.Repeat("*1\r\n", maxDepth+2), resp.ErrTooDeep},
+
+		// the limits apply to the copied values as to the rewritten ones
+		{"*1\r\n$4\r\nPING\r\n", strings.Repeat("*1\r\n", maxDepth+2), resp.ErrTooDeep},
+		{"*1\r\n$4\r\nPING\r\n", strings.Repeat("|1\r\n_\r\n_\r\n", 1<<20) + "_\r\n", resp.ErrTooDeep},
+		{"*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n", strings.Repeat("|1\r\n_\r\n_\r\n", 1<<20) + "_\r\n", resp.ErrTooDeep},
+		{"*1\r\n$4\r\nPING\r\n", "$536870913\r\n", resp.ErrInvalidBulkString},
+		{"*2\r\n$7\r\nCLUSTER\r\n$5\r\nNODES\r\n", "$536870913\r\n", resp.ErrInvalidBulkString},
+		{"*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n", "*16777217\r\n", resp.ErrInvalidArray},
+	}
+
+	for i, c := range cases {
+		p := &Proxy{Resolve: resolve}
+		toRemote, toLocal := p.NewConn()
+
+		var buf bytes.Buffer
+		if _, err := toRemote(&buf, strings.NewReader(c.req)); err != nil {
+			t.Errorf("%d: want no request error, got %v", i, err)
+			continue
+		}
+		if _, err := toLocal(&buf, strings.NewReader(c.rep)); err != c.err {
+			t.Errorf("%d: want error %v, got %v", i, c.err, err)
+		}
+	}
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// remoteFunc is the remote side of a connection, that calls the function
+// with the data written to it.
+type remoteFunc func(b []byte)
+
+func (f remoteFunc) Write(b []byte) (int, error) {
+	f(b)
+	return len(b), nil
+}
+
+func TestProxyInlineTooBig(t *testing.T) {
+	p := &Proxy{Resolve: resolve}
+	toRemote, toLocal := p.NewConn()
+
+	rr, rw := io.Pipe()
+	var sent bytes.Buffer
+	remote := remoteFunc(func(b []byte) {
+		sent.Write(b)
+		go rw.Write([]byte("+PONG\r\n"))
+	})
+
+	var local bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := toLocal(&local, rr)
+		done <- err
+	}()
+
+	// the error is replied after the previous request
+	req := "PING\r\n" + strings.Repeat("a", bufferSize) + "\r\n"
+	if _, err := toRemote(remote, strings.NewReader(req)); err != resp.ErrInlineTooLong {
+		t.Errorf("want error %v, got %v", resp.ErrInlineTooLong, err)
+	}
+	rw.Close()
+	if err := <-done; err != nil {
+		t.Errorf("want no reply error, got %v", err)
+	}
+
+	if got := sent.String(); got != "PING\r\n" {
+		t.Errorf("want request %q, got %q", "PING\r\n", got)
+	}
+	want := "+PONG\r\n-ERR Protocol error: too big inline request\r\n"
+	if got := local.String(); got != want {
+		t.Errorf("want reply %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"strings"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+// rewriteSlots rewrites the reply to CLUSTER SLOTS, an array of slot
+// ranges, each one an array of the first slot, the last slot and the
+// nodes serving them:
+//
+//  1. 1) (integer) 0
+//  2. (integer) 5460
+//  3. 1) "10.0.0.1"
+//  2. (integer) 6379
+//  3. "09dbe9720cda62f7865eabc5fd8857c5d2678366"
+//  4. (metadata...)
+func (c *conn) rewriteSlots(v interface{}) {
+	slots, _ := v.(resp.Array)
+	for _, el := range slots {
+		slot, ok := el.(resp.Array)
+		if !ok || len(slot) < 3 {
+			continue
+		}
+		for _, el := range slot[2:] {
+			node, ok := el.(resp.Array)
+			if !ok || len(node) < 2 {
+				continue
+			}
+			host, ok := str(node[0])
+			port, isInt := node[1].(int64)
+			if !ok || !isInt {
+				continue
+			}
+			if localHost, localPort, ok := c.resolve(host, port); ok {
+				node[0] = withStr(node[0], localHost)
+				node[1] = localPort
+			}
+		}
+	}
+}
+
+// rewriteShards rewrites the reply to CLUSTER SHARDS, an array of shards,
+// each one a map with the slots and nodes of the shard. Each node is a
+// map with, among others, the ip, endpoint, port and tls-port fields.
+// In RESP2, the maps are arrays of key-value pairs.
+func (c *conn) rewriteShards(v interface{}) {
+	shards, _ := v.(resp.Array)
+	for _, shard := range shards {
+		nodes := field(shard, "nodes")
+		if nodes == nil {
+			continue
+		}
+		list, _ := (*nodes).(resp.Array)
+		for _, node := range list {
+			c.rewriteShardNode(node)
+		}
+	}
+}
+
+func (c *conn) rewriteShardNode(node interface{}) {
+	host := ""
+	for _, key := range []string{"ip", "endpoint"} {
+		if f := field(node, key); f != nil {
+			if s, ok := str(*f); ok && s != "" && s != "?" {
+				host = s
+				break
+			}
+		}
+	}
+
+	var localHost string
+	for _, key := range []string{"port", "tls-port"} {
+		f := field(node, key)
+		if f == nil {
+			continue
+		}
+		port, ok := (*f).(int64)
+		if !ok {
+			continue
+		}
+		if h, p, ok := c.resolve(host, port); ok {
+			localHost = h
+			*f = p
+		}
+	}
+
+	if localHost == "" {
+		return
+	}
+	for _, key := range []string{"ip", "endpoint"} {
+		if f := field(node, key); f != nil {
+			if _, ok := str(*f); ok {
+				*f = withStr(*f, localHost)
+			}
+		}
+	}
+}
+
+// rewriteNodes rewrites the reply to CLUSTER NODES, a bulk string (or a
+// verbatim string in RESP3) with one line per node, in the form:
+//
+//	<id> <ip:port@cport[,hostname]> <flags> <master> ...
+//
+// It returns the rewritten reply.
+func (c *conn) rewriteNodes(v interface{}) interface{} {
+	text, ok := str(v)
+	if !ok {
+		return v
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			continue
+		}
+
+		addr := fields[1]
+		suffix := ""
+		if j := strings.IndexAny(addr, "@,"); j >= 0 {
+			addr, suffix = addr[:j], addr[j:]
+		}
+		if local, ok := c.localAddr(addr); ok {
+			fields[1] = local + suffix
+			lines[i] = strings.Join(fields, " ")
+		}
+	}
+	return withStr(v, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"bufio"
+	"io"
+	"math/big"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+const (
+	// size of the read buffer, which is the maximum length of an inline
+	// request
+	bufferSize = 64 << 10
+	// maximum nesting depth of aggregate values
+	maxDepth = 32
+)
+
+// stream decodes the values read from a connection and encodes them to
+// the other side.
+type stream struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	dec *resp.Decoder
+	enc *resp.Encoder
+}
+
+func newStream(dst io.Writer, src io.Reader) *stream {
+	r := bufio.NewReaderSize(src, bufferSize)
+	w := bufio.NewWriter(dst)
+
+	dec := resp.NewDecoder(r)
+	dec.SetLimits(resp.Limits{MaxDepth: maxDepth})
+
+	// the Encoder flushes each value to w, which is only flushed when
+	// there are no more pipelined values, so it must not use w as its
+	// own buffer.
+	enc := resp.NewEncoder(struct{ io.Writer }{w})
+	return &stream{r: r, w: w, dec: dec, enc: enc}
+}
+
+// encode encodes the decoded value v as it was received.
+func (s *stream) encode(v interface{}) error {
+	s.enc.SetProtocol(protocol(v))
+	return s.enc.Encode(v)
+}
+
+// protocol returns the version of the protocol that encodes the decoded
+// value v as it was received: RESP3 if it contains a RESP3 type, RESP2
+// otherwise, as the nil arrays of RESP2 are nulls in RESP3.
+func protocol(v interface{}) int {
+	switch v := v.(type) {
+	case resp.Array:
+		for _, el := range v {
+			if protocol(el) == resp.RESP3 {
+				return resp.RESP3
+			}
+		}
+	case resp.Map, resp.Set, resp.Push, resp.Attributed, resp.Null,
+		resp.BlobError, resp.VerbatimString, float64, bool, *big.Int:
+		return resp.RESP3
+	}
+	return resp.RESP2
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF if err is io.EOF, as it is
+// returned in the middle of a value.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// str returns the text of v if it is a simple, bulk or verbatim string.
+func str(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case resp.SimpleString:
+		return string(v), true
+	case resp.VerbatimString:
+		return v.Text, true
+	}
+	return "", false
+}
+
+// withStr returns s as a string of the same type as v, a string for
+// which str returns true.
+func withStr(v interface{}, s string) interface{} {
+	switch v := v.(type) {
+	case resp.SimpleString:
+		return resp.SimpleString(s)
+	case resp.VerbatimString:
+		v.Text = s
+		return v
+	}
+	return s
+}
+
+// field returns the value of the key in the map v, which may be a RESP3
+// map or a RESP2 array of key-value pairs, so that it can be replaced.
+// It returns nil if there is no such key.
+func field(v interface{}, key string) *interface{} {
+	switch v := v.(type) {
+	case resp.Map:
+		for i := range v {
+			if k, ok := str(v[i].Key); ok && k == key {
+				return &v[i].Value
+			}
+		}
+	case resp.Array:
+		for i := 0; i+1 < len(v); i += 2 {
+			if k, ok := str(v[i]); ok && k == key {
+				return &v[i+1]
+			}
+		}
+	}
+	return nil
+}
@@ -14,6 +14,8 @@ type IdleTracker struct {
 
 	currentCounter  uint64
 	previousCounter uint64
+	lastCheck       int64 // UnixNano time of the start or the last check
+	expired         int32 // 1 once the context is cancelled due to inactivity
 }
 
 // Start starts the tracker. If the IdleTimeout is less than or equal to
@@ -33,6 +35,7 @@ func (t *IdleTracker) track(ctx context.Context, cancel func(), d Doner) {
 
 	done := ctx.Done()
 	for {
+		atomic.StoreInt64(&t.lastCheck, time.Now().UnixNano())
 		select {
 		case <-time.After(t.IdleTimeout):
 			current := atomic.LoadUint64(&t.currentCounter)
@@ -40,6 +43,7 @@ func (t *IdleTracker) track(ctx context.Context, cancel func(), d Doner) {
 
 			if current == previous {
 				// no activity since last check
+				atomic.StoreInt32(&t.expired, 1)
 				cancel()
 				return
 			}
@@ -52,6 +56,36 @@ func (t *IdleTracker) track(ctx context.Context, cancel func(), d Doner) {
 	}
 }
 
+// Remaining returns the duration before the tracker cancels its
+// context if there is no more activity. It returns 0 if there is no
+// tracking to do, and the IdleTimeout if the tracker is not started.
+func (t *IdleTracker) Remaining() time.Duration {
+	if t.IdleTimeout <= 0 {
+		return 0
+	}
+	last := atomic.LoadInt64(&t.lastCheck)
+	if last == 0 {
+		return t.IdleTimeout
+	}
+
+	// the next check cancels the context if there was no activity since
+	// the last one, otherwise the check after that
+	next := time.Unix(0, last).Add(t.IdleTimeout)
+	if atomic.LoadUint64(&t.currentCounter) != atomic.LoadUint64(&t.previousCounter) {
+		next = next.Add(t.IdleTimeout)
+	}
+	if d := time.Until(next); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Expired returns true if the tracker cancelled its context because
+// there was no activity.
+func (t *IdleTracker) Expired() bool {
+	return atomic.LoadInt32(&t.expired) == 1
+}
+
 // Touch notifies the tracker of activity.
 func (t *IdleTracker) Touch() {
 	if t.IdleTimeout > 0 {
@@ -37,6 +37,9 @@ func TestIdleTrackerNoActivity(t *testing.T) {
 		if duration < want || duration > (want+(10*time.Millisecond)) {
 			t.Errorf("want duration of %v, got %v", want, duration)
 		}
+		if expired := c > 0 && c < timeout; tracker.Expired() != expired {
+			t.Errorf("%v: want Expired %t, got %t", c, expired, tracker.Expired())
+		}
 	}
 }
 
@@ -92,3 +95,33 @@ func TestIdleTrackerConn(t *testing.T) {
 		t.Errorf("want duration of %v, got %v", want, duration)
 	}
 }
+
+func TestIdleTrackerRemaining(t *testing.T) {
+	idle := 100 * time.Millisecond
+	tracker := &IdleTracker{IdleTimeout: idle}
+	if d := tracker.Remaining(); d != idle {
+		t.Errorf("want %v before start, got %v", idle, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	tracker.Start(ctx, cancel, wg)
+
+	<-time.After(40 * time.Millisecond)
+	if d := tracker.Remaining(); d > 60*time.Millisecond || d < 40*time.Millisecond {
+		t.Errorf("want about 60ms without activity, got %v", d)
+	}
+
+	// the activity postpones the cancellation to the next check
+	tracker.Touch()
+	if d := tracker.Remaining(); d > 160*time.Millisecond || d < 140*time.Millisecond {
+		t.Errorf("want about 160ms after activity, got %v", d)
+	}
+	wg.Wait()
+
+	if d := (&IdleTracker{}).Remaining(); d != 0 {
+		t.Errorf("want 0 without idle timeout, got %v", d)
+	}
+}
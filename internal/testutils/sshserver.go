@@ -0,0 +1,137 @@
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHServer is an in-process SSH server that can be used for tests. It
+// accepts direct-tcpip channels and forwards them to the requested
+// address, and rejects all other channels and requests.
+type SSHServer struct {
+	// Addr is the address the server listens on.
+	Addr *net.TCPAddr
+	// HostKey is the public host key of the server.
+	HostKey ssh.PublicKey
+
+	l  net.Listener
+	wg sync.WaitGroup
+}
+
+// StartSSHServer starts an SSH server on a random port of the loopback
+// interface with the provided configuration. A host key is generated
+// and added to the configuration.
+func StartSSHServer(config *ssh.ServerConfig) (*SSHServer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SSHServer{
+		Addr:    l.Addr().(*net.TCPAddr),
+		HostKey: signer.PublicKey(),
+		l:       l,
+	}
+	s.wg.Add(1)
+	go s.serve(config)
+	return s, nil
+}
+
+// Close stops the server. Established connections are not closed.
+func (s *SSHServer) Close() error {
+	err := s.l.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *SSHServer) serve(config *ssh.ServerConfig) {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn, config)
+	}
+}
+
+func (s *SSHServer) handle(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "direct-tcpip" {
+			nch.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		go forward(nch)
+	}
+}
+
+// forward handles a direct-tcpip channel request.
+func forward(nch ssh.NewChannel) {
+	// RFC 4254 7.2: host to connect, port to connect, originator
+	// address and originator port.
+	data := nch.ExtraData()
+	host, rest, ok := parseString(data)
+	if !ok || len(rest) < 4 {
+		nch.Reject(ssh.ConnectionFailed, "invalid request")
+		return
+	}
+	port := binary.BigEndian.Uint32(rest)
+
+	remote, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		nch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		remote.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, remote)
+		ch.CloseWrite()
+	}()
+	io.Copy(remote, ch)
+	remote.Close()
+	ch.Close()
+}
+
+func parseString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < n {
+		return "", nil, false
+	}
+	return string(b[:n]), b[n:], true
+}
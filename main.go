@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"expvar"
 	"flag"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,14 +22,42 @@ var (
 	versionFlag              = flag.Bool("version", false, "Print the version.")
 	generateLaunchdPlistFlag = flag.Bool("generate-launchd-plist", false, "Generate a skeleton launchd `plist` file.")
 
-	addrFlag              = flag.String("addr", "127.0.0.1", "The `address` to bind to.")
-	portFlag              = flag.Int("port", 7070, "Port `number` to listen on.")
-	tunnelIdleTimeoutFlag = flag.Duration("tunnel-idle-timeout", 30*time.Minute, "Idle `timeout` for inactive SSH tunnels.")
-	writeTimeoutFlag      = flag.Duration("write-timeout", 30*time.Second, "Write `timeout`.")
-	sshDialTimeoutFlag    = flag.Duration("ssh-dial-timeout", 30*time.Second, "SSH dial `timeout`.")
-	knownHostsFileFlag    = flag.String("known-hosts-file", "${HOME}/.ssh/known_hosts", "Known hosts `file`.")
+	addrFlag                 = flag.String("addr", "127.0.0.1", "The `address` to bind to.")
+	portFlag                 = flag.Int("port", 7070, "Port `number` to listen on.")
+	unixSocketFlag           = flag.String("unix-socket", "", "Unix socket `path` to listen on instead of -addr and -port.")
+	tunnelSocketDirFlag      = flag.String("tunnel-socket-dir", "", "`Directory` of the Unix sockets of the tunnels, defaults to a directory in the temporary directory.")
+	tunnelIdleTimeoutFlag    = flag.Duration("tunnel-idle-timeout", 30*time.Minute, "Idle `timeout` for inactive SSH tunnels.")
+	writeTimeoutFlag         = flag.Duration("write-timeout", 30*time.Second, "Write `timeout`.")
+	authChallengeTimeoutFlag = flag.Duration("auth-challenge-timeout", 2*time.Minute, "`Timeout` to answer an interactive authentication challenge.")
+	hostKeyTimeoutFlag       = flag.Duration("host-key-timeout", 30*time.Second, "`Timeout` to verify the host keys of a new sentinel tunnel, or the TLS connection of an interactive tunnel, before replying with its address.")
+	sshDialTimeoutFlag       = flag.Duration("ssh-dial-timeout", 30*time.Second, "SSH dial `timeout`.")
+	sshKeepaliveIntervalFlag = flag.Duration("ssh-keepalive-interval", 30*time.Second, "`Interval` between SSH keepalive requests, 0 to disable.")
+	sshKeepaliveCountMaxFlag = flag.Int("ssh-keepalive-count-max", 3, "`Number` of failed SSH keepalive requests before reconnecting.")
+	knownHostsFileFlag       = flag.String("known-hosts-file", "${HOME}/.ssh/known_hosts", "Known hosts `file`.")
+	sshConfigFileFlag        = flag.String("ssh-config-file", "${HOME}/.ssh/config", "OpenSSH client configuration `file`, empty to disable.")
+	passphrasesFileFlag      = flag.String("passphrases-file", "", "Passphrases `file` for encrypted identity files.")
+	authTokenFileFlag        = flag.String("auth-token-file", "", "Auth token `file` required to run commands, generated if it does not exist. Empty to disable.")
+	tlsCertFileFlag          = flag.String("tls-cert-file", "", "TLS certificate `file` to accept TLS connections, with -tls-key-file.")
+	tlsKeyFileFlag           = flag.String("tls-key-file", "", "TLS key `file` to accept TLS connections, with -tls-cert-file.")
+	identityFilesFlag        stringsFlag
 )
 
+func init() {
+	flag.Var(&identityFilesFlag, "identity-file", "Private key `file` to use for all SSH servers, can be repeated.")
+}
+
+// stringsFlag is a flag.Value that can be set multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 var plistTemplate = `
 <?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
@@ -85,9 +115,15 @@ func main() {
 		return
 	}
 
-	ip := net.ParseIP(*addrFlag)
-	if ip == nil {
-		log.Fatalf("invalid address: %v", *addrFlag)
+	var listenAddr net.Addr
+	if *unixSocketFlag != "" {
+		listenAddr = &net.UnixAddr{Name: os.ExpandEnv(*unixSocketFlag), Net: "unix"}
+	} else {
+		ip := net.ParseIP(*addrFlag)
+		if ip == nil {
+			log.Fatalf("invalid address: %v", *addrFlag)
+		}
+		listenAddr = &net.TCPAddr{IP: ip, Port: *portFlag}
 	}
 
 	// handle SIGINT and SIGTERM
@@ -102,16 +138,40 @@ func main() {
 
 	// configure and start the server
 	meta := &server.MetaConfig{
-		KnownHostsFile: os.ExpandEnv(*knownHostsFileFlag),
-		SSHDialTimeout: *sshDialTimeoutFlag,
+		KnownHostsFile:  os.ExpandEnv(*knownHostsFileFlag),
+		SSHDialTimeout:  *sshDialTimeoutFlag,
+		SSHConfigFile:   os.ExpandEnv(*sshConfigFileFlag),
+		PassphrasesFile: os.ExpandEnv(*passphrasesFileFlag),
+	}
+	for _, f := range identityFilesFlag {
+		meta.IdentityFiles = append(meta.IdentityFiles, os.ExpandEnv(f))
 	}
 
 	srv := &server.Server{
-		Addr:              &net.TCPAddr{IP: ip, Port: *portFlag},
-		MetaConfig:        meta,
-		TunnelIdleTimeout: *tunnelIdleTimeoutFlag,
-		WriteTimeout:      *writeTimeoutFlag,
-		Stats:             expvar.NewMap("server"),
+		Addr:                 listenAddr,
+		MetaConfig:           meta,
+		TunnelIdleTimeout:    *tunnelIdleTimeoutFlag,
+		WriteTimeout:         *writeTimeoutFlag,
+		AuthChallengeTimeout: *authChallengeTimeoutFlag,
+		HostKeyTimeout:       *hostKeyTimeoutFlag,
+		SSHKeepaliveInterval: *sshKeepaliveIntervalFlag,
+		SSHKeepaliveCountMax: *sshKeepaliveCountMaxFlag,
+		TunnelSocketDir:      os.ExpandEnv(*tunnelSocketDirFlag),
+		Stats:                expvar.NewMap("server"),
+	}
+	if *authTokenFileFlag != "" {
+		token, err := server.LoadAuthToken(os.ExpandEnv(*authTokenFileFlag))
+		if err != nil {
+			log.Fatalf("invalid auth token: %v", err)
+		}
+		srv.AuthToken = token
+	}
+	if *tlsCertFileFlag != "" || *tlsKeyFileFlag != "" {
+		cert, err := tls.LoadX509KeyPair(os.ExpandEnv(*tlsCertFileFlag), os.ExpandEnv(*tlsKeyFileFlag))
+		if err != nil {
+			log.Fatalf("invalid TLS certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 	if err := srv.ListenAndServe(ctx); err != nil {
 		log.Fatalf("exit with error: %v", err)
@@ -9,6 +9,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"strconv"
 )
 
 var (
@@ -24,39 +26,173 @@ var (
 	// ErrInvalidBulkString is returned if the bulk string data cannot be decoded.
 	ErrInvalidBulkString = errors.New("resp: invalid bulk string")
 
-	// ErrInvalidArray is returned if the array data cannot be decoded.
+	// ErrInvalidArray is returned if the array data cannot be decoded, or
+	// the data of the other aggregate types of RESP3.
 	ErrInvalidArray = errors.New("resp: invalid array")
 
-	// ErrNotAnArray is returned if the DecodeRequest function is called and
-	// the decoded value is not an array.
+	// ErrInvalidDouble is returned if an invalid value is found while parsing a double.
+	ErrInvalidDouble = errors.New("resp: invalid double value")
+
+	// ErrInvalidBoolean is returned if an invalid value is found while parsing a boolean.
+	ErrInvalidBoolean = errors.New("resp: invalid boolean value")
+
+	// ErrInvalidBigNumber is returned if an invalid value is found while parsing a big number.
+	ErrInvalidBigNumber = errors.New("resp: invalid big number value")
+
+	// ErrInvalidVerbatimString is returned if the verbatim string data cannot be decoded.
+	ErrInvalidVerbatimString = errors.New("resp: invalid verbatim string")
+
+	// ErrNotAnArray was returned if the DecodeRequest function was called
+	// and the decoded value was not an array.
+	//
+	// Deprecated: DecodeRequest decodes the values that are not arrays
+	// as inline requests, it never returns this error.
 	ErrNotAnArray = errors.New("resp: expected an array type")
 
 	// ErrInvalidRequest is returned if the DecodeRequest function is called and
 	// the decoded value is not an array containing only bulk strings, and at least 1 element.
 	ErrInvalidRequest = errors.New("resp: invalid request, must be an array of bulk strings with at least one element")
+
+	// ErrInlineTooLong is returned if the DecodeRequest function is called and
+	// the inline request is longer than the maximum length.
+	ErrInlineTooLong = errors.New("resp: inline request too long")
+
+	// ErrUnbalancedQuotes is returned if the DecodeRequest function is called and
+	// the inline request has a missing or misplaced quote.
+	ErrUnbalancedQuotes = errors.New("resp: unbalanced quotes in inline request")
+
+	// ErrLineTooLong is returned if a simple string, an error or any other
+	// value terminated by a CRLF is longer than the maximum line length.
+	ErrLineTooLong = errors.New("resp: line too long")
+
+	// ErrTooDeep is returned if the aggregate values are nested deeper than
+	// the maximum depth.
+	ErrTooDeep = errors.New("resp: maximum nesting depth exceeded")
 )
 
 const (
-	//defaultMaxLine   = 4096      // 4KB
+	defaultMaxLine   = 64 << 10  // 64KB, as Redis for inline requests
 	defaultMaxLength = 512 << 20 // 512MB
-	defaultMaxDigits = 20        // int64 = 19 digits + sign
+	defaultMaxArray  = 1 << 24   // 16M elements
+	defaultMaxDepth  = 128
+	defaultMaxDigits = 20 // int64 = 19 digits + sign
+
+	// the values longer than this are read as the data arrives, so that
+	// the allocation is not driven by an announced length alone
+	allocChunk = 64 << 10
+
+	// the scratch buffers larger than this are not kept for reuse, so that
+	// a single large value does not pin its memory
+	maxScratch = allocChunk
 )
 
+// emptyBytes is the borrowed empty bulk string, boxed once so that
+// decoding it does not allocate.
+var emptyBytes interface{} = []byte{}
+
+// Limits are the limits of the values decoded by a Decoder. A zero
+// field uses the default limit.
+type Limits struct {
+	// MaxLineLength is the maximum length of the values terminated by a
+	// CRLF, such as simple strings and errors, and of the inline
+	// requests. Defaults to 64KB.
+	MaxLineLength int
+	// MaxBulkLength is the maximum length of a bulk string, a blob error
+	// or a verbatim string. Defaults to 512MB.
+	MaxBulkLength int
+	// MaxArrayLength is the maximum number of elements of an array, a set
+	// or a push value, and twice the maximum number of entries of a map.
+	// Defaults to 16M.
+	MaxArrayLength int
+	// MaxDepth is the maximum nesting depth of the aggregate values, a
+	// flat array having a depth of 1. The value of an attribute counts
+	// as one level. Defaults to 128.
+	MaxDepth int
+}
+
 // Decoder decodes values received by an io.Reader.
 type Decoder struct {
 	r         *bufio.Reader
 	maxLength int
+	maxLine   int
+	maxArray  int
+	maxDepth  int
+
+	// the current nesting depth
+	depth int
+
+	// scratch space reused to read the bulk strings and the lines, and
+	// to copy the headers of the values
+	buf    []byte
+	line   []byte
+	header [24]byte
+
+	// if borrow is true, the bulk strings are decoded as byte slices of
+	// arena, which is reused on each call to Decode
+	borrow bool
+	arena  []byte
 }
 
-// NewDecoder returns a new Decoder that reads values from r.
+// NewDecoder returns a new Decoder that reads values from r, with the
+// default limits.
 func NewDecoder(r io.Reader) *Decoder {
-	dec := &Decoder{
-		r:         bufferedReader(r),
-		maxLength: defaultMaxLength,
-	}
+	dec := &Decoder{r: bufferedReader(r)}
+	dec.SetLimits(Limits{})
 	return dec
 }
 
+// SetLimits sets the limits of the decoded values. Decoding a value
+// that exceeds a limit fails with an error, without reading or
+// allocating more than the limit.
+func (d *Decoder) SetLimits(l Limits) {
+	d.maxLine = orDefault(l.MaxLineLength, defaultMaxLine)
+	d.maxLength = orDefault(l.MaxBulkLength, defaultMaxLength)
+	d.maxArray = orDefault(l.MaxArrayLength, defaultMaxArray)
+	d.maxDepth = orDefault(l.MaxDepth, defaultMaxDepth)
+}
+
+// SetBorrowBytes sets whether the bulk strings are decoded as []byte
+// instead of string. The byte slices share the Decoder's memory and are
+// only valid until the next call to Decode, so that their data is not
+// copied. Storing a byte slice in the decoded value still allocates its
+// slice header, so it saves an allocation per non-empty bulk string and
+// the copy of its data. It does not affect DecodeRequest.
+func (d *Decoder) SetBorrowBytes(borrow bool) {
+	d.borrow = borrow
+}
+
+// Reset discards the buffered data and makes the Decoder read from r,
+// so that it can be reused. It keeps its limits and settings.
+func (d *Decoder) Reset(r io.Reader) {
+	if br, ok := r.(*bufio.Reader); ok {
+		d.r = br
+	} else {
+		d.r.Reset(r)
+	}
+	d.depth = 0
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// IsProtocolError returns true if err is an error returned by a Decoder
+// because the data is invalid, as opposed to e.g. a read error.
+func IsProtocolError(err error) bool {
+	switch err {
+	case ErrInvalidPrefix, ErrMissingCRLF, ErrInvalidInteger,
+		ErrInvalidBulkString, ErrInvalidArray, ErrInvalidDouble,
+		ErrInvalidBoolean, ErrInvalidBigNumber, ErrInvalidVerbatimString,
+		ErrNotAnArray, ErrInvalidRequest, ErrInlineTooLong,
+		ErrUnbalancedQuotes, ErrLineTooLong, ErrTooDeep:
+		return true
+	}
+	return false
+}
+
 func bufferedReader(r io.Reader) *bufio.Reader {
 	if br, ok := r.(*bufio.Reader); ok {
 		return br
@@ -77,51 +213,238 @@ func (a Array) String() string {
 }
 
 // DecodeRequest decodes the provided byte slice and returns the array
-// representing the request. If the encoded value is not an array, it
-// returns ErrNotAnArray, and if it is not a valid request, it returns ErrInvalidRequest.
+// representing the request. If it is not a valid request, it returns
+// ErrInvalidRequest.
+//
+// If the data does not start with an array, it is decoded as an inline
+// request, as Redis does, that is a line of arguments separated by
+// whitespace and quoted as in redis-cli, so that the requests can be
+// typed e.g. with telnet. The other RESP prefixes are not special in a
+// request, a line such as "+ping" is the inline request of that word.
 func (d *Decoder) DecodeRequest() ([]string, error) {
-	// Decode the value, must be an array
-	val, err := d.decodeValue(true)
+	ch, err := d.r.ReadByte()
 	if err != nil {
 		return nil, err
 	}
-	ar, ok := val.(Array)
-	if !ok {
-		return nil, ErrNotAnArray
+	if ch != '*' {
+		if err := d.r.UnreadByte(); err != nil {
+			return nil, err
+		}
+		return d.decodeInlineRequest()
 	}
+	return d.decodeRequestArray()
+}
 
-	// Must have at least one element
-	if len(ar) < 1 {
+// decodeRequestArray decodes the byte slice as an array of bulk strings
+// directly into a slice of strings, without the intermediate Array. It
+// assumes the '*' prefix is already consumed. If an element is not a
+// bulk string, the whole array is still consumed before it returns
+// ErrInvalidRequest.
+func (d *Decoder) decodeRequestArray() ([]string, error) {
+	cnt, err := d.decodeInteger()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cnt == -1 || cnt == 0:
+		// Must have at least one element
 		return nil, ErrInvalidRequest
+
+	case cnt < 0 || cnt > int64(d.maxArray):
+		return nil, ErrInvalidArray
 	}
 
+	d.depth++
+	defer func() { d.depth-- }()
+
 	// Must have only strings
-	strs := make([]string, len(ar))
-	for i, v := range ar {
-		v, ok := v.(string)
-		if !ok {
-			return nil, ErrInvalidRequest
+	strs := make([]string, 0, min(cnt, allocChunk))
+	valid := true
+	for i := 0; i < int(cnt); i++ {
+		ch, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if ch != '$' {
+			if err := d.r.UnreadByte(); err != nil {
+				return nil, err
+			}
+			if _, err := d.decodeValue(); err != nil {
+				return nil, err
+			}
+			valid = false
+			continue
+		}
+
+		b, isNil, err := d.readBulk(false)
+		if err != nil {
+			return nil, err
+		}
+		if isNil {
+			valid = false
+			continue
 		}
-		strs[i] = v
+		strs = append(strs, string(b))
+	}
+	if !valid {
+		return nil, ErrInvalidRequest
 	}
 	return strs, nil
 }
 
 // Decode decodes the provided byte slice and returns the parsed value.
 func (d *Decoder) Decode() (interface{}, error) {
-	return d.decodeValue(false)
+	d.resetArena()
+	return d.decodeValue()
+}
+
+// DecodeBulkStringTo decodes the next value, which must be a bulk
+// string, and writes its data to w as it is read, so that a large value
+// is not buffered in memory. It returns the number of bytes written, or
+// -1 for a nil bulk string.
+func (d *Decoder) DecodeBulkStringTo(w io.Writer) (int64, error) {
+	ch, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if ch != '$' {
+		return 0, ErrInvalidBulkString
+	}
+	cnt, err := d.readBulkLength()
+	if err != nil || cnt == -1 {
+		return cnt, err
+	}
+
+	n, err := io.CopyN(w, d.r, cnt)
+	if err != nil {
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	if err := d.readCRLF(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// CopyValue copies the next value to w as it is read, without decoding
+// it, so that it keeps its exact encoding and its bulk strings are not
+// buffered in memory. The value is checked against the limits of the
+// Decoder as with Decode, but the lines of the simple types are copied
+// without validating their content. It returns io.ErrUnexpectedEOF if
+// the value is truncated.
+func (d *Decoder) CopyValue(w io.Writer) error {
+	ch, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch ch {
+	case '+', '-', ':', '_', ',', '#', '(':
+		line, err := d.readLine()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		return d.copyLine(w, ch, line)
+
+	case '$', '=', '!':
+		cnt, err := d.readBulkLength()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if cnt == -1 && ch == '!' {
+			return ErrInvalidBulkString
+		}
+		if err := d.copyHeader(w, ch, cnt); err != nil || cnt == -1 {
+			return err
+		}
+		if _, err := io.CopyN(w, d.r, cnt); err != nil {
+			return unexpectedEOF(err)
+		}
+		if err := d.readCRLF(); err != nil {
+			return err
+		}
+		_, err = w.Write(crlf)
+		return err
+
+	case '*', '~', '>', '%', '|':
+		size := int64(1)
+		if ch == '%' || ch == '|' {
+			size = 2
+		}
+		cnt, err := d.decodeInteger()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if cnt < -1 || cnt > int64(d.maxArray)/size || (cnt == -1 && ch == '|') {
+			return ErrInvalidArray
+		}
+		if err := d.copyHeader(w, ch, cnt); err != nil {
+			return err
+		}
+
+		// the attributed value counts as one level of nesting, as for
+		// Decode
+		if cnt > 0 || ch == '|' {
+			if d.depth >= d.maxDepth {
+				return ErrTooDeep
+			}
+			d.depth++
+			defer func() { d.depth-- }()
+		}
+		for i := int64(0); i < cnt*size; i++ {
+			if err := d.CopyValue(w); err != nil {
+				return unexpectedEOF(err)
+			}
+		}
+		if ch == '|' {
+			return unexpectedEOF(d.CopyValue(w))
+		}
+		return nil
+
+	default:
+		return ErrInvalidPrefix
+	}
+}
+
+// copyHeader writes the header of a bulk or aggregate value of length n
+// to w.
+func (d *Decoder) copyHeader(w io.Writer, prefix byte, n int64) error {
+	b := append(d.header[:0], prefix)
+	b = strconv.AppendInt(b, n, 10)
+	_, err := w.Write(append(b, '\r', '\n'))
+	return err
+}
+
+// copyLine writes the line of a simple value to w.
+func (d *Decoder) copyLine(w io.Writer, prefix byte, line []byte) error {
+	d.header[0] = prefix
+	if _, err := w.Write(d.header[:1]); err != nil {
+		return err
+	}
+	if _, err := w.Write(line); err != nil {
+		return err
+	}
+	_, err := w.Write(crlf)
+	return err
+}
+
+// resetArena makes the arena reusable by the next borrowed bulk strings.
+func (d *Decoder) resetArena() {
+	if cap(d.arena) > maxScratch {
+		d.arena = nil
+	}
+	d.arena = d.arena[:0]
 }
 
 // decodeValue parses the byte slice and decodes the value based on its
 // prefix, as defined by the RESP protocol.
-func (d *Decoder) decodeValue(requiresArray bool) (interface{}, error) {
+func (d *Decoder) decodeValue() (interface{}, error) {
 	ch, err := d.r.ReadByte()
 	if err != nil {
 		return nil, err
 	}
-	if requiresArray && ch != '*' {
-		return nil, ErrNotAnArray
-	}
 
 	var val interface{}
 	switch ch {
@@ -140,6 +463,40 @@ func (d *Decoder) decodeValue(requiresArray bool) (interface{}, error) {
 	case '*':
 		// Array
 		val, err = d.decodeArray()
+	case '_':
+		// Null (RESP3)
+		val, err = d.decodeNull()
+	case ',':
+		// Double (RESP3)
+		val, err = d.decodeDouble()
+	case '#':
+		// Boolean (RESP3)
+		val, err = d.decodeBoolean()
+	case '(':
+		// Big number (RESP3)
+		val, err = d.decodeBigNumber()
+	case '!':
+		// Blob error (RESP3)
+		val, err = d.decodeBlobError()
+	case '=':
+		// Verbatim string (RESP3)
+		val, err = d.decodeVerbatimString()
+	case '%':
+		// Map (RESP3)
+		val, err = d.decodeMap()
+	case '~':
+		// Set (RESP3)
+		var ar Array
+		ar, err = d.decodeArray()
+		val = Set(ar)
+	case '>':
+		// Push (RESP3)
+		var ar Array
+		ar, err = d.decodeArray()
+		val = Push(ar)
+	case '|':
+		// Attributes (RESP3), followed by the attributed value
+		val, err = d.decodeAttributed()
 	default:
 		err = ErrInvalidPrefix
 	}
@@ -150,7 +507,15 @@ func (d *Decoder) decodeValue(requiresArray bool) (interface{}, error) {
 // decodeArray decodes the byte slice as an array. It assumes the
 // '*' prefix is already consumed.
 func (d *Decoder) decodeArray() (Array, error) {
-	// First comes the number of elements in the array
+	return d.decodeAggregate(1)
+}
+
+// decodeAggregate decodes the byte slice as an aggregate of elements
+// made of size values each, 1 for arrays, sets and pushes, 2 for maps
+// and attributes. It returns all the values in a flat array. It
+// assumes the prefix is already consumed.
+func (d *Decoder) decodeAggregate(size int64) (Array, error) {
+	// First comes the number of elements in the aggregate
 	cnt, err := d.decodeInteger()
 	if err != nil {
 		return nil, err
@@ -168,54 +533,168 @@ func (d *Decoder) decodeArray() (Array, error) {
 		// Invalid length
 		return nil, ErrInvalidArray
 
+	case cnt > int64(d.maxArray)/size:
+		return nil, ErrInvalidArray
+
 	default:
-		// Allocate the array
-		ar := make(Array, cnt)
+		if d.depth >= d.maxDepth {
+			return nil, ErrTooDeep
+		}
+		d.depth++
+		defer func() { d.depth-- }()
+
+		// Allocate the array, up to a chunk as the elements may not come
+		cnt *= size
+		ar := make(Array, 0, min(cnt, allocChunk))
 
 		// Decode each value
 		for i := 0; i < int(cnt); i++ {
-			val, err := d.decodeValue(false)
+			val, err := d.decodeValue()
 			if err != nil {
 				return nil, err
 			}
-			ar[i] = val
+			ar = append(ar, val)
 		}
 		return ar, nil
 	}
 }
 
-// decodeBulkString decodes the byte slice as a binary-safe string. The
-// '$' prefix is assumed to be already consumed.
+// decodeBulkString decodes the byte slice as a binary-safe string, or
+// as a borrowed byte slice if the Decoder is set to do so. The '$'
+// prefix is assumed to be already consumed.
 func (d *Decoder) decodeBulkString() (interface{}, error) {
-	// First comes the length of the bulk string, an integer
-	cnt, err := d.decodeInteger()
+	b, isNil, err := d.readBulk(d.borrow)
 	if err != nil {
 		return nil, err
 	}
-	switch {
-	case cnt == -1:
+	if isNil {
 		// Special case to represent a nil bulk string
-		return nil, nil
+		return NilBulkString{}, nil
+	}
+	if d.borrow {
+		if len(b) == 0 {
+			return emptyBytes, nil
+		}
+		return b, nil
+	}
+	return string(b), nil
+}
 
-	case cnt < -1:
-		return nil, ErrInvalidBulkString
+// readBulk reads the length and the data of a bulk string, a blob error
+// or a verbatim string. The data is read in the arena if borrow is true,
+// in the scratch buffer otherwise, so that it is only valid until the
+// next read. isNil is true for a nil bulk string.
+func (d *Decoder) readBulk(borrow bool) (b []byte, isNil bool, err error) {
+	// First comes the length of the bulk string, an integer
+	cnt, err := d.readBulkLength()
+	if err != nil {
+		return nil, false, err
+	}
+	if cnt == -1 {
+		return nil, true, nil
+	}
 
-	case cnt > int64(d.maxLength):
-		return nil, ErrInvalidBulkString
+	// Then the string is cnt long, followed by the CRLF
+	if !borrow {
+		b, err = d.readFull(d.buf[:0], cnt)
+		if cap(b) <= maxScratch {
+			d.buf = b
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		start := len(d.arena)
+		d.arena, err = d.readFull(d.arena, cnt)
+		if err != nil {
+			return nil, false, err
+		}
+		// the capacity is limited so that appending to b cannot
+		// overwrite the next values
+		b = d.arena[start:len(d.arena):len(d.arena)]
+	}
+	if err := d.readCRLF(); err != nil {
+		return nil, false, err
+	}
+	return b, false, nil
+}
 
-	default:
-		// Then the string is cnt long, and bytes read is cnt+n+2 (for ending CRLF)
-		need := cnt + 2
-		// TODO: reuse scratch space instead
-		buf := make([]byte, need)
-		if _, err := io.ReadFull(d.r, buf); err != nil {
-			return nil, err
+// readBulkLength reads the length of a bulk string, which is -1 for a
+// nil bulk string.
+func (d *Decoder) readBulkLength() (int64, error) {
+	cnt, err := d.decodeInteger()
+	if err != nil {
+		return 0, err
+	}
+	if cnt < -1 || cnt > int64(d.maxLength) {
+		return 0, ErrInvalidBulkString
+	}
+	return cnt, nil
+}
+
+// readCRLF reads the CRLF that terminates a bulk string.
+func (d *Decoder) readCRLF() error {
+	cr, err := d.r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	lf, err := d.r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if cr != '\r' || lf != '\n' {
+		return ErrMissingCRLF
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readFull reads exactly n bytes and appends them to dst. If n is
+// large, dst grows as the data is read, by up to allocChunk bytes at a
+// time.
+func (d *Decoder) readFull(dst []byte, n int64) ([]byte, error) {
+	var read int64
+	for read < n {
+		m := n - read
+		if free := int64(cap(dst) - len(dst)); free < m {
+			m = min(m, max(free, allocChunk))
+			if free < m {
+				dst = append(dst, make([]byte, m)...)[:len(dst)]
+			}
 		}
-		if buf[len(buf)-2] != '\r' || buf[len(buf)-1] != '\n' {
-			return nil, ErrMissingCRLF
+
+		start := len(dst)
+		dst = dst[:start+int(m)]
+		k, err := io.ReadFull(d.r, dst[start:])
+		read += int64(k)
+		if err != nil {
+			if err == io.EOF && read > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return dst[:start+k], err
 		}
-		return string(buf[:len(buf)-2]), nil
 	}
+	return dst, nil
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
 }
 
 // decodeInteger decodes the byte slice as a singed 64bit integer. The
@@ -273,22 +752,189 @@ loop:
 // decodeSimpleString decodes the byte slice as a SimpleString. The
 // '+' prefix is assumed to be already consumed.
 func (d *Decoder) decodeSimpleString() (interface{}, error) {
-	// TODO: limit bytes read
-	v, err := d.r.ReadBytes('\r')
+	v, err := d.readLine()
 	if err != nil {
 		return nil, err
 	}
+	return SimpleString(v), nil
+}
+
+// readLine reads the data up to the next CRLF, and returns it without
+// the CRLF. It returns ErrLineTooLong if the line is longer than
+// maxLine bytes.
+func (d *Decoder) readLine() ([]byte, error) {
+	v := d.line[:0]
+	defer func() {
+		if cap(v) <= maxScratch {
+			d.line = v
+		}
+	}()
+	for {
+		b, err := d.r.ReadSlice('\r')
+		if len(v)+len(b) > d.maxLine+1 {
+			return nil, ErrLineTooLong
+		}
+		v = append(v, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
 
 	if ch, err := d.r.ReadByte(); err != nil {
 		return nil, err
 	} else if ch != '\n' {
 		return nil, ErrMissingCRLF
 	}
-	return string(v[:len(v)-1]), nil
+	return v[:len(v)-1], nil
 }
 
 // decodeError decodes the byte slice as an Error. The '-' prefix
 // is assumed to be already consumed.
 func (d *Decoder) decodeError() (interface{}, error) {
-	return d.decodeSimpleString()
+	v, err := d.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return Error(v), nil
+}
+
+// decodeNull decodes the byte slice as a RESP3 null. The '_' prefix
+// is assumed to be already consumed.
+func (d *Decoder) decodeNull() (interface{}, error) {
+	v, err := d.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 0 {
+		return nil, ErrMissingCRLF
+	}
+	return Null{}, nil
+}
+
+// decodeBlobError decodes the byte slice as a RESP3 blob error. The
+// '!' prefix is assumed to be already consumed.
+func (d *Decoder) decodeBlobError() (interface{}, error) {
+	b, isNil, err := d.readBulk(false)
+	if err != nil {
+		return nil, err
+	}
+	if isNil {
+		return nil, ErrInvalidBulkString
+	}
+	return BlobError(b), nil
+}
+
+// decodeDouble decodes the byte slice as a RESP3 double. The ','
+// prefix is assumed to be already consumed.
+func (d *Decoder) decodeDouble() (float64, error) {
+	v, err := d.readLine()
+	if err != nil {
+		return 0, err
+	}
+	// ParseFloat accepts inf, -inf and nan as sent by Redis
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err != nil {
+		return 0, ErrInvalidDouble
+	}
+	return f, nil
+}
+
+// decodeBoolean decodes the byte slice as a RESP3 boolean. The '#'
+// prefix is assumed to be already consumed.
+func (d *Decoder) decodeBoolean() (bool, error) {
+	v, err := d.readLine()
+	if err != nil {
+		return false, err
+	}
+	switch string(v) {
+	case "t":
+		return true, nil
+	case "f":
+		return false, nil
+	default:
+		return false, ErrInvalidBoolean
+	}
+}
+
+// decodeBigNumber decodes the byte slice as a RESP3 big number. The
+// '(' prefix is assumed to be already consumed.
+func (d *Decoder) decodeBigNumber() (*big.Int, error) {
+	v, err := d.readLine()
+	if err != nil {
+		return nil, err
+	}
+	n, ok := new(big.Int).SetString(string(v), 10)
+	if !ok {
+		return nil, ErrInvalidBigNumber
+	}
+	return n, nil
+}
+
+// decodeVerbatimString decodes the byte slice as a RESP3 verbatim
+// string. The '=' prefix is assumed to be already consumed.
+func (d *Decoder) decodeVerbatimString() (interface{}, error) {
+	b, isNil, err := d.readBulk(false)
+	if err != nil {
+		return nil, err
+	}
+	if isNil {
+		return NilBulkString{}, nil
+	}
+	if len(b) < 4 || b[3] != ':' {
+		return nil, ErrInvalidVerbatimString
+	}
+	s := string(b)
+	return VerbatimString{Format: s[:3], Text: s[4:]}, nil
+}
+
+// decodeMap decodes the byte slice as a RESP3 map. The '%' prefix is
+// assumed to be already consumed.
+func (d *Decoder) decodeMap() (interface{}, error) {
+	ar, err := d.decodeAggregate(2)
+	if err != nil {
+		return nil, err
+	}
+	if ar == nil {
+		return Map(nil), nil
+	}
+	return pairs(ar), nil
+}
+
+// decodeAttributed decodes the byte slice as RESP3 attributes, and the
+// value that follows them. The '|' prefix is assumed to be already
+// consumed.
+func (d *Decoder) decodeAttributed() (interface{}, error) {
+	ar, err := d.decodeAggregate(2)
+	if err != nil {
+		return nil, err
+	}
+	if ar == nil {
+		return nil, ErrInvalidArray
+	}
+
+	// the attributed value counts as one level of nesting, otherwise a
+	// chain of attributes would recurse without limit
+	if d.depth >= d.maxDepth {
+		return nil, ErrTooDeep
+	}
+	d.depth++
+	v, err := d.decodeValue()
+	d.depth--
+	if err != nil {
+		return nil, err
+	}
+	return Attributed{Attributes: pairs(ar), Value: v}, nil
+}
+
+// pairs returns the Map of the keys and values in ar.
+func pairs(ar Array) Map {
+	m := make(Map, len(ar)/2)
+	for i := range m {
+		m[i] = KeyValue{Key: ar[2*i], Value: ar[2*i+1]}
+	}
+	return m
 }
@@ -3,7 +3,11 @@ package resp
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -40,8 +44,22 @@ var decodeErrCases = []struct {
 	{[]byte("*-3\r\n"), Array(nil), ErrInvalidArray},
 	{[]byte(":\r\n"), int64(0), nil},
 	{[]byte("$\r\n\r\n"), "", nil},
-	{[]byte("!\r\n"), nil, ErrInvalidPrefix},
+	{[]byte("?\r\n"), nil, ErrInvalidPrefix},
 	{[]byte("*1\r\n:1-\r\n"), Array(nil), ErrInvalidInteger},
+	{[]byte("_a\r\n"), nil, ErrMissingCRLF},
+	{[]byte(",1.5x\r\n"), float64(0), ErrInvalidDouble},
+	{[]byte(",\r\n"), float64(0), ErrInvalidDouble},
+	{[]byte("#x\r\n"), false, ErrInvalidBoolean},
+	{[]byte("#t"), false, io.EOF},
+	{[]byte("(12a\r\n"), (*big.Int)(nil), ErrInvalidBigNumber},
+	{[]byte("=3\r\ntxt\r\n"), nil, ErrInvalidVerbatimString},
+	{[]byte("=5\r\ntxt-a\r\n"), nil, ErrInvalidVerbatimString},
+	{[]byte("%1\r\n+a\r\n"), nil, io.EOF},
+	{[]byte("%-2\r\n"), nil, ErrInvalidArray},
+	{[]byte("|-1\r\n"), nil, ErrInvalidArray},
+	{[]byte("|1\r\n+a\r\n+b\r\n"), nil, io.EOF},
+	{[]byte("~1\r\n"), Set(nil), io.EOF},
+	{[]byte("!-1\r\n"), nil, ErrInvalidBulkString},
 }
 
 var decodeValidCases = []struct {
@@ -49,14 +67,14 @@ var decodeValidCases = []struct {
 	val interface{}
 	err error
 }{
-	{[]byte{'+', '\r', '\n'}, "", nil},
-	{[]byte{'+', 'a', '\r', '\n'}, "a", nil},
-	{[]byte{'+', 'O', 'K', '\r', '\n'}, "OK", nil},
-	{[]byte("+ceci n'est pas un string\r\n"), "ceci n'est pas un string", nil},
-	{[]byte{'-', '\r', '\n'}, "", nil},
-	{[]byte{'-', 'a', '\r', '\n'}, "a", nil},
-	{[]byte{'-', 'K', 'O', '\r', '\n'}, "KO", nil},
-	{[]byte("-ceci n'est pas un string\r\n"), "ceci n'est pas un string", nil},
+	{[]byte{'+', '\r', '\n'}, SimpleString(""), nil},
+	{[]byte{'+', 'a', '\r', '\n'}, SimpleString("a"), nil},
+	{[]byte{'+', 'O', 'K', '\r', '\n'}, SimpleString("OK"), nil},
+	{[]byte("+ceci n'est pas un string\r\n"), SimpleString("ceci n'est pas un string"), nil},
+	{[]byte{'-', '\r', '\n'}, Error(""), nil},
+	{[]byte{'-', 'a', '\r', '\n'}, Error("a"), nil},
+	{[]byte{'-', 'K', 'O', '\r', '\n'}, Error("KO"), nil},
+	{[]byte("-ceci n'est pas un string\r\n"), Error("ceci n'est pas un string"), nil},
 	{[]byte(":1\r\n"), int64(1), nil},
 	{[]byte(":123\r\n"), int64(123), nil},
 	{[]byte(":-123\r\n"), int64(-123), nil},
@@ -65,15 +83,48 @@ var decodeValidCases = []struct {
 	{[]byte("$0\r\n\r\n"), "", nil},
 	{[]byte("$24\r\nceci n'est pas un string\r\n"), "ceci n'est pas un string", nil},
 	{[]byte("$51\r\nceci n'est pas un string\r\navec\rdes\nsauts\r\nde\x00ligne.\r\n"), "ceci n'est pas un string\r\navec\rdes\nsauts\r\nde\x00ligne.", nil},
-	{[]byte("$-1\r\n"), nil, nil},
+	{[]byte("$-1\r\n"), NilBulkString{}, nil},
 	{[]byte("*0\r\n"), Array{}, nil},
 	{[]byte("*1\r\n:10\r\n"), Array{int64(10)}, nil},
 	{[]byte("*-1\r\n"), Array(nil), nil},
 	{[]byte("*3\r\n+string\r\n-error\r\n:-2345\r\n"),
-		Array{"string", "error", int64(-2345)}, nil},
+		Array{SimpleString("string"), Error("error"), int64(-2345)}, nil},
 	{[]byte("*5\r\n+string\r\n-error\r\n:-2345\r\n$4\r\nallo\r\n*2\r\n$0\r\n\r\n$-1\r\n"),
-		Array{"string", "error", int64(-2345), "allo",
-			Array{"", nil}}, nil},
+		Array{SimpleString("string"), Error("error"), int64(-2345), "allo",
+			Array{"", NilBulkString{}}}, nil},
+	{[]byte("_\r\n"), Null{}, nil},
+	{[]byte(",1.5\r\n"), float64(1.5), nil},
+	{[]byte(",-2\r\n"), float64(-2), nil},
+	{[]byte(",1e-3\r\n"), float64(0.001), nil},
+	{[]byte(",inf\r\n"), math.Inf(1), nil},
+	{[]byte(",-inf\r\n"), math.Inf(-1), nil},
+	{[]byte("#t\r\n"), true, nil},
+	{[]byte("#f\r\n"), false, nil},
+	{[]byte("(3492890328409238509324850943850943825024385\r\n"), bigInt("3492890328409238509324850943850943825024385"), nil},
+	{[]byte("(-12\r\n"), big.NewInt(-12), nil},
+	{[]byte("!21\r\nSYNTAX invalid syntax\r\n"), BlobError("SYNTAX invalid syntax"), nil},
+	{[]byte("=15\r\ntxt:Some string\r\n"), VerbatimString{Format: "txt", Text: "Some string"}, nil},
+	{[]byte("=4\r\nmkd:\r\n"), VerbatimString{Format: "mkd"}, nil},
+	{[]byte("%0\r\n"), Map{}, nil},
+	{[]byte("%2\r\n+first\r\n:1\r\n*1\r\n+k\r\n#t\r\n"),
+		Map{{SimpleString("first"), int64(1)}, {Array{SimpleString("k")}, true}}, nil},
+	{[]byte("%-1\r\n"), Map(nil), nil},
+	{[]byte("=-1\r\n"), NilBulkString{}, nil},
+	{[]byte("~-1\r\n"), Set(nil), nil},
+	{[]byte("~2\r\n+a\r\n:1\r\n"), Set{SimpleString("a"), int64(1)}, nil},
+	{[]byte(">3\r\n+message\r\n+chan\r\n$2\r\nhi\r\n"), Push{SimpleString("message"), SimpleString("chan"), "hi"}, nil},
+	{[]byte("|1\r\n+ttl\r\n:3600\r\n$3\r\nval\r\n"),
+		Attributed{Attributes: Map{{SimpleString("ttl"), int64(3600)}}, Value: "val"}, nil},
+	{[]byte("*2\r\n|1\r\n+a\r\n,0.5\r\n:1\r\n_\r\n"),
+		Array{Attributed{Attributes: Map{{SimpleString("a"), 0.5}}, Value: int64(1)}, Null{}}, nil},
+}
+
+func bigInt(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big number " + s)
+	}
+	return n
 }
 
 var decodeRequestCases = []struct {
@@ -82,12 +133,46 @@ var decodeRequestCases = []struct {
 	err error
 }{
 	{[]byte("*-1\r\n"), nil, ErrInvalidRequest},
-	{[]byte(":4\r\n"), nil, ErrNotAnArray},
+	{[]byte(":4\r\n"), []string{":4"}, nil},
+	{[]byte("+ping\r\n"), []string{"+ping"}, nil},
+	{[]byte("$3 -1\r\n"), []string{"$3", "-1"}, nil},
 	{[]byte("*0\r\n"), nil, ErrInvalidRequest},
 	{[]byte("*1\r\n:6\r\n"), nil, ErrInvalidRequest},
 	{[]byte("*1\r\n$2\r\nab\r\n"), []string{"ab"}, nil},
 	{[]byte("*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$24\r\nceci n'est pas un string\r\n"),
 		[]string{"SET", "mykey", "ceci n'est pas un string"}, nil},
+	{[]byte("ping\r\n"), []string{"ping"}, nil},
+	{[]byte("info tunnels\n"), []string{"info", "tunnels"}, nil},
+	{[]byte("\r\n  \t\r\n  set   a\tb  \r\n"), []string{"set", "a", "b"}, nil},
+	{[]byte("set \"a b\" 'c d' \"\"\r\n"), []string{"set", "a b", "c d", ""}, nil},
+	{[]byte("set \"\\x41\\n\\\"\\q\\xZZ\"\r\n"), []string{"set", "A\n\"qxZZ"}, nil},
+	{[]byte("set 'it\\'s' 'a\\nb'\r\n"), []string{"set", "it's", "a\\nb"}, nil},
+	{[]byte("set a\"b c\"\r\n"), []string{"set", "ab c"}, nil},
+	{[]byte("set \"a\r\n"), nil, ErrUnbalancedQuotes},
+	{[]byte("set 'a\r\n"), nil, ErrUnbalancedQuotes},
+	{[]byte("set \"a\"b\r\n"), nil, ErrUnbalancedQuotes},
+	{[]byte("set 'a'b\r\n"), nil, ErrUnbalancedQuotes},
+	{[]byte("ping"), nil, io.EOF},
+	{[]byte(""), nil, io.EOF},
+	{append(bytes.Repeat([]byte("a"), 61), "\r\n"...), nil, ErrInlineTooLong},
+	{append(bytes.Repeat([]byte("a"), 60), "\r\n"...), []string{string(bytes.Repeat([]byte("a"), 60))}, nil},
+}
+
+func TestDecodeRequestInlineTooLong(t *testing.T) {
+	// longer than the buffer of the reader
+	raw := append(bytes.Repeat([]byte("a"), defaultMaxLine+1), "\r\n"...)
+	if _, err := NewDecoder(bytes.NewReader(raw)).DecodeRequest(); err != ErrInlineTooLong {
+		t.Errorf("want %v, got %v", ErrInlineTooLong, err)
+	}
+
+	raw = append(bytes.Repeat([]byte("a"), defaultMaxLine), "\r\nping\r\n"...)
+	dec := NewDecoder(bytes.NewReader(raw))
+	for _, want := range []int{defaultMaxLine, 4} {
+		got, err := dec.DecodeRequest()
+		if err != nil || len(got) != 1 || len(got[0]) != want {
+			t.Errorf("want argument of length %d, got %d arguments and %v", want, len(got), err)
+		}
+	}
 }
 
 func TestDecode(t *testing.T) {
@@ -107,7 +192,9 @@ func TestDecode(t *testing.T) {
 
 func TestDecodeRequest(t *testing.T) {
 	for _, c := range decodeRequestCases {
-		got, err := NewDecoder(bytes.NewReader(c.raw)).DecodeRequest()
+		dec := NewDecoder(bytes.NewReader(c.raw))
+		dec.maxLine = 60
+		got, err := dec.DecodeRequest()
 		if err != c.err {
 			t.Errorf("%s: expected error %v, got %v", string(c.raw), c.err, err)
 		}
@@ -118,6 +205,329 @@ func TestDecodeRequest(t *testing.T) {
 	}
 }
 
+func TestDecodeLimits(t *testing.T) {
+	limits := Limits{MaxLineLength: 10, MaxBulkLength: 8, MaxArrayLength: 4, MaxDepth: 2}
+	cases := []struct {
+		enc string
+		err error
+	}{
+		{"+1234567890\r\n", nil},
+		{"+12345678901\r\n", ErrLineTooLong},
+		{"-12345678901\r\n", ErrLineTooLong},
+		{",1.000000000\r\n", ErrLineTooLong},
+		{"$8\r\n12345678\r\n", nil},
+		{"$9\r\n123456789\r\n", ErrInvalidBulkString},
+		{"!9\r\n123456789\r\n", ErrInvalidBulkString},
+		{"*4\r\n:1\r\n:2\r\n:3\r\n:4\r\n", nil},
+		{"*5\r\n", ErrInvalidArray},
+		{"*9223372036854775807\r\n", ErrInvalidArray},
+		{"%2\r\n:1\r\n:2\r\n:3\r\n:4\r\n", nil},
+		{"%3\r\n", ErrInvalidArray},
+		{"*1\r\n*1\r\n:1\r\n", nil},
+		{"*1\r\n*1\r\n*0\r\n", nil},
+		{"*1\r\n*1\r\n*1\r\n:1\r\n", ErrTooDeep},
+		{"|1\r\n:1\r\n:2\r\n*1\r\n:3\r\n", nil},
+		{"*1\r\n|1\r\n:1\r\n:2\r\n:3\r\n", nil},
+		{"*1\r\n|1\r\n:1\r\n:2\r\n*1\r\n:3\r\n", ErrTooDeep},
+		{"*1\r\n|1\r\n:1\r\n*1\r\n:2\r\n:3\r\n", ErrTooDeep},
+		{"|1\r\n:1\r\n:2\r\n|1\r\n:1\r\n:2\r\n|1\r\n:1\r\n:2\r\n:3\r\n", ErrTooDeep},
+	}
+	// the inline requests
+	requests := []struct {
+		enc string
+		err error
+	}{
+		{"1 2 3 4 5\r\n", ErrInvalidArray},
+		{"12345678901\r\n", ErrInlineTooLong},
+		{"+12345678901\r\n", ErrInlineTooLong},
+	}
+
+	for _, c := range cases {
+		dec := NewDecoder(strings.NewReader(c.enc))
+		dec.SetLimits(limits)
+		_, err := dec.Decode()
+		if err != c.err {
+			t.Errorf("%q: want %v, got %v", c.enc, c.err, err)
+		}
+		if err != nil && !IsProtocolError(err) {
+			t.Errorf("%q: want protocol error, got %v", c.enc, err)
+		}
+	}
+	for _, c := range requests {
+		dec := NewDecoder(strings.NewReader(c.enc))
+		dec.SetLimits(limits)
+		_, err := dec.DecodeRequest()
+		if err != c.err {
+			t.Errorf("%q: want %v, got %v", c.enc, c.err, err)
+		}
+		if err != nil && !IsProtocolError(err) {
+			t.Errorf("%q: want protocol error, got %v", c.enc, err)
+		}
+	}
+}
+
+func TestDecodeAttributeChain(t *testing.T) {
+	// the attributed values count as nesting levels, a long chain fails
+	// under the default limits instead of overflowing the stack
+	chain := strings.Repeat("|1\r\n_\r\n_\r\n", 1<<20) + "_\r\n"
+	if _, err := NewDecoder(strings.NewReader(chain)).Decode(); err != ErrTooDeep {
+		t.Errorf("want %v, got %v", ErrTooDeep, err)
+	}
+	chain = strings.Repeat("*1\r\n|1\r\n_\r\n_\r\n", 1<<20) + "_\r\n"
+	if _, err := NewDecoder(strings.NewReader(chain)).Decode(); err != ErrTooDeep {
+		t.Errorf("want %v within arrays, got %v", ErrTooDeep, err)
+	}
+
+	// within the limit
+	chain = strings.Repeat("|1\r\n_\r\n_\r\n", 100) + ":1\r\n"
+	v, err := NewDecoder(strings.NewReader(chain)).Decode()
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		a, ok := v.(Attributed)
+		if !ok {
+			t.Fatalf("%d: want attributed value, got %#v", i, v)
+		}
+		v = a.Value
+	}
+	if v != int64(1) {
+		t.Errorf("want 1, got %#v", v)
+	}
+}
+
+func TestDecodeAnnouncedLength(t *testing.T) {
+	// the announced lengths do not allocate before the data arrives
+	cases := []struct {
+		enc string
+		err error
+	}{
+		{"$536870912\r\nabc", io.ErrUnexpectedEOF},
+		{"*16777216\r\n:1\r\n", io.EOF},
+		{"%8388608\r\n:1\r\n", io.EOF},
+	}
+
+	for _, c := range cases {
+		_, err := NewDecoder(strings.NewReader(c.enc)).Decode()
+		if err != c.err {
+			t.Errorf("%.20q: want %v, got %v", c.enc, c.err, err)
+		}
+		if IsProtocolError(err) {
+			t.Errorf("%.20q: want no protocol error, got %v", c.enc, err)
+		}
+	}
+
+	raw := "$70000\r\n" + strings.Repeat("a", 70000) + "\r\n"
+	v, err := NewDecoder(strings.NewReader(raw)).Decode()
+	if s, _ := v.(string); err != nil || len(s) != 70000 {
+		t.Errorf("want string of 70000 bytes, got %d bytes and %v", len(s), err)
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	cases := []struct {
+		proto int
+		enc   string
+	}{
+		{RESP2, "+OK\r\n"},
+		{RESP2, "-ERR failed\r\n"},
+		{RESP2, ":-12\r\n"},
+		{RESP2, "$2\r\nOK\r\n"},
+		{RESP2, "$-1\r\n"},
+		{RESP2, "*-1\r\n"},
+		{RESP2, "*4\r\n+a\r\n-b\r\n$1\r\nc\r\n*2\r\n$-1\r\n*-1\r\n"},
+		{RESP3, "_\r\n"},
+		{RESP3, "$-1\r\n"},
+		{RESP3, ",1.5\r\n"},
+		{RESP3, "#f\r\n"},
+		{RESP3, "(-3492890328409238509324850943850943825024385\r\n"},
+		{RESP3, "!3\r\nE\r\n\r\n"},
+		{RESP3, "=8\r\ntxt:a\r\nb\r\n"},
+		{RESP3, "%2\r\n+a\r\n:1\r\n$1\r\nb\r\n~1\r\n_\r\n"},
+		{RESP3, ">2\r\n+message\r\n-ERR x\r\n"},
+		{RESP3, "|1\r\n+ttl\r\n:1\r\n+OK\r\n"},
+	}
+
+	var buf bytes.Buffer
+	for _, c := range cases {
+		v, err := NewDecoder(strings.NewReader(c.enc)).Decode()
+		if err != nil {
+			t.Errorf("%q: want no decode error, got %v", c.enc, err)
+			continue
+		}
+
+		buf.Reset()
+		enc := NewEncoder(&buf)
+		enc.SetProtocol(c.proto)
+		if err := enc.Encode(v); err != nil {
+			t.Errorf("%q: want no encode error, got %v", c.enc, err)
+			continue
+		}
+		if got := buf.String(); got != c.enc {
+			t.Errorf("want %q, got %q", c.enc, got)
+		}
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	in := "*6\r\n+OK\r\n-ERR x\r\n:3\r\n$-1\r\n*-1\r\n%1\r\n$1\r\na\r\n,2.5\r\n"
+	v, err := NewDecoder(strings.NewReader(in)).DecodeValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != KindArray {
+		t.Fatalf("want %v, got %v", KindArray, v.Kind)
+	}
+
+	elems := v.Elems()
+	kinds := []Kind{KindSimpleString, KindError, KindInteger, KindNilBulkString, KindNilArray, KindMap}
+	if len(elems) != len(kinds) {
+		t.Fatalf("want %d elements, got %d", len(kinds), len(elems))
+	}
+	for i, k := range kinds {
+		if elems[i].Kind != k {
+			t.Errorf("%d: want %v, got %v", i, k, elems[i].Kind)
+		}
+	}
+
+	if s := elems[0].Str(); s != "OK" {
+		t.Errorf("want OK, got %q", s)
+	}
+	if !elems[1].IsError() || elems[1].Str() != "ERR x" {
+		t.Errorf("want error ERR x, got %v", elems[1].Interface())
+	}
+	if n := elems[2].Int(); n != 3 {
+		t.Errorf("want 3, got %d", n)
+	}
+	if !elems[3].IsNil() || !elems[4].IsNil() || elems[2].IsNil() {
+		t.Errorf("want only nil values to be nil")
+	}
+	m := elems[5].Map()
+	if len(m) != 1 || m[0].Key != "a" || ValueOf(m[0].Value).Float() != 2.5 {
+		t.Errorf("want map a: 2.5, got %v", m)
+	}
+	if k := ValueOf(struct{}{}).Kind; k != KindInvalid {
+		t.Errorf("want %v, got %v", KindInvalid, k)
+	}
+}
+
+func TestDecodeBorrowBytes(t *testing.T) {
+	raw := "*4\r\n$2\r\nab\r\n$-1\r\n$0\r\n\r\n$3\r\ncde\r\n$3\r\nfgh\r\n"
+	dec := NewDecoder(strings.NewReader(raw))
+	dec.SetBorrowBytes(true)
+
+	v, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, raw, v, Array{[]byte("ab"), NilBulkString{}, []byte{}, []byte("cde")})
+	if got := ValueOf(v.(Array)[3]); got.Kind != KindBulkString || got.Str() != "cde" {
+		t.Errorf("want bulk string %q, got %v %q", "cde", got.Kind, got.Str())
+	}
+
+	v, err = dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, raw, v, []byte("fgh"))
+
+	// requests are always decoded as strings
+	dec.Reset(strings.NewReader("*1\r\n$4\r\nPING\r\n"))
+	req, err := dec.DecodeRequest()
+	if err != nil || len(req) != 1 || req[0] != "PING" {
+		t.Errorf("want [PING], got %v and %v", req, err)
+	}
+}
+
+func TestDecodeBulkStringTo(t *testing.T) {
+	data := strings.Repeat("a", 70000)
+	cases := []struct {
+		enc  string
+		n    int64
+		want string
+		err  error
+	}{
+		{"$3\r\nabc\r\n", 3, "abc", nil},
+		{"$0\r\n\r\n", 0, "", nil},
+		{"$-1\r\n", -1, "", nil},
+		{"$70000\r\n" + data + "\r\n", 70000, data, nil},
+		{"$4\r\nabc", 3, "abc", io.ErrUnexpectedEOF},
+		{"$3\r\nabcZ\n", 3, "abc", ErrMissingCRLF},
+		{"$3\r\nabc", 3, "abc", io.ErrUnexpectedEOF},
+		{"$-2\r\n", 0, "", ErrInvalidBulkString},
+		{"+OK\r\n", 0, "", ErrInvalidBulkString},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		n, err := NewDecoder(strings.NewReader(c.enc)).DecodeBulkStringTo(&buf)
+		if err != c.err {
+			t.Errorf("%.20q: want error %v, got %v", c.enc, c.err, err)
+		}
+		if n != c.n || buf.String() != c.want {
+			t.Errorf("%.20q: want %d bytes, got %d bytes and %.20q", c.enc, c.n, n, buf.String())
+		}
+	}
+}
+
+func TestCopyValue(t *testing.T) {
+	data := strings.Repeat("a", 70000)
+	valid := []string{
+		"+OK\r\n",
+		"-ERR failed\r\n",
+		":-12\r\n",
+		"$70000\r\n" + data + "\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*3\r\n:1\r\n$1\r\na\r\n*1\r\n+b\r\n",
+		"%2\r\n+a\r\n:1\r\n+b\r\n_\r\n",
+		"~2\r\n,1.50\r\n#t\r\n",
+		">2\r\n+invalidate\r\n(12345678901234567890\r\n",
+		"=7\r\ntxt:abc\r\n",
+		"!3\r\nerr\r\n",
+		"|1\r\n+key\r\n:1\r\n*1\r\n:2\r\n",
+	}
+	for _, enc := range valid {
+		var buf bytes.Buffer
+		dec := NewDecoder(strings.NewReader(enc + "+next\r\n"))
+		if err := dec.CopyValue(&buf); err != nil {
+			t.Errorf("%.20q: want no error, got %v", enc, err)
+		}
+		if buf.String() != enc {
+			t.Errorf("%.20q: want the value copied as is, got %.20q", enc, buf.String())
+		}
+		if v, err := dec.Decode(); v != SimpleString("next") || err != nil {
+			t.Errorf("%.20q: want next value, got %#v and %v", enc, v, err)
+		}
+	}
+
+	invalid := []struct {
+		enc string
+		err error
+	}{
+		{"", io.EOF},
+		{"?x\r\n", ErrInvalidPrefix},
+		{"+OK", io.ErrUnexpectedEOF},
+		{"+OK\rx", ErrMissingCRLF},
+		{"$3\r\nabc", io.ErrUnexpectedEOF},
+		{"$3\r\nabcZ\n", ErrMissingCRLF},
+		{"$536870913\r\n", ErrInvalidBulkString},
+		{"!-1\r\n", ErrInvalidBulkString},
+		{"*2\r\n:1\r\n", io.ErrUnexpectedEOF},
+		{"*16777217\r\n", ErrInvalidArray},
+		{"%8388609\r\n", ErrInvalidArray},
+		{"|-1\r\n", ErrInvalidArray},
+		{strings.Repeat("*1\r\n", defaultMaxDepth+1), ErrTooDeep},
+		{strings.Repeat("|1\r\n_\r\n_\r\n", 1<<20) + "_\r\n", ErrTooDeep},
+	}
+	for _, c := range invalid {
+		if err := NewDecoder(strings.NewReader(c.enc)).CopyValue(ioutil.Discard); err != c.err {
+			t.Errorf("%.20q: want error %v, got %v", c.enc, c.err, err)
+		}
+	}
+}
+
 func assertValue(t *testing.T, in string, got, exp interface{}) {
 	tgot, texp := reflect.TypeOf(got), reflect.TypeOf(exp)
 	if tgot != texp {
@@ -213,3 +623,78 @@ func BenchmarkDecodeRequest(b *testing.B) {
 	}
 	forbenchmark = val
 }
+
+func benchmarkDecodeReused(b *testing.B, enc []byte, borrow bool) {
+	var val interface{}
+	var err error
+
+	r := bytes.NewReader(enc)
+	dec := NewDecoder(r)
+	dec.SetBorrowBytes(borrow)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(enc)
+		dec.Reset(r)
+		val, err = dec.Decode()
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	forbenchmark = val
+}
+
+func BenchmarkDecodeReusedBulkString(b *testing.B) {
+	benchmarkDecodeReused(b, decodeValidCases[14].enc, false)
+}
+
+func BenchmarkDecodeBorrowedBulkString(b *testing.B) {
+	benchmarkDecodeReused(b, decodeValidCases[14].enc, true)
+}
+
+func BenchmarkDecodeReusedArray(b *testing.B) {
+	benchmarkDecodeReused(b, decodeValidCases[21].enc, false)
+}
+
+func BenchmarkDecodeBorrowedArray(b *testing.B) {
+	benchmarkDecodeReused(b, decodeValidCases[21].enc, true)
+}
+
+func BenchmarkDecodeReusedDouble(b *testing.B) {
+	benchmarkDecodeReused(b, decodeValidCases[23].enc, false)
+}
+
+func BenchmarkDecodeReusedRequest(b *testing.B) {
+	var val []string
+	var err error
+
+	enc := decodeRequestCases[5].raw
+	r := bytes.NewReader(enc)
+	dec := NewDecoder(r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(enc)
+		dec.Reset(r)
+		val, err = dec.DecodeRequest()
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	forbenchmark = val
+}
+func BenchmarkDecodeBulkStringTo(b *testing.B) {
+	var err error
+
+	enc := []byte("$65536\r\n" + strings.Repeat("a", 65536) + "\r\n")
+	r := bytes.NewReader(enc)
+	dec := NewDecoder(r)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(enc)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(enc)
+		dec.Reset(r)
+		_, err = dec.DecodeBulkStringTo(ioutil.Discard)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -15,6 +18,13 @@ var (
 	f    = []byte(":0\r\n")
 	one  = t
 	zero = f
+
+	// RESP3 values
+	t3   = []byte("#t\r\n")
+	f3   = []byte("#f\r\n")
+	null = []byte("_\r\n")
+
+	crlf = []byte("\r\n")
 )
 
 // ErrInvalidValue is returned if the value to encode is invalid.
@@ -43,20 +53,54 @@ type SimpleString string
 // as a BulkString, but this is the default encoding for a normal Go string.
 type BulkString string
 
+// NilBulkString is a sentinel type used to indicate that the nil bulk
+// string value should be encoded. It is the decoded value of a nil bulk
+// string, while a nil array is decoded as a nil Array.
+type NilBulkString struct{}
+
 // Encoder encodes values to the Redis serialization protocol.
 type Encoder struct {
 	w         *bufio.Writer
 	maxLength int
+	proto     int
+
+	// scratch space to format the numbers without allocations
+	scratch [32]byte
+	double  [32]byte
+	big     []byte
+
+	// the nesting level of the marshaled pointers, maps and slices, and
+	// the ones being encoded past startDetectingCyclesAfter
+	ptrLevel uint
+	ptrSeen  map[ptrKey]struct{}
 }
 
-// NewEncoder returns a new Encoder that writes to w.
+// NewEncoder returns a new Encoder that writes to w, using RESP2.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{
 		w:         bufferedWriter(w),
 		maxLength: defaultMaxLength,
+		proto:     RESP2,
 	}
 }
 
+// SetProtocol sets the version of the protocol used to encode the
+// values, RESP2 or RESP3. In RESP2, the RESP3 types are encoded as
+// their closest RESP2 type, as Redis does.
+func (e *Encoder) SetProtocol(version int) {
+	e.proto = version
+}
+
+// Reset discards the buffered data and makes the Encoder write to w, so
+// that it can be reused.
+func (e *Encoder) Reset(w io.Writer) {
+	if bw, ok := w.(*bufio.Writer); ok {
+		e.w = bw
+		return
+	}
+	e.w.Reset(w)
+}
+
 func bufferedWriter(w io.Writer) *bufio.Writer {
 	if bw, ok := w.(*bufio.Writer); ok {
 		return bw
@@ -64,7 +108,8 @@ func bufferedWriter(w io.Writer) *bufio.Writer {
 	return bufio.NewWriter(w)
 }
 
-// Encode encodes the value v.
+// Encode encodes the value v. The values of the Go types that are not
+// defined by this package are converted as Marshal does.
 func (e *Encoder) Encode(v interface{}) error {
 	if err := e.encodeValue(v); err != nil {
 		return err
@@ -72,7 +117,27 @@ func (e *Encoder) Encode(v interface{}) error {
 	return e.w.Flush()
 }
 
-// TODO: use reusable scratch space and strconv.AppendXxx
+// EncodeBulkStringFrom encodes a bulk string of n bytes read from r, as
+// they are read, so that a large value is not buffered in memory. It
+// returns io.ErrUnexpectedEOF if r has less than n bytes.
+func (e *Encoder) EncodeBulkStringFrom(r io.Reader, n int64) error {
+	if n < 0 {
+		return ErrInvalidValue
+	}
+	if err := e.writeHeader('$', n); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(e.w, r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if _, err := e.w.Write(crlf); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
 
 func (e *Encoder) encodeValue(v interface{}) error {
 	switch v := v.(type) {
@@ -83,12 +148,7 @@ func (e *Encoder) encodeValue(v interface{}) error {
 		_, err := e.w.Write(pong)
 		return err
 	case bool:
-		if v {
-			_, err := e.w.Write(t)
-			return err
-		}
-		_, err := e.w.Write(f)
-		return err
+		return e.encodeBoolean(v)
 	case SimpleString:
 		return e.encodeSimpleString(v)
 	case Error:
@@ -105,11 +165,11 @@ func (e *Encoder) encodeValue(v interface{}) error {
 			return e.encodeInteger(v)
 		}
 	case string:
-		return e.encodeBulkString(BulkString(v))
-	case BulkString:
 		return e.encodeBulkString(v)
+	case BulkString:
+		return e.encodeBulkString(string(v))
 	case []byte:
-		return e.encodeBulkString(BulkString(v))
+		return e.encodeBulkBytes(v)
 	case []string:
 		return e.encodeStringArray(v)
 	case []interface{}:
@@ -118,8 +178,29 @@ func (e *Encoder) encodeValue(v interface{}) error {
 		return e.encodeArray(v)
 	case nil:
 		return e.encodeNil()
+	case NilBulkString:
+		return e.writeHeader('$', -1)
+	case Null:
+		return e.encodeNil()
+	case BlobError:
+		return e.encodeBlobError(v)
+	case float64:
+		return e.encodeDouble(v)
+	case *big.Int:
+		return e.encodeBigNumber(v)
+	case VerbatimString:
+		return e.encodeVerbatimString(v)
+	case Map:
+		return e.encodeMap('%', v)
+	case Set:
+		return e.encodeAggregate('~', Array(v))
+	case Push:
+		return e.encodeAggregate('>', Array(v))
+	case Attributed:
+		return e.encodeAttributed(v)
 	default:
-		return ErrInvalidValue
+		// the other Go values, see Marshal
+		return e.encodeMarshaled(v)
 	}
 }
 
@@ -128,18 +209,17 @@ func (e *Encoder) encodeValue(v interface{}) error {
 func (e *Encoder) encodeStringArray(v []string) error {
 	// Special case for a nil array
 	if v == nil {
-		return e.encodePrefixed('*', "-1")
+		return e.encodeNilArray()
 	}
 
 	// First encode the number of elements
-	n := len(v)
-	if err := e.encodePrefixed('*', strconv.Itoa(n)); err != nil {
+	if err := e.writeHeader('*', int64(len(v))); err != nil {
 		return err
 	}
 
 	// Then encode each value
 	for _, el := range v {
-		if err := e.encodeBulkString(BulkString(el)); err != nil {
+		if err := e.encodeBulkString(el); err != nil {
 			return err
 		}
 	}
@@ -148,14 +228,22 @@ func (e *Encoder) encodeStringArray(v []string) error {
 
 // encodeArray encodes an array value to w.
 func (e *Encoder) encodeArray(v Array) error {
+	return e.encodeAggregate('*', v)
+}
+
+// encodeAggregate encodes an array, set or push value to w, with the
+// specified prefix. In RESP2, it is always encoded as an array.
+func (e *Encoder) encodeAggregate(prefix byte, v Array) error {
 	// Special case for a nil array
 	if v == nil {
-		return e.encodePrefixed('*', "-1")
+		return e.encodeNilArray()
 	}
 
 	// First encode the number of elements
-	n := len(v)
-	if err := e.encodePrefixed('*', strconv.Itoa(n)); err != nil {
+	if e.proto != RESP3 {
+		prefix = '*'
+	}
+	if err := e.writeHeader(prefix, int64(len(v))); err != nil {
 		return err
 	}
 
@@ -169,39 +257,213 @@ func (e *Encoder) encodeArray(v Array) error {
 }
 
 // encodeBulkString encodes a bulk string to w.
-func (e *Encoder) encodeBulkString(v BulkString) error {
-	n := len(v)
-	data := strconv.Itoa(n) + "\r\n" + string(v)
-	return e.encodePrefixed('$', data)
+func (e *Encoder) encodeBulkString(v string) error {
+	if err := e.writeHeader('$', int64(len(v))); err != nil {
+		return err
+	}
+	return e.writeString(v)
+}
+
+// encodeBulkBytes encodes a byte slice as a bulk string to w.
+func (e *Encoder) encodeBulkBytes(v []byte) error {
+	if err := e.writeHeader('$', int64(len(v))); err != nil {
+		return err
+	}
+	return e.writeBytes(v)
 }
 
 // encodeInteger encodes an integer value to w.
 func (e *Encoder) encodeInteger(v int64) error {
-	return e.encodePrefixed(':', strconv.FormatInt(v, 10))
+	return e.writeHeader(':', v)
 }
 
 // encodeSimpleString encodes a simple string value to w.
 func (e *Encoder) encodeSimpleString(v SimpleString) error {
-	return e.encodePrefixed('+', string(v))
+	return e.writeLine('+', string(v))
 }
 
 // encodeError encodes an error value to w.
 func (e *Encoder) encodeError(v Error) error {
-	return e.encodePrefixed('-', string(v))
+	return e.writeLine('-', string(v))
 }
 
-// encodeNil encodes a nil value as a nil bulk string.
+// encodeBlobError encodes a blob error value to w, as an error in RESP2
+// where its CR and LF characters are replaced by spaces.
+func (e *Encoder) encodeBlobError(v BlobError) error {
+	if e.proto != RESP3 {
+		s := strings.NewReplacer("\r", " ", "\n", " ").Replace(string(v))
+		return e.encodeError(Error(s))
+	}
+	if err := e.writeHeader('!', int64(len(v))); err != nil {
+		return err
+	}
+	return e.writeString(string(v))
+}
+
+// encodeNil encodes a nil value as a nil bulk string, or as a null in
+// RESP3.
 func (e *Encoder) encodeNil() error {
-	return e.encodePrefixed('$', "-1")
+	if e.proto == RESP3 {
+		_, err := e.w.Write(null)
+		return err
+	}
+	return e.writeHeader('$', -1)
+}
+
+// encodeNilArray encodes a nil array, or a null in RESP3.
+func (e *Encoder) encodeNilArray() error {
+	if e.proto == RESP3 {
+		_, err := e.w.Write(null)
+		return err
+	}
+	return e.writeHeader('*', -1)
 }
 
-// encodePrefixed encodes the data v to w, with the specified prefix.
-func (e *Encoder) encodePrefixed(prefix byte, v string) error {
-	// TODO: reuse scratch space
-	buf := make([]byte, len(v)+3)
-	buf[0] = prefix
-	copy(buf[1:], v)
-	copy(buf[len(buf)-2:], "\r\n")
+// encodeBoolean encodes a boolean value to w, as an integer in RESP2.
+func (e *Encoder) encodeBoolean(v bool) error {
+	b := f
+	switch {
+	case v && e.proto == RESP3:
+		b = t3
+	case v:
+		b = t
+	case e.proto == RESP3:
+		b = f3
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+// encodeDouble encodes a double value to w, as a bulk string in RESP2.
+func (e *Encoder) encodeDouble(v float64) error {
+	b := e.double[:0]
+	switch {
+	case math.IsInf(v, 1):
+		b = append(b, "inf"...)
+	case math.IsInf(v, -1):
+		b = append(b, "-inf"...)
+	case math.IsNaN(v):
+		b = append(b, "nan"...)
+	default:
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+	if e.proto != RESP3 {
+		return e.encodeBulkBytes(b)
+	}
+	if err := e.w.WriteByte(','); err != nil {
+		return err
+	}
+	return e.writeBytes(b)
+}
+
+// encodeBigNumber encodes a big number value to w, as a bulk string in
+// RESP2.
+func (e *Encoder) encodeBigNumber(v *big.Int) error {
+	if v == nil {
+		return e.encodeNil()
+	}
+	e.big = v.Append(e.big[:0], 10)
+	if e.proto != RESP3 {
+		return e.encodeBulkBytes(e.big)
+	}
+	if err := e.w.WriteByte('('); err != nil {
+		return err
+	}
+	return e.writeBytes(e.big)
+}
+
+// encodeVerbatimString encodes a verbatim string value to w, as a bulk
+// string of its text in RESP2.
+func (e *Encoder) encodeVerbatimString(v VerbatimString) error {
+	if e.proto != RESP3 {
+		return e.encodeBulkString(v.Text)
+	}
+	if len(v.Format) != 3 {
+		return ErrInvalidValue
+	}
+	n := len(v.Format) + 1 + len(v.Text)
+	if err := e.writeHeader('=', int64(n)); err != nil {
+		return err
+	}
+	if _, err := e.w.WriteString(v.Format); err != nil {
+		return err
+	}
+	if err := e.w.WriteByte(':'); err != nil {
+		return err
+	}
+	return e.writeString(v.Text)
+}
+
+// encodeMap encodes a map value to w with the specified prefix, '%'
+// for maps and '|' for attributes. In RESP2, it is encoded as a flat
+// array of keys and values.
+func (e *Encoder) encodeMap(prefix byte, v Map) error {
+	if v == nil {
+		return e.encodeNilArray()
+	}
+
+	n := len(v)
+	if e.proto != RESP3 {
+		prefix, n = '*', 2*n
+	}
+	if err := e.writeHeader(prefix, int64(n)); err != nil {
+		return err
+	}
+
+	for _, kv := range v {
+		if err := e.encodeValue(kv.Key); err != nil {
+			return err
+		}
+		if err := e.encodeValue(kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeAttributed encodes the attributes followed by the value to w.
+// The attributes are omitted in RESP2.
+func (e *Encoder) encodeAttributed(v Attributed) error {
+	if e.proto == RESP3 && v.Attributes != nil {
+		if err := e.encodeMap('|', v.Attributes); err != nil {
+			return err
+		}
+	}
+	return e.encodeValue(v.Value)
+}
+
+// writeHeader writes the prefix followed by the integer n and a CRLF to
+// w, formatting n in the scratch space.
+func (e *Encoder) writeHeader(prefix byte, n int64) error {
+	buf := append(e.scratch[:0], prefix)
+	buf = strconv.AppendInt(buf, n, 10)
+	buf = append(buf, '\r', '\n')
 	_, err := e.w.Write(buf)
 	return err
 }
+
+// writeLine writes the prefix followed by v and a CRLF to w.
+func (e *Encoder) writeLine(prefix byte, v string) error {
+	if err := e.w.WriteByte(prefix); err != nil {
+		return err
+	}
+	return e.writeString(v)
+}
+
+// writeString writes v followed by a CRLF to w.
+func (e *Encoder) writeString(v string) error {
+	if _, err := e.w.WriteString(v); err != nil {
+		return err
+	}
+	_, err := e.w.Write(crlf)
+	return err
+}
+
+// writeBytes writes v followed by a CRLF to w.
+func (e *Encoder) writeBytes(v []byte) error {
+	if _, err := e.w.Write(v); err != nil {
+		return err
+	}
+	_, err := e.w.Write(crlf)
+	return err
+}
@@ -2,8 +2,12 @@ package resp
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"strings"
 	"testing"
-	"time"
 )
 
 var encodeValidCases = []struct {
@@ -41,7 +45,7 @@ var encodeValidCases = []struct {
 	{[]byte("*5\r\n+string\r\n-error\r\n:-2345\r\n$4\r\nallo\r\n*2\r\n$0\r\n\r\n$-1\r\n"),
 		Array{SimpleString("string"), Error("error"), int64(-2345), "allo",
 			Array{"", nil}}, nil},
-	{nil, time.Second, ErrInvalidValue},
+	{nil, make(chan int), ErrInvalidValue},
 }
 
 func TestEncode(t *testing.T) {
@@ -63,6 +67,101 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+var encodeRESP3Cases = []struct {
+	val   interface{}
+	resp2 string
+	resp3 string
+}{
+	{nil, "$-1\r\n", "_\r\n"},
+	{Null{}, "$-1\r\n", "_\r\n"},
+	{NilBulkString{}, "$-1\r\n", "$-1\r\n"},
+	{BlobError("ERR a\r\nb"), "-ERR a  b\r\n", "!8\r\nERR a\r\nb\r\n"},
+	{Array(nil), "*-1\r\n", "_\r\n"},
+	{[]string(nil), "*-1\r\n", "_\r\n"},
+	{true, ":1\r\n", "#t\r\n"},
+	{false, ":0\r\n", "#f\r\n"},
+	{1.5, "$3\r\n1.5\r\n", ",1.5\r\n"},
+	{float64(-2), "$2\r\n-2\r\n", ",-2\r\n"},
+	{math.Inf(1), "$3\r\ninf\r\n", ",inf\r\n"},
+	{math.Inf(-1), "$4\r\n-inf\r\n", ",-inf\r\n"},
+	{math.NaN(), "$3\r\nnan\r\n", ",nan\r\n"},
+	{big.NewInt(-123), "$4\r\n-123\r\n", "(-123\r\n"},
+	{VerbatimString{Format: "txt", Text: "Some string"}, "$11\r\nSome string\r\n", "=15\r\ntxt:Some string\r\n"},
+	{Map{}, "*0\r\n", "%0\r\n"},
+	{Map{{"a", int64(1)}, {SimpleString("b"), Map{{"c", true}}}},
+		"*4\r\n$1\r\na\r\n:1\r\n+b\r\n*2\r\n$1\r\nc\r\n:1\r\n",
+		"%2\r\n$1\r\na\r\n:1\r\n+b\r\n%1\r\n$1\r\nc\r\n#t\r\n"},
+	{Set{"a", int64(2)}, "*2\r\n$1\r\na\r\n:2\r\n", "~2\r\n$1\r\na\r\n:2\r\n"},
+	{Push{"message", "chan"}, "*2\r\n$7\r\nmessage\r\n$4\r\nchan\r\n", ">2\r\n$7\r\nmessage\r\n$4\r\nchan\r\n"},
+	{Attributed{Attributes: Map{{"ttl", int64(3600)}}, Value: "v"},
+		"$1\r\nv\r\n", "|1\r\n$3\r\nttl\r\n:3600\r\n$1\r\nv\r\n"},
+	{Array{nil, false}, "*2\r\n$-1\r\n:0\r\n", "*2\r\n_\r\n#f\r\n"},
+}
+
+func TestEncodeRESP3(t *testing.T) {
+	var buf bytes.Buffer
+
+	for _, c := range encodeRESP3Cases {
+		for _, proto := range []int{RESP2, RESP3} {
+			want := c.resp2
+			if proto == RESP3 {
+				want = c.resp3
+			}
+
+			buf.Reset()
+			enc := NewEncoder(&buf)
+			enc.SetProtocol(proto)
+			if err := enc.Encode(c.val); err != nil {
+				t.Errorf("%v: RESP%d: want no error, got %v", c.val, proto, err)
+				continue
+			}
+			if got := buf.String(); got != want {
+				t.Errorf("%v: RESP%d: want %q, got %q", c.val, proto, want, got)
+			}
+		}
+	}
+}
+
+func TestEncodeBulkStringFrom(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	data := strings.Repeat("a", 70000)
+	if err := enc.EncodeBulkStringFrom(strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if want := "$70000\r\n" + data + "\r\n"; buf.String() != want {
+		t.Errorf("want bulk string of %d bytes, got %.20q", len(want), buf.String())
+	}
+
+	buf.Reset()
+	enc.Reset(&buf)
+	if err := enc.EncodeBulkStringFrom(strings.NewReader("abc"), 4); err != io.ErrUnexpectedEOF {
+		t.Errorf("want %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if err := enc.EncodeBulkStringFrom(strings.NewReader("abc"), -1); err != ErrInvalidValue {
+		t.Errorf("want %v, got %v", ErrInvalidValue, err)
+	}
+}
+
+func TestEncodeReset(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+	enc := NewEncoder(&buf1)
+	if err := enc.Encode(int64(12)); err != nil {
+		t.Fatal(err)
+	}
+	enc.Reset(&buf2)
+	if err := enc.Encode("ab"); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf1.String(); got != ":12\r\n" {
+		t.Errorf("want %q in first writer, got %q", ":12\r\n", got)
+	}
+	if got := buf2.String(); got != "$2\r\nab\r\n" {
+		t.Errorf("want %q in second writer, got %q", "$2\r\nab\r\n", got)
+	}
+}
+
 func BenchmarkEncodeSimpleString(b *testing.B) {
 	var err error
 	var buf bytes.Buffer
@@ -122,3 +221,50 @@ func BenchmarkEncodeArray(b *testing.B) {
 		b.Fatal(err)
 	}
 }
+
+func benchmarkEncode(b *testing.B, val interface{}, proto int) {
+	var err error
+
+	enc := NewEncoder(ioutil.Discard)
+	enc.SetProtocol(proto)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err = enc.Encode(val)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkEncodeBulkBytes(b *testing.B) {
+	benchmarkEncode(b, []byte("ceci n'est pas un string"), RESP2)
+}
+
+func BenchmarkEncodeStringArray(b *testing.B) {
+	benchmarkEncode(b, []string{"SET", "mykey", "ceci n'est pas un string"}, RESP2)
+}
+
+func BenchmarkEncodeDouble(b *testing.B) {
+	benchmarkEncode(b, 1.5, RESP3)
+}
+
+func BenchmarkEncodeBigNumber(b *testing.B) {
+	benchmarkEncode(b, bigInt("3492890328409238509324850943850943825024385"), RESP3)
+}
+
+func BenchmarkEncodeBulkStringFrom(b *testing.B) {
+	var err error
+
+	data := bytes.Repeat([]byte("a"), 65536)
+	r := bytes.NewReader(data)
+	enc := NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		err = enc.EncodeBulkStringFrom(r, int64(len(data)))
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+package resp
+
+import "bufio"
+
+// decodeInlineRequest decodes an inline request, that is a line of
+// arguments separated by whitespace, as sent by e.g. telnet. The empty
+// lines are skipped.
+func (d *Decoder) decodeInlineRequest() ([]string, error) {
+	for {
+		line, err := d.readInlineLine()
+		if err != nil {
+			return nil, err
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) > d.maxArray {
+			return nil, ErrInvalidArray
+		}
+		if len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+// readInlineLine reads the data up to the next LF, and returns it
+// without the LF or CRLF. It returns ErrInlineTooLong if the line is
+// longer than maxLine bytes.
+func (d *Decoder) readInlineLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, err := d.r.ReadSlice('\n')
+		if len(line)+len(b) > d.maxLine+2 {
+			return nil, ErrInlineTooLong
+		}
+		line = append(line, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	if len(line) > d.maxLine {
+		return nil, ErrInlineTooLong
+	}
+	return line, nil
+}
+
+// splitArgs splits the line in arguments as redis-cli does. The
+// arguments are separated by whitespace, and may be quoted. In double
+// quotes, the escape sequences \n, \r, \t, \b, \a and \xHH are
+// supported, and \ escapes any other character. In single quotes, only
+// \' is supported. A closing quote must be followed by whitespace or
+// the end of the line, otherwise ErrUnbalancedQuotes is returned, as
+// for a missing closing quote.
+func splitArgs(line []byte) ([]string, error) {
+	var args []string
+	i, n := 0, len(line)
+	for {
+		// skip the blanks
+		for i < n && isSpace(line[i]) {
+			i++
+		}
+		if i == n {
+			return args, nil
+		}
+
+		var arg []byte
+		var inDouble, inSingle bool
+	loop:
+		for ; ; i++ {
+			if i == n {
+				if inDouble || inSingle {
+					return nil, ErrUnbalancedQuotes
+				}
+				break
+			}
+
+			ch := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case ch == '\\' && i+3 < n && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				case ch == '\\' && i+1 < n:
+					i++
+					arg = append(arg, unescape(line[i]))
+				case ch == '"':
+					if i+1 < n && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					i++
+					break loop
+				default:
+					arg = append(arg, ch)
+				}
+
+			case inSingle:
+				switch {
+				case ch == '\\' && i+1 < n && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case ch == '\'':
+					if i+1 < n && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					i++
+					break loop
+				default:
+					arg = append(arg, ch)
+				}
+
+			default:
+				switch {
+				case isSpace(ch):
+					break loop
+				case ch == '"':
+					inDouble = true
+				case ch == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, ch)
+				}
+			}
+		}
+		args = append(args, string(arg))
+	}
+}
+
+// unescape returns the character represented by the escape sequence
+// \ch in double quotes.
+func unescape(ch byte) byte {
+	switch ch {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return ch
+	}
+}
+
+func isSpace(ch byte) bool {
+	switch ch {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+func isHex(ch byte) bool {
+	return ('0' <= ch && ch <= '9') || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F')
+}
+
+func hexValue(ch byte) byte {
+	switch {
+	case '0' <= ch && ch <= '9':
+		return ch - '0'
+	case 'a' <= ch && ch <= 'f':
+		return ch - 'a' + 10
+	default:
+		return ch - 'A' + 10
+	}
+}
@@ -0,0 +1,667 @@
+package resp
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Marshaler is implemented by the types that marshal themselves to a
+// value that the Encoder can encode, e.g. a SimpleString or a Map.
+type Marshaler interface {
+	MarshalRESP() (interface{}, error)
+}
+
+// Unmarshaler is implemented by the types that unmarshal themselves
+// from a decoded value, as returned by Decode.
+type Unmarshaler interface {
+	UnmarshalRESP(v interface{}) error
+}
+
+// ReplyError is returned by Unmarshal if the decoded value is an error
+// reply and the destination is not an Error or an interface{}.
+type ReplyError struct {
+	Msg string
+}
+
+func (e *ReplyError) Error() string {
+	return e.Msg
+}
+
+// UnmarshalTypeError is returned by Unmarshal if a decoded value cannot
+// be stored in a Go value of the destination type.
+type UnmarshalTypeError struct {
+	Kind Kind
+	Type reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("resp: cannot unmarshal %v into Go value of type %v", e.Kind, e.Type)
+}
+
+// UnsupportedValueError is returned by Marshal and Encode if the value
+// to encode contains itself, via a pointer, a map or a slice.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "resp: unsupported value: " + e.Str
+}
+
+var (
+	bigIntType          = reflect.TypeOf(big.Int{})
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Marshal returns the RESP2 encoding of v. It encodes the values that
+// the Encoder supports as it does, and the other values as follows:
+//
+//	Marshaler               the value returned by MarshalRESP
+//	error                   an Error of its message
+//	encoding.TextMarshaler  a bulk string of its text
+//	integers                an integer, or a big number if too large
+//	floats                  a double
+//	strings                 a bulk string
+//	slices and arrays       an array, or a nil array if nil
+//	maps                    a map with the keys sorted
+//	structs                 a map of the exported fields
+//	pointers, interfaces    the value they point to, or nil
+//
+// The maps are encoded as flat arrays of keys and values in RESP2. To
+// encode them as maps and use the other RESP3 types, use an Encoder
+// with the RESP3 protocol.
+//
+// The name of a struct field in the map can be set with a tag, e.g.
+// `resp:"name"`, and ",omitempty" omits the field if it has the zero
+// value of its type. A field with the tag "-" is ignored. The fields of
+// an exported embedded struct without a tag are marshaled as if they
+// were in the outer struct.
+//
+// A value that contains itself, via a pointer, a map or a slice, fails
+// with an *UnsupportedValueError instead of recursing forever.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// startDetectingCyclesAfter is the nesting level of the marshaled
+// pointers, maps and slices after which the Encoder checks for cycles,
+// as encoding/json does, so that the values that are not deeply nested
+// pay nothing for it.
+const startDetectingCyclesAfter = 1000
+
+// ptrKey identifies a pointer, map or slice being encoded. The length
+// distinguishes a slice from a shorter one sharing its array.
+type ptrKey struct {
+	ptr uintptr
+	len int
+}
+
+// encodeMarshaled encodes v, a value not supported by the Encoder, as
+// converted by marshal. It fails with an *UnsupportedValueError if v is
+// a pointer, map or slice that is already being encoded.
+func (e *Encoder) encodeMarshaled(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if rv.IsNil() {
+			break
+		}
+		e.ptrLevel++
+		defer func() { e.ptrLevel-- }()
+		if e.ptrLevel > startDetectingCyclesAfter {
+			key := ptrKey{ptr: rv.Pointer()}
+			if rv.Kind() == reflect.Slice {
+				key.len = rv.Len()
+			}
+			if _, ok := e.ptrSeen[key]; ok {
+				return &UnsupportedValueError{Value: rv, Str: fmt.Sprintf("encountered a cycle via %s", rv.Type())}
+			}
+			if e.ptrSeen == nil {
+				e.ptrSeen = make(map[ptrKey]struct{})
+			}
+			e.ptrSeen[key] = struct{}{}
+			defer delete(e.ptrSeen, key)
+		}
+	}
+
+	m, err := marshal(v)
+	if err != nil {
+		return err
+	}
+	return e.encodeValue(m)
+}
+
+// marshal converts v, a value not supported by the Encoder, to a value
+// that it supports. The elements of the aggregates are converted as
+// they are encoded.
+func marshal(v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		// before the methods, that may not support a nil receiver
+		return nil, nil
+	}
+
+	if m, ok := v.(Marshaler); ok {
+		return m.MarshalRESP()
+	}
+	if err, ok := v.(error); ok {
+		msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+		return Error(msg), nil
+	}
+	if m, ok := v.(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := rv.Uint(); u > math.MaxInt64 {
+			return new(big.Int).SetUint64(u), nil
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return rv.String(), nil
+
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return rv.Elem().Interface(), nil
+
+	case reflect.Slice:
+		if rv.IsNil() {
+			return Array(nil), nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return string(rv.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		ar := make(Array, rv.Len())
+		for i := range ar {
+			ar[i] = rv.Index(i).Interface()
+		}
+		return ar, nil
+
+	case reflect.Map:
+		if rv.IsNil() {
+			return Map(nil), nil
+		}
+		keys := rv.MapKeys()
+		sortKeys(keys)
+		m := make(Map, len(keys))
+		for i, k := range keys {
+			m[i] = KeyValue{Key: k.Interface(), Value: rv.MapIndex(k).Interface()}
+		}
+		return m, nil
+
+	case reflect.Struct:
+		if rv.Type() == bigIntType {
+			n := rv.Interface().(big.Int)
+			return &n, nil
+		}
+		var m Map
+		for _, f := range structFields(rv.Type()) {
+			fv := rv.FieldByIndex(f.index)
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			m = append(m, KeyValue{Key: f.name, Value: fv.Interface()})
+		}
+		if m == nil {
+			m = Map{}
+		}
+		return m, nil
+	}
+	return nil, ErrInvalidValue
+}
+
+// sortKeys sorts the keys of a map, so that the encoding is stable.
+func sortKeys(keys []reflect.Value) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch a.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() < b.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return a.Uint() < b.Uint()
+		case reflect.Float32, reflect.Float64:
+			return a.Float() < b.Float()
+		case reflect.String:
+			return a.String() < b.String()
+		default:
+			return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+		}
+	})
+}
+
+// isEmptyValue returns true if v is the zero value of its type, or an
+// empty slice or map.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field is a marshaled field of a struct.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// structFields returns the marshaled fields of the struct type t.
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("resp")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if sf.Anonymous && tag == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range structFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: []int{i}, omitEmpty: opts == "omitempty"})
+	}
+	return fields
+}
+
+// Unmarshal decodes the first value in data and stores it in the value
+// pointed to by v. See UnmarshalValue for the conversions.
+func Unmarshal(data []byte, v interface{}) error {
+	val, err := NewDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		return err
+	}
+	return UnmarshalValue(val, v)
+}
+
+// UnmarshalValue stores src, a value as returned by Decode, in the value
+// pointed to by dst. It supports the Go types supported by Marshal, and
+// converts the decoded values as follows:
+//
+//   - a value assignable to the destination is assigned as is;
+//   - the nil values set the destination to its zero value;
+//   - an error reply fails with a *ReplyError, unless the destination
+//     is an Error or an interface{};
+//   - the strings are parsed into numbers and booleans;
+//   - the integers and doubles are converted to the other numeric types,
+//     if they fit, and formatted into strings;
+//   - the maps and the flat arrays of keys and values are stored in Go
+//     maps and structs, the keys of the structs matching the names of the
+//     fields as Marshal sets them, or case-insensitively.
+//
+// It fails with an *UnmarshalTypeError if a value cannot be converted.
+func UnmarshalValue(src interface{}, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("resp: Unmarshal requires a non-nil pointer, got %T", dst)
+	}
+	return unmarshal(src, rv.Elem())
+}
+
+func unmarshal(src interface{}, dst reflect.Value) error {
+	if dst.CanAddr() {
+		pv := dst.Addr()
+		if pv.Type().Implements(unmarshalerType) {
+			return pv.Interface().(Unmarshaler).UnmarshalRESP(src)
+		}
+	}
+
+	// a []byte may be borrowed from the Decoder, so it is always copied
+	if b, ok := src.([]byte); ok {
+		src = append([]byte(nil), b...)
+	}
+	if src != nil {
+		if st := reflect.TypeOf(src); st.AssignableTo(dst.Type()) {
+			dst.Set(reflect.ValueOf(src))
+			return nil
+		}
+	}
+
+	val := ValueOf(src)
+	switch {
+	case src == nil || val.IsNil():
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	case val.IsError():
+		return &ReplyError{Msg: val.Str()}
+	case val.Kind == KindAttributed:
+		return unmarshal(val.AttributedValue().Interface(), dst)
+	}
+
+	if dst.CanAddr() && dst.Addr().Type().Implements(textUnmarshalerType) {
+		if s, ok := stringOf(val); ok {
+			return dst.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		}
+	}
+
+	typeErr := &UnmarshalTypeError{Kind: val.Kind, Type: dst.Type()}
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return unmarshal(src, dst.Elem())
+
+	case reflect.Bool:
+		switch val.Kind {
+		case KindBoolean:
+			dst.SetBool(val.Bool())
+		case KindInteger:
+			dst.SetBool(val.Int() != 0)
+		default:
+			s, _ := stringOf(val)
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return typeErr
+			}
+			dst.SetBool(b)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := intOf(val)
+		if !ok || dst.OverflowInt(n) {
+			return typeErr
+		}
+		dst.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := uintOf(val)
+		if !ok || dst.OverflowUint(n) {
+			return typeErr
+		}
+		dst.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := floatOf(val)
+		if !ok || dst.OverflowFloat(f) {
+			return typeErr
+		}
+		dst.SetFloat(f)
+
+	case reflect.String:
+		s, ok := stringOf(val)
+		if !ok {
+			return typeErr
+		}
+		dst.SetString(s)
+
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			s, ok := stringOf(val)
+			if !ok {
+				return typeErr
+			}
+			dst.SetBytes([]byte(s))
+			return nil
+		}
+		elems := elemsOf(val)
+		if elems == nil {
+			return typeErr
+		}
+		sl := reflect.MakeSlice(dst.Type(), len(elems), len(elems))
+		for i, el := range elems {
+			if err := unmarshal(el, sl.Index(i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(sl)
+
+	case reflect.Array:
+		elems := elemsOf(val)
+		if elems == nil || len(elems) != dst.Len() {
+			return typeErr
+		}
+		for i, el := range elems {
+			if err := unmarshal(el, dst.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		m, ok := mapOf(val)
+		if !ok {
+			return typeErr
+		}
+		t := dst.Type()
+		mv := reflect.MakeMapWithSize(t, len(m))
+		for _, kv := range m {
+			k := reflect.New(t.Key()).Elem()
+			if err := unmarshal(kv.Key, k); err != nil {
+				return err
+			}
+			v := reflect.New(t.Elem()).Elem()
+			if err := unmarshal(kv.Value, v); err != nil {
+				return err
+			}
+			mv.SetMapIndex(k, v)
+		}
+		dst.Set(mv)
+
+	case reflect.Struct:
+		if dst.Type() == bigIntType {
+			n, ok := bigIntOf(val)
+			if !ok {
+				return typeErr
+			}
+			dst.Set(reflect.ValueOf(*n))
+			return nil
+		}
+
+		m, ok := mapOf(val)
+		if !ok {
+			return typeErr
+		}
+		fields := structFields(dst.Type())
+		for _, kv := range m {
+			name, ok := stringOf(ValueOf(kv.Key))
+			if !ok {
+				continue
+			}
+			if f := fieldByName(fields, name); f != nil {
+				if err := unmarshal(kv.Value, dst.FieldByIndex(f.index)); err != nil {
+					return err
+				}
+			}
+		}
+
+	default:
+		return typeErr
+	}
+	return nil
+}
+
+// fieldByName returns the field named name, or matching it
+// case-insensitively, or nil.
+func fieldByName(fields []field, name string) *field {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, name) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// stringOf returns the string of a string-like or a numeric value.
+func stringOf(v Value) (string, bool) {
+	switch v.Kind {
+	case KindSimpleString, KindBulkString, KindVerbatimString:
+		return v.Str(), true
+	case KindInteger:
+		return strconv.FormatInt(v.Int(), 10), true
+	case KindDouble:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), true
+	case KindBigNumber:
+		return v.BigInt().String(), true
+	case KindBoolean:
+		return strconv.FormatBool(v.Bool()), true
+	}
+	return "", false
+}
+
+func intOf(v Value) (int64, bool) {
+	switch v.Kind {
+	case KindInteger:
+		return v.Int(), true
+	case KindDouble:
+		f := v.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(f), true
+	case KindBigNumber:
+		if !v.BigInt().IsInt64() {
+			return 0, false
+		}
+		return v.BigInt().Int64(), true
+	}
+	s, ok := stringOf(v)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+func uintOf(v Value) (uint64, bool) {
+	switch v.Kind {
+	case KindInteger:
+		if v.Int() < 0 {
+			return 0, false
+		}
+		return uint64(v.Int()), true
+	case KindBigNumber:
+		if !v.BigInt().IsUint64() {
+			return 0, false
+		}
+		return v.BigInt().Uint64(), true
+	case KindDouble:
+		f := v.Float()
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+			return 0, false
+		}
+		return uint64(f), true
+	}
+	s, ok := stringOf(v)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	return n, err == nil
+}
+
+func floatOf(v Value) (float64, bool) {
+	switch v.Kind {
+	case KindDouble:
+		return v.Float(), true
+	case KindInteger:
+		return float64(v.Int()), true
+	}
+	s, ok := stringOf(v)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+func bigIntOf(v Value) (*big.Int, bool) {
+	switch v.Kind {
+	case KindBigNumber:
+		return v.BigInt(), true
+	case KindInteger:
+		return big.NewInt(v.Int()), true
+	}
+	s, ok := stringOf(v)
+	if !ok {
+		return nil, false
+	}
+	return new(big.Int).SetString(s, 10)
+}
+
+// elemsOf returns the elements of an array, a set or a push value.
+func elemsOf(v Value) []interface{} {
+	switch x := v.Interface().(type) {
+	case Array:
+		return x
+	case Set:
+		return x
+	case Push:
+		return x
+	}
+	return nil
+}
+
+// mapOf returns the entries of a map value, or of an array of keys and
+// values as maps are encoded in RESP2.
+func mapOf(v Value) (Map, bool) {
+	switch x := v.Interface().(type) {
+	case Map:
+		return x, true
+	case Array:
+		if len(x)%2 != 0 {
+			return nil, false
+		}
+		return pairs(x), true
+	}
+	return nil, false
+}
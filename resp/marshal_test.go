@@ -0,0 +1,232 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y int
+}
+
+func (p point) MarshalRESP() (interface{}, error) {
+	return SimpleString(strings.Repeat("x", p.X)), nil
+}
+
+type upper string
+
+func (u *upper) UnmarshalRESP(v interface{}) error {
+	s, ok := v.(string)
+	if !ok {
+		return errors.New("want bulk string")
+	}
+	*u = upper(strings.ToUpper(s))
+	return nil
+}
+
+type Base struct {
+	ID int64 `resp:"id"`
+}
+
+type tunnelInfo struct {
+	Base
+	Host    string            `resp:"host"`
+	Port    uint16            `resp:"port"`
+	Weight  float32           `resp:"weight,omitempty"`
+	Tags    []string          `resp:"tags"`
+	Meta    map[string]int    `resp:"meta,omitempty"`
+	IP      net.IP            `resp:"ip,omitempty"`
+	Next    *tunnelInfo       `resp:"next,omitempty"`
+	Ignored string            `resp:"-"`
+	Extra   map[string]string `resp:"extra,omitempty"`
+	private int
+}
+
+var marshalCases = []struct {
+	val   interface{}
+	resp2 string
+	resp3 string
+}{
+	{int(-3), ":-3\r\n", ":-3\r\n"},
+	{int8(8), ":8\r\n", ":8\r\n"},
+	{int32(32), ":32\r\n", ":32\r\n"},
+	{uint(7), ":7\r\n", ":7\r\n"},
+	{uint64(math.MaxUint64), "$20\r\n18446744073709551615\r\n", "(18446744073709551615\r\n"},
+	{float32(0.5), "$3\r\n0.5\r\n", ",0.5\r\n"},
+	{errors.New("ERR bad\nthing"), "-ERR bad thing\r\n", "-ERR bad thing\r\n"},
+	{net.ParseIP("10.0.0.1"), "$8\r\n10.0.0.1\r\n", "$8\r\n10.0.0.1\r\n"},
+	{point{X: 2}, "+xx\r\n", "+xx\r\n"},
+	{&point{X: 1}, "+x\r\n", "+x\r\n"},
+	{(*point)(nil), "$-1\r\n", "_\r\n"},
+	{[]int{1, 2}, "*2\r\n:1\r\n:2\r\n", "*2\r\n:1\r\n:2\r\n"},
+	{[2]bool{true, false}, "*2\r\n:1\r\n:0\r\n", "*2\r\n#t\r\n#f\r\n"},
+	{[]int(nil), "*-1\r\n", "_\r\n"},
+	{map[string]int{"b": 2, "a": 1}, "*4\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n:2\r\n", "%2\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n:2\r\n"},
+	{map[int]bool{3: true, -1: false}, "*4\r\n:-1\r\n:0\r\n:3\r\n:1\r\n", "%2\r\n:-1\r\n#f\r\n:3\r\n#t\r\n"},
+	{Array{int16(1), []string{"a"}}, "*2\r\n:1\r\n*1\r\n$1\r\na\r\n", "*2\r\n:1\r\n*1\r\n$1\r\na\r\n"},
+	{tunnelInfo{Base: Base{ID: 1}, Host: "h", Port: 22, Ignored: "x", private: 1},
+		"*8\r\n$2\r\nid\r\n:1\r\n$4\r\nhost\r\n$1\r\nh\r\n$4\r\nport\r\n:22\r\n$4\r\ntags\r\n*-1\r\n",
+		"%4\r\n$2\r\nid\r\n:1\r\n$4\r\nhost\r\n$1\r\nh\r\n$4\r\nport\r\n:22\r\n$4\r\ntags\r\n_\r\n"},
+	{struct{}{}, "*0\r\n", "%0\r\n"},
+}
+
+func TestMarshal(t *testing.T) {
+	var buf bytes.Buffer
+
+	for _, c := range marshalCases {
+		b, err := Marshal(c.val)
+		if err != nil {
+			t.Errorf("%#v: want no error, got %v", c.val, err)
+		} else if string(b) != c.resp2 {
+			t.Errorf("%#v: want %q, got %q", c.val, c.resp2, b)
+		}
+
+		buf.Reset()
+		enc := NewEncoder(&buf)
+		enc.SetProtocol(RESP3)
+		if err := enc.Encode(c.val); err != nil {
+			t.Errorf("%#v: RESP3: want no error, got %v", c.val, err)
+		} else if buf.String() != c.resp3 {
+			t.Errorf("%#v: RESP3: want %q, got %q", c.val, c.resp3, buf.String())
+		}
+	}
+
+	for _, v := range []interface{}{make(chan int), func() {}, complex(1, 2), []interface{}{1, make(chan int)}} {
+		if _, err := Marshal(v); err != ErrInvalidValue {
+			t.Errorf("%T: want %v, got %v", v, ErrInvalidValue, err)
+		}
+	}
+}
+
+type list []interface{}
+
+func TestMarshalCycle(t *testing.T) {
+	ptr := &tunnelInfo{Host: "h"}
+	ptr.Next = ptr
+	m := map[string]interface{}{"a": 1}
+	m["self"] = m
+	sl := list{1, nil}
+	sl[1] = sl
+
+	for _, v := range []interface{}{ptr, m, sl, Array{1, ptr}} {
+		_, err := Marshal(v)
+		if _, ok := err.(*UnsupportedValueError); !ok {
+			t.Errorf("%T: want *UnsupportedValueError, got %v", v, err)
+		}
+	}
+
+	// deeply nested values and the values shared by siblings are not
+	// cycles
+	var deep *tunnelInfo
+	for i := 0; i < 2*startDetectingCyclesAfter; i++ {
+		deep = &tunnelInfo{Next: deep}
+	}
+	shared := &tunnelInfo{Next: deep}
+	for _, v := range []interface{}{deep, list{shared, shared}} {
+		if _, err := Marshal(v); err != nil {
+			t.Errorf("%T: want no error, got %v", v, err)
+		}
+	}
+}
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	in := tunnelInfo{
+		Base:   Base{ID: 12},
+		Host:   "redis.example",
+		Port:   6379,
+		Weight: 0.25,
+		Tags:   []string{"a", "b"},
+		Meta:   map[string]int{"x": 1},
+		IP:     net.ParseIP("10.0.0.1"),
+		Next:   &tunnelInfo{Host: "next"},
+	}
+
+	for _, proto := range []int{RESP2, RESP3} {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetProtocol(proto)
+		if err := enc.Encode(in); err != nil {
+			t.Fatal(err)
+		}
+
+		var out tunnelInfo
+		if err := Unmarshal(buf.Bytes(), &out); err != nil {
+			t.Errorf("RESP%d: want no error, got %v", proto, err)
+			continue
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("RESP%d: want %#v, got %#v", proto, in, out)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	cases := []struct {
+		enc  string
+		dst  interface{} // pointer to the destination
+		want interface{} // value pointed to by dst, or the error
+	}{
+		{":12\r\n", new(int8), int8(12)},
+		{":300\r\n", new(int8), &UnmarshalTypeError{Kind: KindInteger, Type: reflect.TypeOf(int8(0))}},
+		{":-1\r\n", new(uint), &UnmarshalTypeError{Kind: KindInteger, Type: reflect.TypeOf(uint(0))}},
+		{"$3\r\n-42\r\n", new(int), -42},
+		{"+42\r\n", new(uint32), uint32(42)},
+		{",2\r\n", new(int64), int64(2)},
+		{",2.5\r\n", new(int64), &UnmarshalTypeError{Kind: KindDouble, Type: reflect.TypeOf(int64(0))}},
+		{"(18446744073709551615\r\n", new(uint64), uint64(math.MaxUint64)},
+		{"(18446744073709551615\r\n", new(big.Int), *bigInt("18446744073709551615")},
+		{"$4\r\n1.25\r\n", new(float64), 1.25},
+		{":3\r\n", new(float32), float32(3)},
+		{":1\r\n", new(bool), true},
+		{"#f\r\n", new(bool), false},
+		{"$4\r\ntrue\r\n", new(bool), true},
+		{":12\r\n", new(string), "12"},
+		{"=7\r\ntxt:abc\r\n", new(string), "abc"},
+		{"$3\r\nabc\r\n", new([]byte), []byte("abc")},
+		{"$3\r\nabc\r\n", new(upper), upper("ABC")},
+		{"$8\r\n10.0.0.1\r\n", new(net.IP), net.ParseIP("10.0.0.1")},
+		{"$-1\r\n", func() *string { s := "x"; return &s }(), ""},
+		{"_\r\n", new(*int), (*int)(nil)},
+		{":5\r\n", new(*int), func() *int { i := 5; return &i }()},
+		{"-ERR failed\r\n", new(string), &ReplyError{Msg: "ERR failed"}},
+		{"-ERR failed\r\n", new(Error), Error("ERR failed")},
+		{"-ERR failed\r\n", new(interface{}), Error("ERR failed")},
+		{"*2\r\n:1\r\n-ERR x\r\n", new([]interface{}), []interface{}{int64(1), Error("ERR x")}},
+		{"*2\r\n:1\r\n:2\r\n", new([]int), []int{1, 2}},
+		{"~2\r\n:1\r\n:2\r\n", new([2]int), [2]int{1, 2}},
+		{"*1\r\n:1\r\n", new([2]int), &UnmarshalTypeError{Kind: KindArray, Type: reflect.TypeOf([2]int{})}},
+		{"*4\r\n+a\r\n:1\r\n+b\r\n:2\r\n", new(map[string]int), map[string]int{"a": 1, "b": 2}},
+		{"%1\r\n:1\r\n+a\r\n", new(map[int]string), map[int]string{1: "a"}},
+		{"*3\r\n+a\r\n:1\r\n+b\r\n", new(map[string]int), &UnmarshalTypeError{Kind: KindArray, Type: reflect.TypeOf(map[string]int{})}},
+		{"%2\r\n+X\r\n:1\r\n+y\r\n:2\r\n", new(point), point{X: 1, Y: 2}},
+		{"|1\r\n+ttl\r\n:1\r\n:7\r\n", new(int), 7},
+		{"+abc\r\n", new([]int), &UnmarshalTypeError{Kind: KindSimpleString, Type: reflect.TypeOf([]int{})}},
+	}
+
+	for _, c := range cases {
+		err := Unmarshal([]byte(c.enc), c.dst)
+		if want, ok := c.want.(error); ok {
+			if !reflect.DeepEqual(err, want) {
+				t.Errorf("%q: want error %v, got %v", c.enc, want, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: want no error, got %v", c.enc, err)
+			continue
+		}
+		if got := reflect.ValueOf(c.dst).Elem().Interface(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: want %#v, got %#v", c.enc, c.want, got)
+		}
+	}
+
+	if err := Unmarshal([]byte(":1\r\n"), 1); err == nil {
+		t.Errorf("want error for a non-pointer destination")
+	}
+}
@@ -0,0 +1,73 @@
+package resp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// The versions of the protocol supported by the Encoder.
+const (
+	// RESP2 is the default version of the protocol.
+	RESP2 = 2
+	// RESP3 is the version introduced in Redis 6, with the additional
+	// types defined in this file.
+	RESP3 = 3
+)
+
+// KeyValue is an entry of a Map.
+type KeyValue struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// Map represents a map as defined by RESP3. It is a slice of entries
+// so that the order of the keys is preserved, and that the keys can be
+// of any type, including arrays. It is encoded as a flat array of keys
+// and values in RESP2.
+type Map []KeyValue
+
+// String is the Stringer implementation for the Map.
+func (m Map) String() string {
+	var buf bytes.Buffer
+	for _, kv := range m {
+		buf.WriteString(fmt.Sprintf("%v (%[1]T): %v (%[2]T)\n", kv.Key, kv.Value))
+	}
+	return buf.String()
+}
+
+// Null represents the null value of RESP3. It is encoded as a nil bulk
+// string in RESP2, as is a nil interface{}.
+type Null struct{}
+
+// BlobError represents a binary-safe error string, as defined by RESP3.
+// It is encoded as an Error in RESP2.
+type BlobError string
+
+// Set represents an unordered collection of distinct values, as
+// defined by RESP3. It is encoded as an array in RESP2.
+type Set []interface{}
+
+// Push represents out-of-band data sent by the server, as defined by
+// RESP3. It is encoded as an array in RESP2.
+type Push []interface{}
+
+// VerbatimString represents a string with a three-letter format, as
+// defined by RESP3, typically "txt" or "mkd". It is encoded as a bulk
+// string of its Text in RESP2.
+type VerbatimString struct {
+	Format string
+	Text   string
+}
+
+// Attributed represents a value preceded by attributes, as defined by
+// RESP3. Only the Value is encoded in RESP2.
+type Attributed struct {
+	Attributes Map
+	Value      interface{}
+}
+
+// The other RESP3 types are represented by Go types:
+//
+//	double       float64
+//	boolean      bool
+//	big number   *big.Int
@@ -0,0 +1,247 @@
+package resp
+
+import (
+	"math/big"
+)
+
+// Kind is the kind of a decoded value.
+type Kind int
+
+// The kinds of the decoded values.
+const (
+	KindInvalid Kind = iota
+	KindSimpleString
+	KindError
+	KindInteger
+	KindBulkString
+	KindNilBulkString
+	KindArray
+	KindNilArray
+	KindNull
+	KindDouble
+	KindBoolean
+	KindBigNumber
+	KindBlobError
+	KindVerbatimString
+	KindMap
+	KindSet
+	KindPush
+	KindAttributed
+)
+
+var kindNames = [...]string{
+	KindInvalid:        "invalid",
+	KindSimpleString:   "simple string",
+	KindError:          "error",
+	KindInteger:        "integer",
+	KindBulkString:     "bulk string",
+	KindNilBulkString:  "nil bulk string",
+	KindArray:          "array",
+	KindNilArray:       "nil array",
+	KindNull:           "null",
+	KindDouble:         "double",
+	KindBoolean:        "boolean",
+	KindBigNumber:      "big number",
+	KindBlobError:      "blob error",
+	KindVerbatimString: "verbatim string",
+	KindMap:            "map",
+	KindSet:            "set",
+	KindPush:           "push",
+	KindAttributed:     "attributed",
+}
+
+// String returns the name of the kind.
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return kindNames[KindInvalid]
+	}
+	return kindNames[k]
+}
+
+// Value is a decoded value along with its Kind, for the callers that
+// prefer not to type-switch on the values returned by Decode. The
+// accessors return the zero value if the Value is not of a kind they
+// support.
+type Value struct {
+	Kind Kind
+	v    interface{}
+}
+
+// ValueOf returns the Value of v, a value as returned by Decode. Its
+// Kind is KindInvalid if v is not such a value.
+func ValueOf(v interface{}) Value {
+	var k Kind
+	switch v := v.(type) {
+	case SimpleString:
+		k = KindSimpleString
+	case Error:
+		k = KindError
+	case int64:
+		k = KindInteger
+	case string, []byte:
+		k = KindBulkString
+	case NilBulkString:
+		k = KindNilBulkString
+	case Array:
+		k = KindArray
+		if v == nil {
+			k = KindNilArray
+		}
+	case Null:
+		k = KindNull
+	case float64:
+		k = KindDouble
+	case bool:
+		k = KindBoolean
+	case *big.Int:
+		k = KindBigNumber
+	case BlobError:
+		k = KindBlobError
+	case VerbatimString:
+		k = KindVerbatimString
+	case Map:
+		k = KindMap
+	case Set:
+		k = KindSet
+	case Push:
+		k = KindPush
+	case Attributed:
+		k = KindAttributed
+	}
+	return Value{Kind: k, v: v}
+}
+
+// DecodeValue decodes the next value and returns its Value.
+func (d *Decoder) DecodeValue() (Value, error) {
+	v, err := d.Decode()
+	if err != nil {
+		return Value{}, err
+	}
+	return ValueOf(v), nil
+}
+
+// Interface returns the value as returned by Decode.
+func (v Value) Interface() interface{} {
+	return v.v
+}
+
+// IsNil returns true if the value is a nil bulk string, a nil array or
+// a null, or any other nil aggregate.
+func (v Value) IsNil() bool {
+	switch x := v.v.(type) {
+	case NilBulkString, Null:
+		return true
+	case Array:
+		return x == nil
+	case Map:
+		return x == nil
+	case Set:
+		return x == nil
+	case Push:
+		return x == nil
+	}
+	return false
+}
+
+// IsError returns true if the value is an error or a blob error.
+func (v Value) IsError() bool {
+	return v.Kind == KindError || v.Kind == KindBlobError
+}
+
+// Str returns the string of a simple string, an error, a bulk string,
+// a blob error or the text of a verbatim string.
+func (v Value) Str() string {
+	switch x := v.v.(type) {
+	case SimpleString:
+		return string(x)
+	case Error:
+		return string(x)
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case BlobError:
+		return string(x)
+	case VerbatimString:
+		return x.Text
+	}
+	return ""
+}
+
+// Bytes returns the data of a bulk string. It is not a copy if the
+// bulk string was decoded as a borrowed byte slice.
+func (v Value) Bytes() []byte {
+	switch x := v.v.(type) {
+	case []byte:
+		return x
+	case string:
+		return []byte(x)
+	}
+	return nil
+}
+
+// Int returns the integer of an integer value.
+func (v Value) Int() int64 {
+	i, _ := v.v.(int64)
+	return i
+}
+
+// Float returns the double of a double value.
+func (v Value) Float() float64 {
+	f, _ := v.v.(float64)
+	return f
+}
+
+// Bool returns the boolean of a boolean value.
+func (v Value) Bool() bool {
+	b, _ := v.v.(bool)
+	return b
+}
+
+// BigInt returns the number of a big number value.
+func (v Value) BigInt() *big.Int {
+	n, _ := v.v.(*big.Int)
+	return n
+}
+
+// Elems returns the elements of an array, a set or a push value.
+func (v Value) Elems() []Value {
+	var ar []interface{}
+	switch x := v.v.(type) {
+	case Array:
+		ar = x
+	case Set:
+		ar = x
+	case Push:
+		ar = x
+	default:
+		return nil
+	}
+
+	vals := make([]Value, len(ar))
+	for i, el := range ar {
+		vals[i] = ValueOf(el)
+	}
+	return vals
+}
+
+// Map returns the entries of a map value, or the attributes of an
+// attributed value.
+func (v Value) Map() Map {
+	switch x := v.v.(type) {
+	case Map:
+		return x
+	case Attributed:
+		return x.Attributes
+	}
+	return nil
+}
+
+// AttributedValue returns the Value that follows the attributes of an
+// attributed value.
+func (v Value) AttributedValue() Value {
+	if x, ok := v.v.(Attributed); ok {
+		return ValueOf(x.Value)
+	}
+	return Value{}
+}
@@ -0,0 +1,235 @@
+// Package sentinel implements the discovery of the Redis masters
+// monitored by Redis Sentinel, and follows their failovers.
+package sentinel
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/common"
+	"github.com/harfangapps/regis-companion/resp"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	switchMasterChannel = "+switch-master"
+
+	// maximum duration of a request to the sentinel
+	requestTimeout = 10 * time.Second
+
+	minWatchBackoff = time.Second
+	maxWatchBackoff = time.Minute
+)
+
+// ErrUnknownMaster is returned by Discover if the sentinel does not
+// monitor a master with that name.
+var ErrUnknownMaster = errors.New("sentinel: unknown master")
+
+// Master is a net.Addr that resolves to the current address of a Redis
+// master monitored by Redis Sentinel. Its address is set by Discover,
+// and is updated by Watch when the sentinel announces a failover.
+type Master struct {
+	// Name is the name of the master in the sentinel's configuration.
+	Name string
+
+	// Dial connects to the sentinel.
+	Dial func() (net.Conn, error)
+
+	// The channel to send errors to. If nil, the errors are logged.
+	// If the send would block, the error is dropped.
+	ErrChan chan<- error
+
+	mu   sync.Mutex
+	addr addr.HostPortAddr
+}
+
+// Network returns the network type for this address, which is
+// always "tcp".
+func (m *Master) Network() string {
+	return "tcp"
+}
+
+// String returns the host:port form of the current address of the
+// master.
+func (m *Master) String() string {
+	return m.Addr().String()
+}
+
+// Addr returns the current address of the master.
+func (m *Master) Addr() addr.HostPortAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addr
+}
+
+func (m *Master) setAddr(a addr.HostPortAddr) {
+	m.mu.Lock()
+	m.addr = a
+	m.mu.Unlock()
+}
+
+// Discover asks the sentinel for the current address of the master.
+func (m *Master) Discover() error {
+	conn, err := m.Dial()
+	if err != nil {
+		return errors.Wrap(err, "dial sentinel")
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return errors.Wrap(err, "set deadline")
+	}
+
+	enc := resp.NewEncoder(conn)
+	dec := resp.NewDecoder(conn)
+	if err := enc.Encode([]string{"SENTINEL", "get-master-addr-by-name", m.Name}); err != nil {
+		return errors.Wrap(err, "write request")
+	}
+	v, err := dec.Decode()
+	if err != nil {
+		return errors.Wrap(err, "read reply")
+	}
+
+	a, err := parseMasterAddr(v)
+	if err != nil {
+		return err
+	}
+	m.setAddr(a)
+	return nil
+}
+
+// parseMasterAddr parses the reply to SENTINEL get-master-addr-by-name.
+func parseMasterAddr(v interface{}) (addr.HostPortAddr, error) {
+	switch v := v.(type) {
+	case resp.Array:
+		if v == nil {
+			return addr.HostPortAddr{}, ErrUnknownMaster
+		}
+		if len(v) == 2 {
+			host, _ := v[0].(string)
+			port, _ := v[1].(string)
+			return parseHostPort(host, port)
+		}
+	case resp.Null:
+		return addr.HostPortAddr{}, ErrUnknownMaster
+	case resp.Error:
+		return addr.HostPortAddr{}, errors.Errorf("sentinel: %s", v)
+	}
+	return addr.HostPortAddr{}, errors.Errorf("sentinel: unexpected reply %v", v)
+}
+
+func parseHostPort(host, port string) (addr.HostPortAddr, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || host == "" || p <= 0 {
+		return addr.HostPortAddr{}, errors.Errorf("sentinel: invalid address %s:%s", host, port)
+	}
+	return addr.HostPortAddr{Host: host, Port: p}, nil
+}
+
+// Watch subscribes to the failover announcements of the sentinel and
+// updates the address of the master accordingly, until ctx is done. If
+// the subscription fails, it subscribes again with backoff, and then
+// calls Discover in case a failover was missed in the meantime.
+func (m *Master) Watch(ctx context.Context) {
+	backoff := minWatchBackoff
+	rediscover := false
+	for {
+		subscribed, err := m.watch(ctx, rediscover)
+		if ctx.Err() != nil {
+			return
+		}
+		err = errors.Wrapf(err, "sentinel watch of master %s", m.Name)
+		common.HandleError(err, m.ErrChan)
+
+		if subscribed {
+			backoff = minWatchBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+		rediscover = true
+	}
+}
+
+// watch subscribes to the failover announcements and processes them
+// until an error occurs. It returns true if the subscription succeeded.
+func (m *Master) watch(ctx context.Context, rediscover bool) (bool, error) {
+	conn, err := m.Dial()
+	if err != nil {
+		return false, errors.Wrap(err, "dial sentinel")
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// unblock the reads when ctx is done
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	enc := resp.NewEncoder(conn)
+	dec := resp.NewDecoder(conn)
+	if err := enc.Encode([]string{"SUBSCRIBE", switchMasterChannel}); err != nil {
+		return false, errors.Wrap(err, "write request")
+	}
+
+	// the first message is the confirmation of the subscription
+	v, err := dec.Decode()
+	if err != nil {
+		return false, errors.Wrap(err, "read reply")
+	}
+	if ar, ok := v.(resp.Array); !ok || len(ar) == 0 || ar[0] != "subscribe" {
+		return false, errors.Errorf("sentinel: unexpected reply %v", v)
+	}
+
+	if rediscover {
+		if err := m.Discover(); err != nil {
+			return true, err
+		}
+	}
+
+	for {
+		v, err := dec.Decode()
+		if err != nil {
+			return true, errors.Wrap(err, "read message")
+		}
+		m.switchMaster(v)
+	}
+}
+
+// switchMaster updates the address of the master if v is a
+// +switch-master message for it, in the form:
+//
+//	<master name> <old ip> <old port> <new ip> <new port>
+func (m *Master) switchMaster(v interface{}) {
+	ar, ok := v.(resp.Array)
+	if !ok || len(ar) != 3 || ar[0] != "message" || ar[1] != switchMasterChannel {
+		return
+	}
+	msg, _ := ar[2].(string)
+	fields := strings.Fields(msg)
+	if len(fields) != 5 || fields[0] != m.Name {
+		return
+	}
+
+	a, err := parseHostPort(fields[3], fields[4])
+	if err != nil {
+		common.HandleError(err, m.ErrChan)
+		return
+	}
+	m.setAddr(a)
+}
@@ -0,0 +1,176 @@
+package sentinel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+// fakeSentinel is a sentinel that monitors a master, and announces the
+// failovers to its subscribers.
+type fakeSentinel struct {
+	l net.Listener
+
+	mu     sync.Mutex
+	master interface{}                // reply to get-master-addr-by-name
+	subs   map[net.Conn]*resp.Encoder // subscribed connections
+}
+
+func startFakeSentinel(t *testing.T, master interface{}) *fakeSentinel {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSentinel{l: l, master: master, subs: make(map[net.Conn]*resp.Encoder)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSentinel) dial() (net.Conn, error) {
+	return net.Dial("tcp", s.l.Addr().String())
+}
+
+func (s *fakeSentinel) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeSentinel) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	dec := resp.NewDecoder(conn)
+	enc := resp.NewEncoder(conn)
+	for {
+		req, err := dec.DecodeRequest()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		switch req[0] {
+		case "SENTINEL":
+			enc.Encode(s.master)
+		case "SUBSCRIBE":
+			s.subs[conn] = enc
+			enc.Encode(resp.Array{"subscribe", req[1], int64(1)})
+		}
+		s.mu.Unlock()
+	}
+}
+
+// failover switches the master and announces it to the subscribers.
+func (s *fakeSentinel) failover(msg string, master interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.master = master
+	for _, enc := range s.subs {
+		enc.Encode(resp.Array{"message", "+switch-master", msg})
+	}
+}
+
+// kick closes the subscribed connections.
+func (s *fakeSentinel) kick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.subs {
+		conn.Close()
+		delete(s.subs, conn)
+	}
+}
+
+func (s *fakeSentinel) subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs)
+}
+
+func TestDiscover(t *testing.T) {
+	cases := []struct {
+		reply interface{}
+		want  addr.HostPortAddr
+		err   bool
+	}{
+		{resp.Array{"10.0.0.1", "6379"}, addr.HostPortAddr{Host: "10.0.0.1", Port: 6379}, false},
+		{resp.Array(nil), addr.HostPortAddr{}, true},
+		{resp.Error("ERR unknown command"), addr.HostPortAddr{}, true},
+		{resp.Array{"10.0.0.1", "x"}, addr.HostPortAddr{}, true},
+		{resp.Array{"10.0.0.1"}, addr.HostPortAddr{}, true},
+	}
+
+	for i, c := range cases {
+		s := startFakeSentinel(t, c.reply)
+		m := &Master{Name: "mymaster", Dial: s.dial}
+
+		err := m.Discover()
+		if (err != nil) != c.err {
+			t.Errorf("%d: want error %t, got %v", i, c.err, err)
+		}
+		if got := m.Addr(); got != c.want {
+			t.Errorf("%d: want address %v, got %v", i, c.want, got)
+		}
+		s.l.Close()
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := startFakeSentinel(t, resp.Array{"10.0.0.1", "6379"})
+	defer s.l.Close()
+
+	errChan := make(chan error, 10)
+	m := &Master{Name: "mymaster", Dial: s.dial, ErrChan: errChan}
+	if err := m.Discover(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Watch(ctx)
+		close(done)
+	}()
+
+	waitFor(t, "subscription", func() bool { return s.subscribers() == 1 })
+
+	// other masters are ignored
+	s.failover("other 10.0.0.1 6379 10.0.0.9 6379", resp.Array{"10.0.0.1", "6379"})
+	s.failover("mymaster 10.0.0.1 6379 10.0.0.2 6380", resp.Array{"10.0.0.2", "6380"})
+	waitFor(t, "failover", func() bool { return m.String() == "10.0.0.2:6380" })
+
+	// a failover missed while the subscription is down is discovered
+	s.kick()
+	s.failover("mymaster 10.0.0.2 6380 10.0.0.3 6381", resp.Array{"10.0.0.3", "6381"})
+	waitFor(t, "rediscovery", func() bool { return m.String() == "10.0.0.3:6381" })
+	waitFor(t, "resubscription", func() bool { return s.subscribers() == 1 })
+	if len(errChan) == 0 {
+		t.Errorf("want subscription error, got none")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("want Watch to return after cancel")
+	}
+}
+
+func waitFor(t *testing.T, desc string, fn func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
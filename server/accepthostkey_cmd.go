@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+type acceptHostKeyCmd struct{}
+
+// ACCEPTHOSTKEY host fingerprint [HASHED]
+//
+// Accepts the unknown host key reported for host by GETTUNNELADDR, by
+// adding it to the known hosts file. The fingerprint must be the one
+// that was reported. With the HASHED option, the host name is hashed
+// in the known hosts file.
+func (c acceptHostKeyCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if l := len(req); l < 3 || l > 4 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	var hashed bool
+	if len(req) == 4 {
+		if opt := strings.ToLower(req[3]); opt != "hashed" {
+			return resp.Error(fmt.Sprintf("ERR unknown option %v", opt)), nil
+		}
+		hashed = true
+	}
+
+	if err := s.MetaConfig.AcceptHostKey(req[1], req[2], hashed); err != nil {
+		return resp.Error(fmt.Sprintf("ERR failed to accept host key: %v", err)), nil
+	}
+	return resp.OK{}, nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+type authCmd struct{}
+
+// AUTH [username] token
+//
+// Authenticates the connection with the token of the Server. The
+// username is ignored, it is accepted for the clients that always send
+// one. Until the connection is authenticated, only AUTH and PING are
+// allowed if the Server requires a token.
+func (c authCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if l := len(req); l < 2 || l > 3 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+	if s.AuthToken == "" {
+		return resp.Error("ERR Client sent AUTH, but no token is set"), nil
+	}
+
+	token := req[len(req)-1]
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.AuthToken)) != 1 {
+		return resp.Error("WRONGPASS invalid token"), nil
+	}
+	return resp.OK{}, nil
+}
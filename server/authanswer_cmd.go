@@ -0,0 +1,17 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+type authAnswerCmd struct{}
+
+// AUTHANSWER challenge-id [answer ...]
+func (c authAnswerCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if len(req) < 2 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+	return s.answerAuth(req[1], req[2:]), nil
+}
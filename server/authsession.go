@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultAuthChallengeTimeout = 2 * time.Minute
+
+var errAuthChallengeTimeout = errors.New("timeout waiting for the authentication challenge answer")
+
+// authSession relays the password and keyboard-interactive challenges
+// of the SSH handshakes of a tunnel to the client that requested it,
+// and the client's answers back to the handshakes.
+type authSession struct {
+	timeout    time.Duration
+	challenges chan *authChallenge
+
+	// set when a challenge is pending an answer
+	tun     *tunnel.Tunnel
+	pending *authChallenge
+}
+
+// authChallenge is a set of prompts for which the SSH handshake waits
+// for answers.
+type authChallenge struct {
+	id          string
+	host        string
+	instruction string
+	prompts     []string
+	echos       []bool
+	answers     chan []string
+}
+
+func newAuthSession(timeout time.Duration) *authSession {
+	if timeout <= 0 {
+		timeout = defaultAuthChallengeTimeout
+	}
+	return &authSession{
+		timeout:    timeout,
+		challenges: make(chan *authChallenge),
+	}
+}
+
+// authMethods returns the password and keyboard-interactive methods
+// that relay their challenges to the session.
+func (a *authSession) authMethods(host *SSHHost) []ssh.AuthMethod {
+	name := fmt.Sprintf("%s@%s", host.User, host.Addr)
+	return []ssh.AuthMethod{
+		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			if len(questions) == 0 {
+				// nothing to ask, servers may send empty challenges
+				return nil, nil
+			}
+			return a.prompt(name, instruction, questions, echos)
+		}),
+		ssh.PasswordCallback(func() (string, error) {
+			answers, err := a.prompt(name, "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return "", err
+			}
+			return answers[0], nil
+		}),
+	}
+}
+
+// prompt sends the challenge to the client and waits for its answers.
+// It is called by the SSH handshake.
+func (a *authSession) prompt(host, instruction string, prompts []string, echos []bool) ([]string, error) {
+	id, err := newChallengeID()
+	if err != nil {
+		return nil, err
+	}
+	ch := &authChallenge{
+		id:          id,
+		host:        host,
+		instruction: instruction,
+		prompts:     prompts,
+		echos:       echos,
+		answers:     make(chan []string, 1),
+	}
+
+	select {
+	case a.challenges <- ch:
+	case <-time.After(a.timeout):
+		return nil, errAuthChallengeTimeout
+	}
+
+	select {
+	case answers := <-ch.answers:
+		return answers, nil
+	case <-time.After(a.timeout):
+		return nil, errAuthChallengeTimeout
+	}
+}
+
+func newChallengeID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// reply returns the RESP representation of the challenge.
+func (c *authChallenge) reply() resp.Array {
+	echos := make(resp.Array, len(c.echos))
+	for i, echo := range c.echos {
+		echos[i] = echo
+	}
+	return resp.Array{
+		resp.SimpleString("CHALLENGE"),
+		c.id,
+		c.host,
+		c.instruction,
+		c.prompts,
+		echos,
+	}
+}
+
+// waitAuth waits for the next event of the tunnel's authentication and
+// returns the reply to send to the client: the next challenge, the
+// tunnel's local address if the SSH connection is established, or an
+// error.
+func (s *Server) waitAuth(a *authSession, tun *tunnel.Tunnel) interface{} {
+	done := make(chan struct{})
+	defer close(done)
+
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- tun.WaitDialed(done)
+	}()
+
+	select {
+	case ch := <-a.challenges:
+		a.tun = tun
+		a.pending = ch
+
+		s.registerAuth(ch.id, a)
+		return ch.reply()
+
+	case err := <-dialed:
+		if err != nil {
+			return s.tunnelErrorReply(err)
+		}
+		return tun.Local.String()
+
+	case <-time.After(a.timeout):
+		return resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", errAuthChallengeTimeout))
+	}
+}
+
+// registerAuth registers the session a as pending an answer to the
+// challenge id, until it is answered or it times out.
+func (s *Server) registerAuth(id string, a *authSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.auths == nil {
+		// server is closed
+		return
+	}
+	s.auths[id] = a
+	time.AfterFunc(a.timeout, func() {
+		s.mu.Lock()
+		if s.auths[id] == a {
+			delete(s.auths, id)
+		}
+		s.mu.Unlock()
+	})
+}
+
+// answerAuth sends the answers to the pending challenge id, and returns
+// the reply to send to the client, as for waitAuth.
+func (s *Server) answerAuth(id string, answers []string) interface{} {
+	s.mu.Lock()
+	a := s.auths[id]
+	delete(s.auths, id)
+	s.mu.Unlock()
+
+	if a == nil {
+		return resp.Error(fmt.Sprintf("ERR unknown challenge %s", id))
+	}
+
+	ch := a.pending
+	if len(answers) != len(ch.prompts) {
+		// keep it pending, the client may try again
+		s.registerAuth(id, a)
+		return resp.Error(fmt.Sprintf("ERR wrong number of answers for challenge %s, want %d", id, len(ch.prompts)))
+	}
+
+	a.pending = nil
+	ch.answers <- answers
+	return s.waitAuth(a, a.tun)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/internal/testutils"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startPasswordSSHServer starts a test SSH server that accepts password
+// authentication with password pwd.
+func startPasswordSSHServer(t *testing.T, pwd string) *testutils.SSHServer {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if string(p) == pwd {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("invalid password for %s", c.User())
+		},
+	}
+	srv, err := testutils.StartSSHServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// writeKnownHosts writes a known hosts file in dir with key as host key
+// for address, and returns its path.
+func writeKnownHosts(t *testing.T, dir, address string, key ssh.PublicKey) string {
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{address}, key)
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return knownHosts
+}
+
+// newStartedServer returns a Server ready to execute commands, without
+// listening for connections.
+func newStartedServer(ctx context.Context, meta *MetaConfig) *Server {
+	return &Server{
+		MetaConfig:           meta,
+		AuthChallengeTimeout: 5 * time.Second,
+		state:                started,
+		tunnels:              make(map[tunnelKey]*tunnel.Tunnel),
+		starts:               make(map[tunnelKey]*tunnelStart),
+		hostKeys:             make(map[tunnelKey]*hostKeyCheck),
+		ids:                  make(map[tunnelKey]string),
+		auths:                make(map[string]*authSession),
+		ctx:                  ctx,
+	}
+}
+
+func TestInteractiveAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authsession")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sshSrv := startPasswordSSHServer(t, "secret")
+	defer sshSrv.Close()
+	knownHosts := writeKnownHosts(t, dir, sshSrv.Addr.String(), sshSrv.HostKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newStartedServer(ctx, &MetaConfig{
+		KnownHostsFile: knownHosts,
+		SSHConfigFile:  filepath.Join(dir, "config"),
+	})
+
+	host := "me@" + sshSrv.Addr.String()
+	execute := func(req ...string) interface{} {
+		res, err := s.execute(nil, req)
+		if err != nil {
+			t.Fatalf("%v: want no error, got %v", req, err)
+		}
+		return res
+	}
+	challengeID := func(res interface{}) string {
+		arr, ok := res.(resp.Array)
+		if !ok || len(arr) != 6 || arr[0] != resp.SimpleString("CHALLENGE") {
+			t.Fatalf("want challenge, got %#v", res)
+		}
+		if prompts := arr[4].([]string); len(prompts) != 1 || prompts[0] != "Password: " {
+			t.Errorf("want password prompt, got %v", prompts)
+		}
+		return arr[1].(string)
+	}
+
+	// wrong password
+	res := execute("gettunneladdr", host, "127.0.0.1:1", "interactive")
+	id := challengeID(res)
+	if res := execute("authanswer", "unknown", "secret"); !strings.Contains(fmt.Sprint(res), "unknown challenge") {
+		t.Errorf("want unknown challenge error, got %v", res)
+	}
+	res = execute("authanswer", id, "wrong")
+	if e, ok := res.(resp.Error); !ok || !strings.Contains(string(e), "failed to start tunnel") {
+		t.Errorf("want failed to start tunnel error, got %#v", res)
+	}
+
+	// right password
+	res = execute("gettunneladdr", host, "127.0.0.1:1", "interactive")
+	id = challengeID(res)
+	if res := execute("authanswer", id); !strings.Contains(fmt.Sprint(res), "wrong number of answers") {
+		t.Errorf("want wrong number of answers error, got %v", res)
+	}
+	res = execute("authanswer", id, "secret")
+	local, ok := res.(string)
+	if !ok || !strings.HasPrefix(local, "127.0.0.1:") {
+		t.Fatalf("want tunnel address, got %#v", res)
+	}
+
+	// the established tunnel is returned without a challenge
+	if res := execute("gettunneladdr", host, "127.0.0.1:1", "interactive"); res != local {
+		t.Errorf("want %v, got %#v", local, res)
+	}
+}
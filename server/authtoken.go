@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LoadAuthToken returns the token stored in the file at path that the
+// clients must send with AUTH. If the file does not exist, a random
+// token is generated and stored in a new file readable only by the
+// user. An existing file must not be accessible by group or others.
+func LoadAuthToken(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return createAuthToken(path)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "stat auth token file")
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return "", errors.Errorf("permissions %#o for auth token file %s are too open", perm, path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "read auth token file")
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.Errorf("auth token file %s is empty", path)
+	}
+	return token, nil
+}
+
+func createAuthToken(path string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate auth token")
+	}
+	token := hex.EncodeToString(b)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", errors.Wrap(err, "create auth token directory")
+	}
+	// fails if the file was created in the meantime
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "create auth token file")
+	}
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		f.Close()
+		return "", errors.Wrap(err, "write auth token file")
+	}
+	if err := f.Close(); err != nil {
+		return "", errors.Wrap(err, "write auth token file")
+	}
+	return token, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+func TestLoadAuthToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authtoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// generated on first load
+	path := filepath.Join(dir, "sub", "token")
+	token, err := LoadAuthToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Errorf("want 64 characters token, got %q", token)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("want permissions 0600, got %#o", perm)
+	}
+
+	// reused afterwards
+	if token2, err := LoadAuthToken(path); err != nil || token2 != token {
+		t.Errorf("want %q, got %q and %v", token, token2, err)
+	}
+
+	// rejected if readable by others
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAuthToken(path); err == nil {
+		t.Errorf("want permissions error, got none")
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	s := &Server{AuthToken: "secret"}
+	state := &connState{}
+
+	cases := []struct {
+		req []string
+		res interface{}
+	}{
+		{[]string{"command"}, resp.Error("NOAUTH Authentication required.")},
+		{[]string{"ping"}, resp.Pong{}},
+		{[]string{"auth", "nope"}, resp.Error("WRONGPASS invalid token")},
+		{[]string{"command"}, resp.Error("NOAUTH Authentication required.")},
+		{[]string{"auth", "default", "secret"}, resp.OK{}},
+		{[]string{"command"}, commandNames},
+	}
+
+	for i, c := range cases {
+		res, err := s.execute(state, c.req)
+		if err != nil {
+			t.Errorf("%d: want no error, got %v", i, err)
+			continue
+		}
+		if _, ok := c.res.([]string); ok {
+			if _, ok := res.([]string); !ok {
+				t.Errorf("%d: want command names, got %#v", i, res)
+			}
+			continue
+		}
+		if res != c.res {
+			t.Errorf("%d: want %#v, got %#v", i, c.res, res)
+		}
+	}
+
+	// a new connection is not authenticated
+	if res, _ := s.execute(nil, []string{"command"}); res != resp.Error("NOAUTH Authentication required.") {
+		t.Errorf("want NOAUTH error, got %#v", res)
+	}
+	// AUTH fails without a token
+	s.AuthToken = ""
+	if res, _ := s.execute(nil, []string{"auth", "secret"}); res == (resp.OK{}) {
+		t.Errorf("want error, got %#v", res)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/sentinel"
+)
+
+type getSentinelMasterCmd struct{}
+
+// GETSENTINELMASTER [user@]ssh.server.host[:port] sentinel.host:port|unix:/remote/socket/path master-name [JUMP [user@]jump.host[:port][,...]]
+//
+// Asks the sentinel for the address of the master, and returns the local
+// address of a tunnel that forwards to the current master. The tunnel
+// subscribes to the failover announcements of the sentinel, so that new
+// connections go to the new master after a failover. The sentinel is
+// asked for the master only when the tunnel is started, the next calls
+// return the address of the same tunnel while it is alive.
+//
+// Host key errors are reported as for GETTUNNELADDR.
+func (c getSentinelMasterCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if len(req) < 4 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	var proxyJump string
+	for i := 4; i < len(req); i++ {
+		switch opt := strings.ToLower(req[i]); opt {
+		case "jump":
+			if i+1 >= len(req) {
+				return resp.Error(fmt.Sprintf("ERR missing value for %v option", opt)), nil
+			}
+			i++
+			proxyJump = req[i]
+		default:
+			return resp.Error(fmt.Sprintf("ERR unknown option %v", opt)), nil
+		}
+	}
+
+	host, err := s.MetaConfig.ResolveHost(req[1], proxyJump)
+	if err != nil {
+		return resp.Error(fmt.Sprintf("ERR invalid SSH server address: %s", err)), nil
+	}
+
+	// sentinel address, port required unless it is a Unix socket
+	sentinelAddr, err := addr.ParseRemoteAddr(req[2])
+	if err != nil {
+		return resp.Error(fmt.Sprintf("ERR invalid sentinel address: %s", err)), nil
+	}
+
+	// reuse the tunnel to the master if it is alive, the sentinel is
+	// only asked for the master when a new tunnel is started
+	key := newTunnelKey(host, sentinelAddr, tunnelOptions{master: &sentinel.Master{Name: req[3]}})
+	if tun := s.liveTunnel(key); tun != nil {
+		return tun.Local.String(), nil
+	}
+
+	// start the tunnel to the sentinel first, so that its host key
+	// errors are reported.
+	tun, check, err := s.getTunnel(host, sentinelAddr, tunnelOptions{})
+	if err != nil {
+		return resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", err)), nil
+	}
+	reply, _ := s.waitHostKeys(check, tun)
+	if e, ok := reply.(resp.Error); ok {
+		return e, nil
+	}
+
+	master := &sentinel.Master{
+		Name:    req[3],
+		Dial:    s.sentinelDialer(host, sentinelAddr),
+		ErrChan: s.ErrChan,
+	}
+	if err := master.Discover(); err != nil {
+		return resp.Error(fmt.Sprintf("ERR failed to discover master: %v", err)), nil
+	}
+
+	tun, check, err = s.getTunnel(host, sentinelAddr, tunnelOptions{master: master})
+	if err != nil {
+		return resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", err)), nil
+	}
+	reply, _ = s.waitHostKeys(check, tun)
+	return reply, nil
+}
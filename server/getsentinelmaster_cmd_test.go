@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/internal/testutils"
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+func TestGetSentinelMasterReusesTunnel(t *testing.T) {
+	// the SSH server forwards to a sentinel that counts the requests for
+	// the master's address
+	var discovers int64
+	sshClient := &testutils.MockSSHClient{
+		DialFunc: func(i int, n, a string) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				dec := resp.NewDecoder(c2)
+				enc := resp.NewEncoder(c2)
+				for {
+					req, err := dec.DecodeRequest()
+					if err != nil {
+						return
+					}
+					switch req[0] {
+					case "SENTINEL":
+						atomic.AddInt64(&discovers, 1)
+						enc.Encode(resp.Array{"10.0.0.1", "6379"})
+					case "SUBSCRIBE":
+						enc.Encode(resp.Array{"subscribe", req[1], int64(1)})
+					}
+				}
+			}()
+			return c1, nil
+		},
+	}
+	defer setAndDeferSSHDial(mockSSHDial(sshClient))()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	req := []string{"getsentinelmaster", "root@127.0.0.1", "sentinel:26379", "mymaster"}
+	first, _ := srv.execute(nil, req)
+	if _, ok := first.(string); !ok {
+		t.Fatalf("want address, got %#v", first)
+	}
+	for i := 0; i < 3; i++ {
+		if res, _ := srv.execute(nil, req); res != first {
+			t.Errorf("want address %v, got %#v", first, res)
+		}
+	}
+	if n := atomic.LoadInt64(&discovers); n != 1 {
+		t.Errorf("want 1 discovery, got %d", n)
+	}
+
+	// another master is another tunnel
+	other, _ := srv.execute(nil, []string{"getsentinelmaster", "root@127.0.0.1", "sentinel:26379", "other"})
+	if _, ok := other.(string); !ok || other == first {
+		t.Errorf("want new address, got %#v", other)
+	}
+	if n := atomic.LoadInt64(&discovers); n != 2 {
+		t.Errorf("want 2 discoveries, got %d", n)
+	}
+
+	// wait for the tunnels to stop before restoring the dial function
+	srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", "sentinel:26379"})
+}
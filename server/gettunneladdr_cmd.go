@@ -2,33 +2,216 @@ package server
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/harfangapps/regis-companion/addr"
 	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+
+	"github.com/pkg/errors"
 )
 
 type getTunnelAddrCmd struct{}
 
-// GETTUNNELADDR [user@]ssh.server.host[:port] remote.server.host:port
+// GETTUNNELADDR [user@]ssh.server.host[:port] remote.server.host:port|unix:/remote/socket/path [JUMP [user@]jump.host[:port][,...]] [INTERACTIVE] [CLUSTER] [TLS] [SERVERNAME name] [CACERT file] [CERT file KEY file] [INSECURE] [UNIX] [WAIT [timeout]]
+//
+// The remote server may be a Unix socket on the SSH server, in which
+// case its path is prefixed with "unix:".
+//
+// With the INTERACTIVE option, the reply is delayed until the SSH
+// connection is established, and if a password or keyboard-interactive
+// authentication is required, a challenge is returned instead of the
+// address. The challenge must be answered with AUTHANSWER.
+//
+// Without the WAIT and INTERACTIVE options, the reply is the address
+// of the tunnel, returned without waiting for its SSH connection, unless
+// a host key error of its SSH servers is already known: a pending
+// unknown host key, or the error the previous tunnel to the same remote
+// server stopped with. The reply is then an error in the form:
+//
+//	HOSTKEY kind host key-type fingerprint
+//
+// where kind is unknown, changed or revoked. An unknown host key can
+// then be accepted with ACCEPTHOSTKEY, or rejected with REJECTHOSTKEY.
+// WAITTUNNEL reports whether the tunnel starts, and its host key errors.
+//
+// With the CLUSTER option, the remote server is a Redis Cluster node,
+// and the addresses of the cluster nodes in the -MOVED and -ASK errors
+// and in the replies to CLUSTER SLOTS, CLUSTER SHARDS and CLUSTER NODES
+// are rewritten to the local addresses of tunnels to those nodes, which
+// are started when first advertised.
+//
+// With the TLS option, the connections to the remote server use TLS,
+// and the tunnel exposes them in plain text locally. SERVERNAME sets the
+// name to verify the server's certificate against (the remote host by
+// default), CACERT the CA certificates to verify it (the system's by
+// default), CERT and KEY the client certificate, and INSECURE disables
+// the verification. Those options imply TLS. With the WAIT or
+// INTERACTIVE option, the TLS connection is verified before the reply,
+// and a failure is reported as an error in the form:
+//
+//	TLS reason
+//
+// With the UNIX option, the tunnel listens on a Unix socket accessible
+// only by the user instead of a TCP port, and the reply is the path of
+// the socket.
+//
+// With the WAIT option, the reply is delayed until the tunnel is ready,
+// as with WAITTUNNEL: its SSH connection is established and a test
+// connection to the remote server succeeds, for at most timeout seconds
+// (30 by default, 0 waits indefinitely). Failures are reported as
+// categorized errors in the form:
+//
+//	category reason
+//
+// where category is AUTH, NETWORK or REMOTE, or as the HOSTKEY and TLS
+// errors above. WAIT cannot be combined with INTERACTIVE, WAITTUNNEL can
+// be used once the challenges are answered.
+//
+// If the tunnel fails to start and the previous tunnel to the same
+// remote server failed too, the error reply ends with the reason why it
+// stopped, as reported by TUNNELHISTORY.
 func (c getTunnelAddrCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
-	if len(req) != 3 {
+	if len(req) < 3 {
 		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
 	}
 
-	user, serverAddr, err := addr.ParseSSHUserAddr(req[1])
+	var proxyJump string
+	var opts tunnelOptions
+	var wait bool
+	timeout := defaultWaitTimeout
+	for i := 3; i < len(req); i++ {
+		switch opt := strings.ToLower(req[i]); opt {
+		case "jump":
+			if i+1 >= len(req) {
+				return resp.Error(fmt.Sprintf("ERR missing value for %v option", opt)), nil
+			}
+			i++
+			proxyJump = req[i]
+		case "interactive":
+			opts.auth = newAuthSession(s.AuthChallengeTimeout)
+		case "cluster":
+			opts.cluster = true
+		case "unix":
+			opts.unix = true
+		case "tls":
+			opts.tls.enabled = true
+		case "insecure":
+			opts.tls.enabled = true
+			opts.tls.insecure = true
+		case "servername", "cacert", "cert", "key":
+			if i+1 >= len(req) {
+				return resp.Error(fmt.Sprintf("ERR missing value for %v option", opt)), nil
+			}
+			i++
+			opts.tls.enabled = true
+			switch opt {
+			case "servername":
+				opts.tls.serverName = req[i]
+			case "cacert":
+				opts.tls.caCert = req[i]
+			case "cert":
+				opts.tls.cert = req[i]
+			case "key":
+				opts.tls.key = req[i]
+			}
+		case "wait":
+			wait = true
+			// the timeout is optional, the options are never numbers
+			if i+1 < len(req) && isNumber(req[i+1]) {
+				i++
+				var err error
+				if timeout, err = parseTimeout(req[i]); err != nil {
+					return resp.Error(fmt.Sprintf("ERR %v", err)), nil
+				}
+			}
+		default:
+			return resp.Error(fmt.Sprintf("ERR unknown option %v", opt)), nil
+		}
+	}
+
+	if wait && opts.auth != nil {
+		return resp.Error("ERR WAIT and INTERACTIVE options are mutually exclusive"), nil
+	}
+
+	host, err := s.MetaConfig.ResolveHost(req[1], proxyJump)
 	if err != nil {
 		return resp.Error(fmt.Sprintf("ERR invalid SSH server address: %s", err)), nil
 	}
 
-	// remote address, port required
-	remoteAddr, err := addr.ParseAddr(req[2], 0)
+	// remote address, port required unless it is a Unix socket
+	remoteAddr, err := addr.ParseRemoteAddr(req[2])
 	if err != nil {
 		return resp.Error(fmt.Sprintf("ERR invalid remote server address: %s", err)), nil
 	}
 
-	addr, err := s.getTunnelAddr(user, serverAddr, remoteAddr)
+	if opts.tls.enabled {
+		if opts.tlsConfig, err = opts.tls.config(remoteHost(remoteAddr)); err != nil {
+			return resp.Error(fmt.Sprintf("ERR invalid TLS options: %v", err)), nil
+		}
+	}
+
+	// the previous tunnel, if it stopped, to report why on failure
+	key := newTunnelKey(host, remoteAddr, opts)
+	prev := s.lastTunnelExit(key)
+
+	if !wait && opts.auth == nil {
+		// do not wait for the SSH servers, report only the host key
+		// errors already known
+		if reply := s.knownHostKeyError(host, key, prev); reply != nil {
+			return reply, nil
+		}
+	}
+
+	tun, check, err := s.getTunnel(host, remoteAddr, opts)
 	if err != nil {
-		return resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", err)), nil
+		return withPreviousFailure(resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", err)), prev), nil
+	}
+
+	if wait {
+		// the test connection verifies the TLS connection too
+		return withPreviousFailure(s.waitReady(tun, check, timeout), prev), nil
+	}
+	if opts.auth != nil {
+		reply := s.waitAuth(opts.auth, tun)
+		if _, ok := reply.(string); ok && opts.tls.enabled {
+			// the reply is the address, verify the TLS connection
+			if res := s.checkTLS(tun); res != nil {
+				return res, nil
+			}
+		}
+		return withPreviousFailure(reply, prev), nil
+	}
+	return tun.Local.String(), nil
+}
+
+// checkTLS connects to the remote server of tun to verify its TLS
+// connection, for at most the HostKeyTimeout, and returns the error
+// reply if it fails, nil otherwise or if it takes longer.
+func (s *Server) checkTLS(tun *tunnel.Tunnel) interface{} {
+	res := make(chan interface{}, 1)
+	go func() {
+		conn, err := tun.DialRemote()
+		if err != nil {
+			if terr, ok := errors.Cause(err).(*tunnel.TLSError); ok {
+				res <- resp.Error(fmt.Sprintf("TLS %v", terr.Err))
+				return
+			}
+			res <- resp.Error(fmt.Sprintf("ERR failed to connect to remote server: %v", err))
+			return
+		}
+		conn.Close()
+		res <- nil
+	}()
+
+	timer := time.NewTimer(s.hostKeyTimeout())
+	defer timer.Stop()
+
+	select {
+	case reply := <-res:
+		return reply
+	case <-timer.C:
+		return nil
 	}
-	return addr.String(), nil
 }
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+type helloCmd struct{}
+
+// hello is the result of a successful HELLO command. The protocol
+// version applies to the connection, starting with the reply.
+type hello struct {
+	// the protocol version, 0 if unchanged
+	proto int
+	// true if the HELLO command authenticated the connection
+	authenticated bool
+}
+
+// reply returns the reply to the HELLO command, for a connection that
+// uses the protocol version proto.
+func (h hello) reply(proto int) resp.Map {
+	return resp.Map{
+		{Key: "server", Value: "regis-companion"},
+		{Key: "version", Value: Version},
+		{Key: "proto", Value: int64(proto)},
+		{Key: "mode", Value: "standalone"},
+		{Key: "role", Value: "master"},
+		{Key: "modules", Value: resp.Array{}},
+	}
+}
+
+// HELLO [protover [AUTH username token] [SETNAME clientname]]
+//
+// Switches the connection to the protocol version protover, 2 or 3,
+// and replies with information about the Server. Without protover,
+// the protocol version is unchanged. With protocol version 3, the
+// replies use the RESP3 types, e.g. INFO replies with a map. If AUTH
+// is set, it authenticates the connection as the AUTH command does,
+// otherwise the connection must already be authenticated if the
+// Server requires a token. SETNAME is accepted and ignored.
+func (c helloCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	var proto int
+	if len(req) > 1 {
+		v, err := strconv.Atoi(req[1])
+		if err != nil {
+			return resp.Error("ERR Protocol version is not an integer or out of range"), nil
+		}
+		if v != resp.RESP2 && v != resp.RESP3 {
+			return resp.Error("NOPROTO unsupported protocol version"), nil
+		}
+		proto = v
+	}
+
+	var authenticated bool
+	for i := 2; i < len(req); i++ {
+		switch opt := strings.ToLower(req[i]); opt {
+		case "auth":
+			if i+2 >= len(req) {
+				return resp.Error(fmt.Sprintf("ERR Syntax error in %v option '%v'", cmdName, req[i])), nil
+			}
+			token := req[i+2]
+			i += 2
+
+			if s.AuthToken == "" {
+				return resp.Error("ERR Client sent AUTH, but no token is set"), nil
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.AuthToken)) != 1 {
+				return resp.Error("WRONGPASS invalid token"), nil
+			}
+			authenticated = true
+
+		case "setname":
+			if i+1 >= len(req) {
+				return resp.Error(fmt.Sprintf("ERR Syntax error in %v option '%v'", cmdName, req[i])), nil
+			}
+			i++
+
+		default:
+			return resp.Error(fmt.Sprintf("ERR Syntax error in %v option '%v'", cmdName, req[i])), nil
+		}
+	}
+	return hello{proto: proto, authenticated: authenticated}, nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+func TestHello(t *testing.T) {
+	s := &Server{AuthToken: "secret"}
+	state := &connState{}
+
+	cases := []struct {
+		req   []string
+		err   string // if empty, the HELLO reply is expected
+		proto int    // protocol of the connection after the request
+	}{
+		{[]string{"hello", "3"}, "NOAUTH ", 2},
+		{[]string{"hello", "3", "auth", "default", "nope"}, "WRONGPASS ", 2},
+		{[]string{"hello", "3", "auth", "default"}, "ERR Syntax error", 2},
+		{[]string{"hello", "3", "auth", "default", "secret", "setname", "cli"}, "", 3},
+		{[]string{"hello"}, "", 3},
+		{[]string{"hello", "4"}, "NOPROTO ", 3},
+		{[]string{"hello", "x"}, "ERR Protocol version", 3},
+		{[]string{"hello", "2", "setname"}, "ERR Syntax error", 3},
+		{[]string{"hello", "2"}, "", 2},
+	}
+
+	for i, c := range cases {
+		res, err := s.execute(state, c.req)
+		if err != nil {
+			t.Errorf("%d: want no error, got %v", i, err)
+			continue
+		}
+
+		if c.err != "" {
+			if e, ok := res.(resp.Error); !ok || !strings.HasPrefix(string(e), c.err) {
+				t.Errorf("%d: want error %q, got %#v", i, c.err, res)
+			}
+		} else {
+			m, ok := res.(resp.Map)
+			if !ok || len(m) == 0 || m[0].Key != "server" || m[2] != (resp.KeyValue{Key: "proto", Value: int64(c.proto)}) {
+				t.Errorf("%d: want HELLO reply with proto %d, got %#v", i, c.proto, res)
+			}
+		}
+		if got := state.protocol(); got != c.proto {
+			t.Errorf("%d: want protocol %d, got %d", i, c.proto, got)
+		}
+	}
+	if !state.authenticated {
+		t.Errorf("want authenticated connection")
+	}
+}
+
+func TestInfoRESP3(t *testing.T) {
+	s := &Server{}
+	state := &connState{}
+
+	res, _ := s.execute(state, []string{"info", "cpu"})
+	if _, ok := res.([]byte); !ok {
+		t.Fatalf("want text reply in RESP2, got %#v", res)
+	}
+
+	if res, _ := s.execute(state, []string{"hello", "3"}); res == nil {
+		t.Fatalf("want HELLO reply, got nil")
+	}
+	res, _ = s.execute(state, []string{"info", "cpu"})
+	m, ok := res.(resp.Map)
+	if !ok || len(m) != 1 || m[0].Key != "cpu" {
+		t.Fatalf("want map of the cpu section, got %#v", res)
+	}
+	fields, _ := m[0].Value.(resp.Map)
+	if len(fields) == 0 || fields[0].Key != "num_cpu" {
+		t.Errorf("want num_cpu field, got %#v", m[0].Value)
+	}
+
+	var buf bytes.Buffer
+	enc := resp.NewEncoder(&buf)
+	enc.SetProtocol(state.protocol())
+	if err := enc.Encode(res); err != nil {
+		t.Fatal(err)
+	}
+	if want := "%1\r\n$3\r\ncpu\r\n%"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("want %q prefix, got %q", want, buf.String())
+	}
+}
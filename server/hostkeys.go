@@ -0,0 +1,327 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Kinds of HostKeyError.
+const (
+	HostKeyUnknown = "unknown"
+	HostKeyChanged = "changed"
+	HostKeyRevoked = "revoked"
+)
+
+// HostKeyError is returned by the host key callback of the SSH client
+// configurations when the host key presented by a server cannot be
+// verified with the known hosts file.
+type HostKeyError struct {
+	// Host is the server's host as written in the known hosts file,
+	// e.g. "example.com" or "[example.com]:2222".
+	Host string
+	// Key is the host key presented by the server.
+	Key ssh.PublicKey
+	// Kind is HostKeyUnknown if the known hosts file has no key for
+	// the host, HostKeyChanged if it has a different key for the host
+	// and HostKeyRevoked if the key is marked as revoked.
+	Kind string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("%s host key for %s: %s %s", e.Kind, e.Host, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+}
+
+// hostKeyCallback returns the host key callback that verifies the host
+// keys with the KnownHostsFile.
+func (c *MetaConfig) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if c.KnownHostsFile == "" {
+		return nil, ErrNoKnownHostsFile
+	}
+
+	var files []string
+	if _, err := os.Stat(c.KnownHostsFile); !os.IsNotExist(err) {
+		files = append(files, c.KnownHostsFile)
+	}
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		switch err := err.(type) {
+		case *knownhosts.KeyError:
+			herr := &HostKeyError{Host: knownhosts.Normalize(hostname), Key: key, Kind: HostKeyChanged}
+			if len(err.Want) == 0 {
+				herr.Kind = HostKeyUnknown
+			}
+			return herr
+		case *knownhosts.RevokedError:
+			return &HostKeyError{Host: knownhosts.Normalize(hostname), Key: key, Kind: HostKeyRevoked}
+		}
+		return err
+	}, nil
+}
+
+// setPendingHostKey keeps the unknown host key of host pending, so that
+// it can be accepted with AcceptHostKey.
+func (c *MetaConfig) setPendingHostKey(host string, key ssh.PublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hostKeys == nil {
+		c.hostKeys = make(map[string]ssh.PublicKey)
+	}
+	c.hostKeys[host] = key
+}
+
+// pendingHostKey returns the pending unknown host key of host, or nil
+// if there is none.
+func (c *MetaConfig) pendingHostKey(host string) ssh.PublicKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hostKeys[host]
+}
+
+// AcceptHostKey adds the pending unknown host key of host to the
+// KnownHostsFile. The fingerprint must be the SHA256 fingerprint of the
+// pending key, to make sure the accepted key is the one that was
+// reported. If hashed is true, the host name is hashed in the file.
+func (c *MetaConfig) AcceptHostKey(host, fingerprint string, hashed bool) error {
+	host = knownhosts.Normalize(host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.hostKeys[host]
+	if key == nil {
+		return errors.Errorf("no pending host key for %s", host)
+	}
+	if fp := ssh.FingerprintSHA256(key); fp != fingerprint {
+		return errors.Errorf("fingerprint of pending host key for %s is %s", host, fp)
+	}
+
+	name := host
+	if hashed {
+		name = knownhosts.HashHostname(host)
+	}
+	if err := appendLine(c.KnownHostsFile, knownhosts.Line([]string{name}, key)); err != nil {
+		return err
+	}
+	delete(c.hostKeys, host)
+	return nil
+}
+
+// RejectHostKey drops the pending unknown host key of host.
+func (c *MetaConfig) RejectHostKey(host string) error {
+	host = knownhosts.Normalize(host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hostKeys[host] == nil {
+		return errors.Errorf("no pending host key for %s", host)
+	}
+	delete(c.hostKeys, host)
+	return nil
+}
+
+// appendLine appends line to the file, creating it if it does not exist.
+// A newline is added first if the file does not end with one.
+func appendLine(file, line string) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if size := fi.Size(); size > 0 {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, size-1); err != nil && err != io.EOF {
+			f.Close()
+			return err
+		}
+		if b[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+
+	if _, err := io.WriteString(f, line+"\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// defaultHostKeyTimeout is the default HostKeyTimeout of the Server.
+const defaultHostKeyTimeout = 30 * time.Second
+
+// hostKeyCheck tracks the verification of the host keys of the SSH
+// servers of a new tunnel, so that host key errors can be reported to
+// the client that requested the tunnel.
+type hostKeyCheck struct {
+	once sync.Once
+	done chan struct{} // closed when the check is complete
+	err  *HostKeyError
+}
+
+func newHostKeyCheck() *hostKeyCheck {
+	return &hostKeyCheck{done: make(chan struct{})}
+}
+
+// wrap returns a host key callback that calls cb and reports its
+// result to the check. A host key error completes the check, and so
+// does a successful verification if final is true.
+func (h *hostKeyCheck) wrap(cb ssh.HostKeyCallback, final bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(hostname, remote, key)
+		if herr, ok := err.(*HostKeyError); ok {
+			h.complete(herr)
+		} else if err == nil && final {
+			h.complete(nil)
+		}
+		return err
+	}
+}
+
+func (h *hostKeyCheck) complete(err *HostKeyError) {
+	h.once.Do(func() {
+		h.err = err
+		close(h.done)
+	})
+}
+
+// hostKeyError returns the host key error of the check, if it is
+// complete.
+func (h *hostKeyCheck) hostKeyError() *HostKeyError {
+	if h == nil {
+		return nil
+	}
+	select {
+	case <-h.done:
+		return h.err
+	default:
+		return nil
+	}
+}
+
+// waitHostKeys waits until the host keys of the SSH servers of tun are
+// verified, for at most the HostKeyTimeout, and returns the reply to
+// send to the client: the tunnel's local address, or an error. If the
+// SSH servers do not answer in time, the address is returned while the
+// tunnel keeps starting, and verified is false.
+func (s *Server) waitHostKeys(check *hostKeyCheck, tun *tunnel.Tunnel) (reply interface{}, verified bool) {
+	done := make(chan struct{})
+	defer close(done)
+
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- tun.WaitDialed(done)
+	}()
+
+	timer := time.NewTimer(s.hostKeyTimeout())
+	defer timer.Stop()
+
+	select {
+	case <-check.done:
+		if check.err != nil {
+			return s.hostKeyErrorReply(check.err), true
+		}
+	case err := <-dialed:
+		if err != nil {
+			return s.tunnelErrorReply(err), true
+		}
+	case <-timer.C:
+		return tun.Local.String(), false
+	}
+	return tun.Local.String(), true
+}
+
+// knownHostKeyError returns the reply for a host key error of the SSH
+// servers of host that is already known, without connecting to them: a
+// pending unknown host key, or the host key error of the current tunnel
+// with that key or of the previous tunnel prev, if the key is still not
+// trusted. It returns nil if there is none.
+func (s *Server) knownHostKeyError(host *SSHHost, key tunnelKey, prev *tunnelExit) interface{} {
+	hops := append(append([]*SSHHost(nil), host.Jumps...), host)
+	for _, hop := range hops {
+		name := knownhosts.Normalize(hop.Addr.String())
+		if key := s.MetaConfig.pendingHostKey(name); key != nil {
+			return s.hostKeyErrorReply(&HostKeyError{Host: name, Key: key, Kind: HostKeyUnknown})
+		}
+	}
+
+	s.mu.Lock()
+	check := s.hostKeys[key]
+	s.mu.Unlock()
+	herr := check.hostKeyError()
+	if herr == nil && prev != nil {
+		herr, _ = errors.Cause(prev.status.Err).(*HostKeyError)
+	}
+	if herr == nil {
+		return nil
+	}
+
+	// the key may have been accepted since, verify it again
+	cb, err := s.MetaConfig.hostKeyCallback()
+	if err != nil {
+		return nil
+	}
+	for _, hop := range hops {
+		if knownhosts.Normalize(hop.Addr.String()) != herr.Host {
+			continue
+		}
+		if err, ok := cb(hop.Addr.String(), hop.Addr, herr.Key).(*HostKeyError); ok {
+			return s.hostKeyErrorReply(err)
+		}
+		break
+	}
+	return nil
+}
+
+// hostKeyTimeout returns the HostKeyTimeout, or its default value if it
+// is not set.
+func (s *Server) hostKeyTimeout() time.Duration {
+	if s.HostKeyTimeout <= 0 {
+		return defaultHostKeyTimeout
+	}
+	return s.HostKeyTimeout
+}
+
+// tunnelErrorReply returns the error reply for a tunnel that failed to
+// start with err. Host key errors have a specific reply.
+func (s *Server) tunnelErrorReply(err error) resp.Error {
+	if herr, ok := errors.Cause(err).(*HostKeyError); ok {
+		return s.hostKeyErrorReply(herr)
+	}
+	return resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", err))
+}
+
+// hostKeyErrorReply returns the reply for a host key error, in the form:
+//
+//	HOSTKEY kind host key-type fingerprint
+//
+// where kind is one of unknown, changed or revoked. An unknown host key
+// is kept pending until it is accepted or rejected.
+func (s *Server) hostKeyErrorReply(err *HostKeyError) resp.Error {
+	if err.Kind == HostKeyUnknown {
+		s.MetaConfig.setPendingHostKey(err.Host, err.Key)
+	}
+	return resp.Error(fmt.Sprintf("HOSTKEY %s %s %s %s", err.Kind, err.Host, err.Key.Type(), ssh.FingerprintSHA256(err.Key)))
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/pkg/errors"
+)
+
+func TestHostKeyAcceptance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sshSrv := startPasswordSSHServer(t, "secret")
+	defer sshSrv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	meta := &MetaConfig{
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		SSHConfigFile:  filepath.Join(dir, "config"),
+	}
+	s := newStartedServer(ctx, meta)
+
+	host := knownhosts.Normalize(sshSrv.Addr.String())
+	fingerprint := ssh.FingerprintSHA256(sshSrv.HostKey)
+	unknown := resp.Error(fmt.Sprintf("HOSTKEY unknown %s %s %s", host, sshSrv.HostKey.Type(), fingerprint))
+
+	execute := func(req ...string) interface{} {
+		res, err := s.execute(nil, req)
+		if err != nil {
+			t.Fatalf("%v: want no error, got %v", req, err)
+		}
+		return res
+	}
+	getTunnelAddr := func() interface{} {
+		res := execute("gettunneladdr", "me@"+sshSrv.Addr.String(), "127.0.0.1:1", "WAIT")
+		if _, ok := res.(resp.Error); ok {
+			// wait for the failed tunnel to terminate, so that the next
+			// call does not share its SSH connection attempt.
+			execute("killtunnel", "me@"+sshSrv.Addr.String(), "127.0.0.1:1")
+		}
+		return res
+	}
+
+	// unknown host key, rejected
+	if res := getTunnelAddr(); res != unknown {
+		t.Fatalf("want %v, got %#v", unknown, res)
+	}
+	if res := execute("rejecthostkey", host); res != (resp.OK{}) {
+		t.Errorf("want OK, got %#v", res)
+	}
+	if res := execute("rejecthostkey", host); !strings.Contains(fmt.Sprint(res), "no pending host key") {
+		t.Errorf("want no pending host key error, got %#v", res)
+	}
+
+	// unknown host key, accepted
+	if res := getTunnelAddr(); res != unknown {
+		t.Fatalf("want %v, got %#v", unknown, res)
+	}
+	if res := execute("accepthostkey", host, "SHA256:nope", "hashed"); !strings.Contains(fmt.Sprint(res), "fingerprint") {
+		t.Errorf("want fingerprint error, got %#v", res)
+	}
+	if res := execute("accepthostkey", host, fingerprint, "hashed"); res != (resp.OK{}) {
+		t.Errorf("want OK, got %#v", res)
+	}
+	b, err := ioutil.ReadFile(meta.KnownHostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "|1|") || strings.Contains(string(b), "127.0.0.1") {
+		t.Errorf("want hashed host name, got %q", b)
+	}
+	if res := getTunnelAddr(); !strings.HasPrefix(fmt.Sprint(res), "AUTH ") {
+		// the host key is accepted, the authentication fails
+		t.Errorf("want auth error, got %#v", res)
+	}
+	execute("killtunnel", "me@"+sshSrv.Addr.String(), "127.0.0.1:1")
+
+	// changed host key
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKnownHosts(t, dir, sshSrv.Addr.String(), otherKey)
+
+	changed := resp.Error(fmt.Sprintf("HOSTKEY changed %s %s %s", host, sshSrv.HostKey.Type(), fingerprint))
+	if res := getTunnelAddr(); res != changed {
+		t.Fatalf("want %v, got %#v", changed, res)
+	}
+	if res := execute("accepthostkey", host, fingerprint); !strings.Contains(fmt.Sprint(res), "no pending host key") {
+		t.Errorf("want no pending host key error, got %#v", res)
+	}
+}
+
+func TestGetTunnelAddrKnownHostKeyError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sshSrv := startPasswordSSHServer(t, "secret")
+	defer sshSrv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	meta := &MetaConfig{
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		SSHConfigFile:  filepath.Join(dir, "config"),
+	}
+	s := newStartedServer(ctx, meta)
+
+	host := knownhosts.Normalize(sshSrv.Addr.String())
+	fingerprint := ssh.FingerprintSHA256(sshSrv.HostKey)
+	unknown := resp.Error(fmt.Sprintf("HOSTKEY unknown %s %s %s", host, sshSrv.HostKey.Type(), fingerprint))
+	req := []string{"gettunneladdr", "me@" + sshSrv.Addr.String(), "127.0.0.1:1"}
+
+	// the first tunnel does not wait for the host key verification
+	if res, ok := s.execute(nil, req); !strings.HasPrefix(fmt.Sprint(res), "127.0.0.1:") {
+		t.Fatalf("want tunnel address, got %#v (%v)", res, ok)
+	}
+
+	// the next ones report the error it stopped with
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, _ := s.execute(nil, req)
+		if res == unknown {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %v, got %#v", unknown, res)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the key is pending
+	if res, _ := s.execute(nil, req); res != unknown {
+		t.Fatalf("want %v, got %#v", unknown, res)
+	}
+
+	if res, _ := s.execute(nil, []string{"accepthostkey", host, fingerprint}); res != (resp.OK{}) {
+		t.Fatalf("want OK, got %#v", res)
+	}
+	if res, _ := s.execute(nil, req); !strings.HasPrefix(fmt.Sprint(res), "127.0.0.1:") {
+		t.Errorf("want tunnel address, got %#v", res)
+	}
+	s.execute(nil, []string{"killtunnel", req[1], req[2]})
+}
+
+func TestGetTunnelAddrDoesNotWait(t *testing.T) {
+	release := make(chan struct{})
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		<-release
+		return nil, errors.New("released")
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	// the SSH server does not answer, the address is returned anyway,
+	// without verifying the TLS connection
+	for _, req := range [][]string{
+		{"gettunneladdr", "root@127.0.0.1", "remote:7000"},
+		{"gettunneladdr", "root@127.0.0.1", "remote:7001", "TLS", "INSECURE"},
+	} {
+		start := time.Now()
+		res, _ := srv.execute(nil, req)
+		if local, ok := res.(string); !ok || !strings.HasPrefix(local, "127.0.0.1:") {
+			t.Errorf("%v: want address, got %#v", req, res)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("%v: want immediate reply, got %v", req, d)
+		}
+	}
+
+	// wait for the tunnels to stop before restoring the dial function
+	close(release)
+	srv.execute(nil, []string{"killtunnel", "1"})
+	srv.execute(nil, []string{"killtunnel", "2"})
+}
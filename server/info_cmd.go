@@ -14,7 +14,39 @@ import (
 
 type infoCmd struct{}
 
+// info is the result of the INFO command, in the text format of Redis.
+type info []byte
+
+// reply returns the text in RESP2, and a map of the sections to the
+// maps of their fields in RESP3.
+func (i info) reply(proto int) interface{} {
+	if proto != resp.RESP3 {
+		return []byte(i)
+	}
+
+	sections := resp.Map{}
+	for _, line := range strings.Split(string(i), "\r\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# "):
+			name := strings.ToLower(strings.TrimPrefix(line, "# "))
+			sections = append(sections, resp.KeyValue{Key: name, Value: resp.Map{}})
+		case len(sections) > 0:
+			last := &sections[len(sections)-1]
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) == 2 {
+				last.Value = append(last.Value.(resp.Map), resp.KeyValue{Key: kv[0], Value: kv[1]})
+			}
+		}
+	}
+	return sections
+}
+
 // INFO [section]
+//
+// Replies with the text of the section, or of all sections, as Redis
+// does. With protocol version 3 (see HELLO), it replies with a map of
+// the sections instead.
 func (c infoCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
 	if l := len(req); l < 1 || l > 2 {
 		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
@@ -107,5 +139,37 @@ func (c infoCmd) Execute(cmdName string, req []string, s *Server) (interface{},
 		})
 	}
 
-	return buf.Bytes(), nil
+	if section == "pool" || section == "" {
+		if buf.Len() > 0 {
+			fmt.Fprint(&buf, "\r\n")
+		}
+
+		clients := s.pool.Stats()
+		fmt.Fprint(&buf, "# Pool\r\n")
+		fmt.Fprintf(&buf, "ssh_clients:%d\r\n", len(clients))
+		for i, client := range clients {
+			fmt.Fprintf(&buf, "client%d:host=%s,tunnels=%d,reconnects=%d", i, client.Key, client.Refs, client.Reconnects)
+			if err := client.LastFailure; err != nil {
+				// last as the error may contain commas
+				msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+				fmt.Fprintf(&buf, ",last_failure_at=%d,last_failure=%s", client.LastFailureAt.Unix(), msg)
+			}
+			fmt.Fprint(&buf, "\r\n")
+		}
+	}
+
+	if meta := s.MetaConfig; meta != nil && (section == "auth" || section == "") {
+		if buf.Len() > 0 {
+			fmt.Fprint(&buf, "\r\n")
+		}
+
+		fmt.Fprint(&buf, "# Auth\r\n")
+		fmt.Fprintf(&buf, "identity_files:%d\r\n", len(meta.IdentityFiles))
+		for i, info := range meta.authKeysInfo() {
+			fmt.Fprintf(&buf, "host%d:host=%s,key=%s,fingerprint=%s,last_auth=%d\r\n",
+				i, info.Host, info.Source, info.Fingerprint, info.At.Unix())
+		}
+	}
+
+	return info(buf.Bytes()), nil
 }
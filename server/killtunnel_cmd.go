@@ -9,24 +9,34 @@ import (
 
 type killTunnelCmd struct{}
 
-// KILLTUNNEL [user@]ssh.server.host[:port] remote.server.host:port
+// KILLTUNNEL [user@]ssh.server.host[:port] remote.server.host:port|unix:/remote/socket/path
+// KILLTUNNEL id
+//
+// Kills the tunnels to the remote server via the SSH server, with any
+// options, or the tunnel with that ID as returned by LISTTUNNELS.
 func (c killTunnelCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if len(req) == 2 {
+		if !s.killTunnelID(req[1]) {
+			return resp.Error(fmt.Sprintf("ERR no tunnel with ID %v", req[1])), nil
+		}
+		return resp.OK{}, nil
+	}
 	if len(req) != 3 {
 		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
 	}
 
-	user, serverAddr, err := addr.ParseSSHUserAddr(req[1])
+	host, err := s.MetaConfig.ResolveHost(req[1], "")
 	if err != nil {
 		return resp.Error(fmt.Sprintf("ERR invalid SSH server address: %s", err)), nil
 	}
 
-	// remote address, port required
-	remoteAddr, err := addr.ParseAddr(req[2], 0)
+	// remote address, port required unless it is a Unix socket
+	remoteAddr, err := addr.ParseRemoteAddr(req[2])
 	if err != nil {
 		return resp.Error(fmt.Sprintf("ERR invalid remote server address: %s", err)), nil
 	}
 
-	if err := s.killTunnel(user, serverAddr, remoteAddr); err != nil {
+	if err := s.killTunnel(host, remoteAddr); err != nil {
 		return resp.Error(fmt.Sprintf("ERR failed to kill tunnel: %v", err)), nil
 	}
 	return resp.OK{}, nil
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+)
+
+type listTunnelsCmd struct{}
+
+// tunnelInfo is the description of a tunnel returned by LISTTUNNELS.
+// The times are Unix timestamps in seconds.
+type tunnelInfo struct {
+	ID             string `resp:"id"`
+	User           string `resp:"user"`
+	SSHServer      string `resp:"ssh_server"`
+	Remote         string `resp:"remote"`
+	Local          string `resp:"local"`
+	State          string `resp:"state"`
+	CreatedAt      int64  `resp:"created_at"`
+	LastActivityAt int64  `resp:"last_activity_at"`
+	IdleRemaining  int64  `resp:"idle_remaining"` // seconds
+	Conns          int64  `resp:"conns"`
+	BytesIn        int64  `resp:"bytes_in"`
+	BytesOut       int64  `resp:"bytes_out"`
+}
+
+// LISTTUNNELS [pattern]
+//
+// Replies with an array of the tunnels, each one a map of its ID, user,
+// SSH server, remote and local addresses, state (prepared, started or
+// closed), creation and last activity times, idle time remaining
+// before it closes, number of active connections, and numbers of bytes
+// received from the local connections (in) and from the remote server
+// (out). The times are Unix timestamps and the durations are in
+// seconds. In RESP2, the maps are flat arrays of keys and values.
+//
+// With a pattern, only the tunnels with an ID, user@server, remote or
+// local address that matches the glob-style pattern are returned, as
+// with the KEYS command of Redis.
+func (c listTunnelsCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if l := len(req); l < 1 || l > 2 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	var pattern string
+	if len(req) == 2 {
+		pattern = req[1]
+	}
+
+	infos := []tunnelInfo{}
+	for _, e := range s.listTunnels() {
+		info := tunnelInfo{
+			ID:        e.id,
+			User:      e.key.User,
+			SSHServer: e.key.Server.String(),
+			Remote:    e.key.Remote.String(),
+		}
+		if e.tun.Local != nil {
+			info.Local = e.tun.Local.String()
+		}
+		if pattern != "" && !matchAny(pattern, info.ID, info.User+"@"+info.SSHServer, info.Remote, info.Local) {
+			continue
+		}
+
+		st := e.tun.Status()
+		info.State = st.State
+		info.CreatedAt = st.Created.Unix()
+		info.LastActivityAt = st.LastActivity.Unix()
+		info.IdleRemaining = int64(st.IdleRemaining / time.Second)
+		info.Conns = int64(st.Conns)
+		info.BytesIn = st.BytesIn
+		info.BytesOut = st.BytesOut
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// tunnelEntry is a tunnel of the Server, with its key and ID.
+type tunnelEntry struct {
+	id  string
+	key tunnelKey
+	tun *tunnel.Tunnel
+}
+
+// listTunnels returns the tunnels of the Server, sorted by ID.
+func (s *Server) listTunnels() []tunnelEntry {
+	s.mu.Lock()
+	entries := make([]tunnelEntry, 0, len(s.tunnels))
+	for key, tun := range s.tunnels {
+		entries = append(entries, tunnelEntry{id: s.ids[key], key: key, tun: tun})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := strconv.ParseUint(entries[i].id, 10, 64)
+		b, _ := strconv.ParseUint(entries[j].id, 10, 64)
+		return a < b
+	})
+	return entries
+}
+
+// matchAny returns true if any of the values matches the glob-style
+// pattern.
+func matchAny(pattern string, values ...string) bool {
+	for _, v := range values {
+		if matchPattern(pattern, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern returns true if s matches the glob-style pattern, as
+// Redis matches them: * matches any sequence of characters, ? any
+// character, [abc] and [a-c] a set of characters, [^abc] any other
+// character, and \ escapes the next character.
+//
+// On a mismatch, only the last * is extended by one character: any
+// match found by extending an earlier * is also found by extending the
+// last one, so the time is bounded by len(pattern)*len(s).
+func matchPattern(pattern, s string) bool {
+	var p, i int
+	star, starI := -1, 0 // the pattern after the last *, and where it matches in s
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, starI = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if ok, n := matchChar(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// the last * matches one more character
+		starI++
+		p, i = star, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchChar returns true if ch matches the element at the start of
+// pattern, which is not a *, and the length of that element.
+func matchChar(pattern string, ch byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+	case '[':
+		ok, rest := matchClass(pattern[1:], ch)
+		return ok, len(pattern) - len(rest)
+	case '\\':
+		if len(pattern) > 1 {
+			return pattern[1] == ch, 2
+		}
+	}
+	return pattern[0] == ch, 1
+}
+
+// matchClass returns true if ch matches the character class at the
+// start of pattern, after its opening bracket, and the rest of the
+// pattern after its closing bracket.
+func matchClass(pattern string, ch byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+
+	var match bool
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			match = match || pattern[1] == ch
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || (ch >= lo && ch <= hi)
+			pattern = pattern[3:]
+		default:
+			match = match || pattern[0] == ch
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		// skip the closing bracket
+		pattern = pattern[1:]
+	}
+	return match != not, pattern
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/internal/testutils"
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "remote:7000", true},
+		{"remote:*", "remote:7000", true},
+		{"*:7000", "remote:7000", true},
+		{"*:7001", "remote:7000", false},
+		{"r*e*:7**", "remote:7000", true},
+		{"r?mote:7000", "remote:7000", true},
+		{"r?mote:7000", "rmote:7000", false},
+		{"remote:700[0-2]", "remote:7001", true},
+		{"remote:700[^0-2]", "remote:7001", false},
+		{"remote:700[13]", "remote:7003", true},
+		{"remote:700[13]", "remote:7002", false},
+		{"unix:/tmp/*.sock", "unix:/tmp/a/b.sock", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"[", "a", false},
+		{"*a*b", "xaxxb", true},
+		{"*a?c*", "abaxcz", true},
+		{`\`, `\`, true},
+		// exponential with recursive backtracking
+		{strings.Repeat("*a", 30) + "b", strings.Repeat("a", 1000), false},
+		{strings.Repeat("*a", 30) + "*", strings.Repeat("a", 1000), true},
+	}
+	for _, c := range cases {
+		if got := matchPattern(c.pattern, c.s); got != c.want {
+			t.Errorf("%q %q: want %t, got %t", c.pattern, c.s, c.want, got)
+		}
+	}
+}
+
+func TestListTunnels(t *testing.T) {
+	defer setAndDeferSSHDial(mockSSHDial(&testutils.MockSSHClient{}))()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	addrs := make(map[string]string)
+	for _, remote := range []string{"remote:7000", "remote:7001"} {
+		res, err := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", remote})
+		if _, ok := res.(string); !ok || err != nil {
+			t.Fatalf("%s: want address, got %#v and %v", remote, res, err)
+		}
+		addrs[remote] = res.(string)
+	}
+
+	res, err := srv.execute(nil, []string{"listtunnels"})
+	infos, ok := res.([]tunnelInfo)
+	if err != nil || !ok || len(infos) != 2 {
+		t.Fatalf("want 2 tunnels, got %#v and %v", res, err)
+	}
+	for i, remote := range []string{"remote:7000", "remote:7001"} {
+		info := infos[i]
+		if info.Remote != remote || info.Local != addrs[remote] || info.User != "root" || info.SSHServer != "127.0.0.1:22" {
+			t.Errorf("%d: want tunnel to %s on %s, got %+v", i, remote, addrs[remote], info)
+		}
+		if info.State != "started" && info.State != "prepared" {
+			t.Errorf("%d: want running tunnel, got %s", i, info.State)
+		}
+		if info.CreatedAt == 0 || info.LastActivityAt < info.CreatedAt {
+			t.Errorf("%d: want creation and activity times, got %d and %d", i, info.CreatedAt, info.LastActivityAt)
+		}
+	}
+
+	// the tunnels are maps of their fields
+	v, err := resp.Marshal(infos[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]interface{}
+	if err := resp.Unmarshal(v, &got); err != nil || len(got) != 1 || got[0]["id"] != infos[0].ID {
+		t.Errorf("want map with ID %s, got %v and %v", infos[0].ID, got, err)
+	}
+
+	// filtered by pattern
+	res, _ = srv.execute(nil, []string{"listtunnels", "*:7001"})
+	if infos, ok := res.([]tunnelInfo); !ok || len(infos) != 1 || infos[0].Remote != "remote:7001" {
+		t.Errorf("want tunnel to remote:7001, got %#v", res)
+	}
+	res, _ = srv.execute(nil, []string{"listtunnels", "nomatch"})
+	if infos, ok := res.([]tunnelInfo); !ok || len(infos) != 0 {
+		t.Errorf("want no tunnel, got %#v", res)
+	}
+
+	// killed by ID
+	id := infos[0].ID
+	if res, _ := srv.execute(nil, []string{"killtunnel", id}); res != (resp.OK{}) {
+		t.Errorf("want OK, got %#v", res)
+	}
+	res, _ = srv.execute(nil, []string{"listtunnels", id})
+	if infos, ok := res.([]tunnelInfo); !ok || len(infos) != 0 {
+		t.Errorf("want killed tunnel to be removed, got %#v", res)
+	}
+	if res, _ := srv.execute(nil, []string{"killtunnel", id}); res != resp.Error("ERR no tunnel with ID "+id) {
+		t.Errorf("want unknown ID error, got %#v", res)
+	}
+	if res, _ := srv.execute(nil, []string{"killtunnel", "999"}); res != resp.Error("ERR no tunnel with ID 999") {
+		t.Errorf("want unknown ID error, got %#v", res)
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+type rejectHostKeyCmd struct{}
+
+// REJECTHOSTKEY host
+//
+// Rejects the unknown host key reported for host by GETTUNNELADDR.
+func (c rejectHostKeyCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if len(req) != 2 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	if err := s.MetaConfig.RejectHostKey(req[1]); err != nil {
+		return resp.Error(fmt.Sprintf("ERR failed to reject host key: %v", err)), nil
+	}
+	return resp.OK{}, nil
+}
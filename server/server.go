@@ -1,22 +1,33 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"expvar"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/cluster"
 	"github.com/harfangapps/regis-companion/common"
 	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/sentinel"
 	"github.com/harfangapps/regis-companion/tunnel"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 )
 
 // Build variables, set when building the binary
@@ -30,7 +41,17 @@ var (
 
 var (
 	errEmptyCmd      = errors.New("command is empty")
+	errServerClosed  = errors.New("server closed")
+	errTunnelKilled  = errors.New("tunnel killed while starting")
 	defaultLocalAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}
+
+	// the limits of the requests, the commands have a few short arguments
+	requestLimits = resp.Limits{
+		MaxLineLength:  64 << 10,
+		MaxBulkLength:  64 << 10,
+		MaxArrayLength: 1024,
+		MaxDepth:       1,
+	}
 )
 
 // each supported command implements this interface
@@ -49,11 +70,22 @@ func init() {
 		"checkupdates": checkUpdatesCmd{
 			client: &http.Client{Timeout: 10 * time.Second},
 		},
-		"command":       commandCmd{},
-		"gettunneladdr": getTunnelAddrCmd{},
-		"killtunnel":    killTunnelCmd{},
-		"info":          infoCmd{},
-		"ping":          pingCmd{},
+		"command":           commandCmd{},
+		"gettunneladdr":     getTunnelAddrCmd{},
+		"getsentinelmaster": getSentinelMasterCmd{},
+		"hello":             helloCmd{},
+		"killtunnel":        killTunnelCmd{},
+		"info":              infoCmd{},
+		"listtunnels":       listTunnelsCmd{},
+		"accepthostkey":     acceptHostKeyCmd{},
+		"rejecthostkey":     rejectHostKeyCmd{},
+		"auth":              authCmd{},
+		"authanswer":        authAnswerCmd{},
+		"ping":              pingCmd{},
+		"setpassphrase":     setPassphraseCmd{},
+		"switchto":          switchToCmd{},
+		"tunnelhistory":     tunnelHistoryCmd{},
+		"waittunnel":        waitTunnelCmd{},
 	}
 
 	for k := range supportedCommands {
@@ -63,9 +95,14 @@ func init() {
 }
 
 type tunnelKey struct {
-	User   string
-	Server addr.HostPortAddr
-	Remote addr.HostPortAddr
+	User    string
+	Server  addr.HostPortAddr
+	Jumps   string   // canonical jump chain, see SSHHost.jumpChain
+	Remote  net.Addr // an addr.HostPortAddr or addr.UnixAddr
+	Cluster bool
+	Master  string // name of the master if Remote is a sentinel
+	TLS     tlsOptions
+	Unix    bool
 }
 
 // various states of the Server
@@ -78,15 +115,44 @@ const (
 // Server defines the regis-companion Server that listens for incoming connections
 // and manages SSH tunnels.
 type Server struct {
-	// The address the server listens on.
+	// The address the server listens on. If it is a Unix socket address,
+	// the socket is accessible only by its owner.
 	Addr net.Addr
 	// The MetaConfig to use to create SSH ClientConfig.
 	MetaConfig *MetaConfig
 
+	// If not empty, the connections must be authenticated with this
+	// token via the AUTH command before running other commands than
+	// PING.
+	AuthToken string
+	// If not nil, ListenAndServe accepts TLS connections with this
+	// configuration.
+	TLSConfig *tls.Config
+
 	// Duration before the tunnels stop if there is no active connection.
 	TunnelIdleTimeout time.Duration
 	// Write timeout before returning a network error on a write attempt.
 	WriteTimeout time.Duration
+	// Duration to wait for the answer to an interactive authentication
+	// challenge before the pending tunnel is abandoned. Defaults to
+	// 2 minutes if not set.
+	AuthChallengeTimeout time.Duration
+	// Duration to wait for the host keys of the SSH servers of a new
+	// tunnel to the sentinel of GETSENTINELMASTER to be verified, and
+	// for the TLS connection of a tunnel requested with INTERACTIVE, before
+	// replying with its address anyway. Defaults to 30 seconds if not set.
+	HostKeyTimeout time.Duration
+	// Interval between the keepalive requests sent to the SSH servers.
+	// If zero, no keepalive request is sent.
+	SSHKeepaliveInterval time.Duration
+	// Number of consecutive keepalive requests that may fail before the
+	// connection to an SSH server is considered dead and is reconnected.
+	SSHKeepaliveCountMax int
+	// The directory of the Unix sockets of the tunnels requested with
+	// the UNIX option, created if it does not exist. An existing one
+	// must be owned by the user with the permissions 0700. Defaults to a
+	// directory of the user in the temporary directory.
+	TunnelSocketDir string
 
 	// If not nil, this is an expvar map that contains statistics about the server,
 	// tunnels and connections.
@@ -100,12 +166,20 @@ type Server struct {
 	ErrChan chan<- error
 
 	server common.RetryServer
-
-	// mu protects the following private fields
-	mu      sync.Mutex
-	state   int
-	tunnels map[tunnelKey]*tunnel.Tunnel
-	ctx     context.Context // stored to pass along to Tunnels
+	pool   tunnel.Pool // SSH clients shared by the tunnels
+
+	// mu protects the following private fields. It is never held while
+	// connecting or waiting for a tunnel.
+	mu       sync.Mutex
+	state    int
+	tunnels  map[tunnelKey]*tunnel.Tunnel
+	starts   map[tunnelKey]*tunnelStart  // tunnels being started
+	hostKeys map[tunnelKey]*hostKeyCheck // host key checks of the tunnels
+	ids      map[tunnelKey]string        // IDs of the tunnels
+	lastID   uint64                      // last ID assigned to a tunnel
+	exits    []*tunnelExit               // the last stopped tunnels, oldest first
+	auths    map[string]*authSession     // pending challenges by ID
+	ctx      context.Context             // stored to pass along to Tunnels
 }
 
 // ListenAndServe starts the server on the specified Addr.
@@ -113,69 +187,374 @@ type Server struct {
 // This call is blocking, it returns only when an error is
 // encountered. As such, it always returns a non-nil error.
 func (s *Server) ListenAndServe(ctx context.Context) error {
-	l, err := net.Listen(s.Addr.Network(), s.Addr.String())
+	l, _, err := addr.Listen(s.Addr)
 	if err != nil {
 		return errors.Wrap(err, "listen error")
 	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
 	return s.serve(ctx, l)
 }
 
-// getTunnelAddr returns the local address to use to access the SSH tunnel.
+// tunnelOptions holds the optional settings of a tunnel requested via
+// GETTUNNELADDR.
+type tunnelOptions struct {
+	// If not nil, the password and keyboard-interactive authentication
+	// challenges are relayed to the client via this session.
+	auth *authSession
+	// If true, the tunnel rewrites the addresses of the Redis Cluster
+	// nodes to the addresses of tunnels to those nodes.
+	cluster bool
+	// If not nil, the tunnel forwards to the current address of this
+	// master, and the remote address is the address of its sentinel.
+	master *sentinel.Master
+	// The TLS options of the connections to the remote server, and the
+	// corresponding configuration if enabled.
+	tls       tlsOptions
+	tlsConfig *tls.Config
+	// If true, the tunnel listens on a Unix socket instead of a TCP port.
+	unix bool
+}
+
+// newTunnelKey returns the key of the tunnel to remote via host with
+// those options.
+func newTunnelKey(host *SSHHost, remote net.Addr, opts tunnelOptions) tunnelKey {
+	key := tunnelKey{User: host.User, Server: host.Addr, Jumps: host.jumpChain(), Remote: remote, Cluster: opts.cluster, TLS: opts.tls, Unix: opts.unix}
+	if opts.master != nil {
+		key.Master = opts.master.Name
+	}
+	return key
+}
+
+// tunnelStart is a tunnel being started for a key. The concurrent
+// requests for the same key wait for it instead of starting their own.
+type tunnelStart struct {
+	done   chan struct{}
+	killed bool // set by killTunnel, under the Server's lock
+
+	// set once done is closed
+	tun   *tunnel.Tunnel
+	check *hostKeyCheck
+	err   error
+}
+
+// getTunnel returns the SSH tunnel to use to access remote via host.
 // If a Tunnel exists for the requested server+remote addresses, it is
-// Touched to see if it is still alive, and if so its existing local address
-// is used.
+// Touched to see if it is still alive, and if so it is returned. If a
+// Tunnel is being started for them, its result is returned once done.
+//
+// Otherwise, a new Tunnel is started for that server+remote pair and
+// that Tunnel is returned. The Tunnels to the same user+server via the
+// same jump hosts and with the same authentication share the same SSH
+// client.
+//
+// The Server's lock is not held while the Tunnel is created, so that a
+// slow SSH agent or server does not block the requests for other
+// tunnels.
 //
-// Otherwise, a new Tunnel is started for that server+remote pair and that
-// Tunnel's local address is returned.
-func (s *Server) getTunnelAddr(user string, server, remote addr.HostPortAddr) (net.Addr, error) {
-	key := tunnelKey{User: user, Server: server, Remote: remote}
+// The verification of the host keys of the Tunnel's SSH servers is
+// reported to the returned hostKeyCheck.
+func (s *Server) getTunnel(host *SSHHost, remote net.Addr, opts tunnelOptions) (*tunnel.Tunnel, *hostKeyCheck, error) {
+	key := newTunnelKey(host, remote, opts)
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	tun := s.tunnels[key]
+	if s.tunnels == nil {
+		s.mu.Unlock()
+		return nil, nil, errServerClosed
+	}
+	tun, check := s.tunnels[key], s.hostKeys[key]
 
 	// if the tunnel exists and is still alive (confirmed by calling
-	// Touch with a return value of true), use it.
-	if tun.Touch() {
-		return tun.Local, nil
+	// Touch with a return value of true), use it, unless it is about
+	// to fail due to a host key error.
+	if tun.Touch() && check.hostKeyError() == nil {
+		s.mu.Unlock()
+		return tun, check, nil
+	}
+
+	// if it is being started, wait for it
+	if st := s.starts[key]; st != nil {
+		s.mu.Unlock()
+		<-st.done
+		return st.tun, st.check, st.err
 	}
 
+	st := &tunnelStart{done: make(chan struct{})}
+	s.starts[key] = st
+	parent := s.ctx
+	s.mu.Unlock()
+
 	// otherwise launch a new Tunnel
-	config, err := s.MetaConfig.WithAgent(user)
+	tun, check, l, err := s.prepareTunnel(host, remote, opts)
+
+	s.mu.Lock()
+	delete(s.starts, key)
+	if err == nil {
+		switch {
+		case s.tunnels == nil:
+			err = errServerClosed
+		case st.killed:
+			err = errTunnelKilled
+		}
+		if err != nil {
+			// the tunnel is prepared but not served, the listener is
+			// all there is to release
+			l.Close()
+		}
+	}
 	if err != nil {
-		return nil, err
+		s.mu.Unlock()
+		st.err = err
+		close(st.done)
+		return nil, nil, err
+	}
+
+	// context specific for this tunnel
+	ctx, cancel := context.WithCancel(parent)
+	tun.KillFunc = cancel
+	s.lastID++
+	id := strconv.FormatUint(s.lastID, 10)
+	tun.ExitFunc = func() { s.reapTunnel(key, id, tun) }
+	s.tunnels[key] = tun
+	s.hostKeys[key] = check
+	s.ids[key] = id
+	s.mu.Unlock()
+
+	go s.serveTunnel(ctx, tun, l)
+	if opts.master != nil {
+		// follow the failovers for as long as the tunnel runs
+		go opts.master.Watch(ctx)
 	}
 
-	// get the port for this new tunnel
-	l, port, err := addr.ListenFunc(defaultLocalAddr)
+	st.tun, st.check = tun, check
+	close(st.done)
+	return tun, check, nil
+}
+
+// liveTunnel returns the Tunnel with that key if it exists and is still
+// alive, unless it is about to fail due to a host key error, or nil
+// otherwise.
+func (s *Server) liveTunnel(key tunnelKey) *tunnel.Tunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tun := s.tunnels[key]; tun.Touch() && s.hostKeys[key].hostKeyError() == nil {
+		return tun
+	}
+	return nil
+}
+
+// prepareTunnel returns a new Tunnel to access remote via host,
+// prepared for serving on the returned listener. Its KillFunc is not
+// set.
+func (s *Server) prepareTunnel(host *SSHHost, remote net.Addr, opts tunnelOptions) (*tunnel.Tunnel, *hostKeyCheck, net.Listener, error) {
+	tun, check, err := s.newTunnel(host, remote, opts)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+
+	// get the address for this new tunnel
+	l, local, err := s.listenTunnel(opts.unix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tun.Local = local
+	tun.IdleTimeout = s.TunnelIdleTimeout
+	if opts.cluster {
+		tun.Filter = s.clusterProxy(host, remote, opts.tls)
+	}
+	if opts.master != nil {
+		tun.Remote = opts.master
 	}
 
-	// context specific for this tunnel
-	ctx, cancel := context.WithCancel(s.ctx)
-	tun = &tunnel.Tunnel{
-		SSH:         server,
-		Config:      config,
-		Local:       &net.TCPAddr{IP: defaultLocalAddr.IP, Port: port},
-		Remote:      remote,
-		IdleTimeout: s.TunnelIdleTimeout,
-		Stats:       s.Stats,
-		ErrChan:     s.ErrChan,
-		KillFunc:    cancel,
-	}
-
-	// launch the Tunnel
 	if err := tun.PrepareForServe(); err != nil {
-		cancel()
-		return nil, err
+		l.Close()
+		return nil, nil, nil, err
 	}
+	return tun, check, l, nil
+}
 
-	s.tunnels[key] = tun
-	go s.serveTunnel(ctx, tun, l)
+// listenTunnel returns the listener of a new tunnel and its address: a
+// new Unix socket in the TunnelSocketDir if unix is true, or a free TCP
+// port on the loopback interface.
+func (s *Server) listenTunnel(unix bool) (net.Listener, net.Addr, error) {
+	if !unix {
+		l, port, err := addr.ListenFunc(defaultLocalAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, &net.TCPAddr{IP: defaultLocalAddr.IP, Port: port}, nil
+	}
+
+	dir := s.TunnelSocketDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("regis-companion-%d", os.Getuid()))
+	}
+	if err := privateDir(dir); err != nil {
+		return nil, nil, err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, nil, err
+	}
+	local := &net.UnixAddr{Name: filepath.Join(dir, "tunnel-"+hex.EncodeToString(b)+".sock"), Net: "unix"}
+	l, _, err := addr.ListenFunc(local)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, local, nil
+}
+
+// privateDir creates the directory dir accessible only by the current
+// user, or checks that the existing one is: a directory, not a symbolic
+// link, owned by the user and with the permissions 0700. The default
+// directory has a predictable name in the shared temporary directory,
+// so an existing one is never trusted nor modified.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return errors.Wrap(err, "create tunnel socket directory")
+	}
+	err := os.Mkdir(dir, 0700)
+	if err == nil {
+		return nil
+	}
+	if !os.IsExist(err) {
+		return errors.Wrap(err, "create tunnel socket directory")
+	}
 
-	return tun.Local, nil
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return errors.Wrap(err, "check tunnel socket directory")
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("tunnel socket directory %s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return errors.Errorf("tunnel socket directory %s is not owned by the current user", dir)
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		return errors.Errorf("tunnel socket directory %s must have permissions 0700, has %#o", dir, perm)
+	}
+	return nil
+}
+
+// newTunnel returns a Tunnel to access remote via host, that is not
+// yet prepared for serving. The verification of the host keys of its
+// SSH servers is reported to the returned hostKeyCheck.
+func (s *Server) newTunnel(host *SSHHost, remote net.Addr, opts tunnelOptions) (*tunnel.Tunnel, *hostKeyCheck, error) {
+	config, err := s.clientConfig(host, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	jumps := make([]tunnel.Hop, 0, len(host.Jumps))
+	for _, jump := range host.Jumps {
+		jumpConfig, err := s.clientConfig(jump, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		jumps = append(jumps, tunnel.Hop{SSH: jump.Addr, Config: jumpConfig})
+	}
+
+	// report the host key verifications of the SSH servers to the check
+	check := newHostKeyCheck()
+	config.HostKeyCallback = check.wrap(config.HostKeyCallback, true)
+	for _, jump := range jumps {
+		jump.Config.HostKeyCallback = check.wrap(jump.Config.HostKeyCallback, false)
+	}
+
+	tun := &tunnel.Tunnel{
+		SSH:               host.Addr,
+		Config:            config,
+		Jumps:             jumps,
+		Pool:              &s.pool,
+		PoolKey:           host.poolKey(opts.auth != nil),
+		KeepaliveInterval: s.SSHKeepaliveInterval,
+		KeepaliveCountMax: s.SSHKeepaliveCountMax,
+		IsPermanentError:  isPermanentDialError,
+		Remote:            remote,
+		TLSConfig:         opts.tlsConfig,
+		Stats:             s.Stats,
+		ErrChan:           s.ErrChan,
+	}
+	return tun, check, nil
+}
+
+// isPermanentDialError returns true if err, an error to reconnect to an
+// SSH server, is an authentication or a host key error. Those are not
+// retried with the configuration of the first tunnel: a new host key
+// must be verified and reported to a client, and the challenges of an
+// interactive authentication have no client to answer them anymore.
+// The next GETTUNNELADDR gets a new SSH client and configuration.
+func isPermanentDialError(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(*HostKeyError); ok {
+		return true
+	}
+	return isAuthError(cause)
+}
+
+// clusterProxy returns the filter that rewrites the addresses of the
+// Redis Cluster nodes advertised by remote to the local addresses of
+// tunnels to those nodes via host, started on demand with the same TLS
+// options.
+func (s *Server) clusterProxy(host *SSHHost, remote net.Addr, tlsOpts tlsOptions) *cluster.Proxy {
+	return &cluster.Proxy{
+		DefaultHost: remoteHost(remote),
+		Resolve: func(nodeHost string, nodePort int) (string, int, error) {
+			node := addr.HostPortAddr{Host: nodeHost, Port: nodePort}
+			opts := tunnelOptions{cluster: true, tls: tlsOpts}
+			if tlsOpts.enabled {
+				var err error
+				if opts.tlsConfig, err = tlsOpts.config(nodeHost); err != nil {
+					return "", 0, err
+				}
+			}
+			tun, _, err := s.getTunnel(host, node, opts)
+			if err != nil {
+				return "", 0, err
+			}
+			local := tun.Local.(*net.TCPAddr)
+			return local.IP.String(), local.Port, nil
+		},
+		ErrChan: s.ErrChan,
+	}
+}
+
+// remoteHost returns the host of the remote address, or an empty string
+// if it is a Unix socket.
+func remoteHost(remote net.Addr) string {
+	if a, ok := remote.(addr.HostPortAddr); ok {
+		return a.Host
+	}
+	return ""
+}
+
+// sentinelDialer returns a function that connects to the sentinel at
+// sentinelAddr via a tunnel through host.
+func (s *Server) sentinelDialer(host *SSHHost, sentinelAddr net.Addr) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		tun, _, err := s.getTunnel(host, sentinelAddr, tunnelOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return net.Dial(tun.Local.Network(), tun.Local.String())
+	}
+}
+
+// clientConfig returns the SSH client configuration to use to connect
+// to host.
+func (s *Server) clientConfig(host *SSHHost, opts tunnelOptions) (*ssh.ClientConfig, error) {
+	config, err := s.MetaConfig.WithAgent(host)
+	if err != nil {
+		return nil, err
+	}
+	if opts.auth != nil {
+		config.Auth = append(config.Auth, opts.auth.authMethods(host)...)
+	}
+	return config, nil
 }
 
 func (s *Server) serveTunnel(ctx context.Context, tun *tunnel.Tunnel, l net.Listener) {
@@ -188,18 +567,62 @@ func (s *Server) serveTunnel(ctx context.Context, tun *tunnel.Tunnel, l net.List
 	}
 }
 
-func (s *Server) killTunnel(user string, server, remote addr.HostPortAddr) error {
-	key := tunnelKey{User: user, Server: server, Remote: remote}
+func (s *Server) killTunnel(host *SSHHost, remote net.Addr) error {
+	// kill the tunnels to that remote with any options, including those
+	// being started, that fail once prepared.
+	match := func(key tunnelKey) bool {
+		return key.User == host.User && key.Server == host.Addr && key.Remote == remote
+	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	var tuns []*tunnel.Tunnel
+	for key, tun := range s.tunnels {
+		if match(key) {
+			tuns = append(tuns, tun)
+		}
+	}
+	for key, st := range s.starts {
+		if match(key) {
+			st.killed = true
+		}
+	}
+	s.mu.Unlock()
+
+	// the lock must not be held while waiting for the tunnels, as their
+	// cluster proxies may need it to start tunnels to the cluster nodes.
+	killAll(tuns)
+	return nil
+}
+
+// killAll kills the tunnels and waits for them to stop. They are all
+// cancelled before waiting so that they stop concurrently.
+func killAll(tuns []*tunnel.Tunnel) {
+	for _, tun := range tuns {
+		tun.KillFunc()
+	}
+	for _, tun := range tuns {
+		tun.KillAndWait()
+	}
+}
+
+// killTunnelID kills the tunnel with that ID. It returns false if there
+// is no such tunnel.
+func (s *Server) killTunnelID(id string) bool {
+	s.mu.Lock()
+	var tun *tunnel.Tunnel
+	for key, kid := range s.ids {
+		if kid == id {
+			tun = s.tunnels[key]
+			break
+		}
+	}
+	s.mu.Unlock()
 
-	tun := s.tunnels[key]
 	if tun == nil {
-		return nil
+		return false
 	}
 	tun.KillAndWait()
-	return nil
+	return true
 }
 
 func (s *Server) serve(ctx context.Context, l net.Listener) error {
@@ -212,10 +635,14 @@ func (s *Server) serve(ctx context.Context, l net.Listener) error {
 		return errors.New("server already started")
 	case closed:
 		s.mu.Unlock()
-		return errors.New("server closed")
+		return errServerClosed
 	}
 
 	s.tunnels = make(map[tunnelKey]*tunnel.Tunnel)
+	s.starts = make(map[tunnelKey]*tunnelStart)
+	s.hostKeys = make(map[tunnelKey]*hostKeyCheck)
+	s.ids = make(map[tunnelKey]string)
+	s.auths = make(map[string]*authSession)
 	s.ctx = ctx
 	s.server.Dispatch = s.serveConn
 	s.server.ErrChan = s.ErrChan
@@ -225,13 +652,23 @@ func (s *Server) serve(ctx context.Context, l net.Listener) error {
 
 	defer func() {
 		s.mu.Lock()
-		// properly terminate all tunnels
-		for _, tun := range s.tunnels {
-			tun.KillAndWait()
-		}
+		tuns := s.tunnels
 		s.tunnels = nil
+		s.starts = nil
+		s.hostKeys = nil
+		s.ids = nil
+		s.auths = nil
 		s.state = closed
 		s.mu.Unlock()
+
+		// properly terminate all tunnels, without holding the lock as the
+		// cluster proxies may need it. The tunnels being started fail
+		// once prepared as the server is closed.
+		all := make([]*tunnel.Tunnel, 0, len(tuns))
+		for _, tun := range tuns {
+			all = append(all, tun)
+		}
+		killAll(all)
 	}()
 
 	return s.server.Serve(ctx)
@@ -250,37 +687,50 @@ func (s *Server) serveConn(ctx context.Context, d common.Doner, conn net.Conn) {
 	}()
 
 	wg.Add(1)
-	go s.readWriteLoop(cancel, wg, conn)
+	go s.readWriteLoop(ctx, cancel, wg, conn)
 
 	// block waiting for the stop signal
 	<-done
 }
 
-func (s *Server) readWriteLoop(cancel func(), d common.Doner, conn net.Conn) {
+func (s *Server) readWriteLoop(ctx context.Context, cancel func(), d common.Doner, conn net.Conn) {
 	defer func() {
 		cancel()
 		d.Done()
 	}()
 
-	dec := resp.NewDecoder(conn)
+	// the reader is kept to forward the buffered data on SWITCHTO
+	br := bufio.NewReader(conn)
+	dec := resp.NewDecoder(br)
+	dec.SetLimits(requestLimits)
 	enc := resp.NewEncoder(conn)
+	state := &connState{}
 	for {
 		// read the request
 		req, err := dec.DecodeRequest()
 		if err != nil {
+			if resp.IsProtocolError(err) {
+				s.replyProtocolError(conn, enc, err)
+			}
 			err = errors.Wrap(err, "decode request error")
 			common.HandleError(err, s.ErrChan)
 			return
 		}
 
 		// handle the request
-		res, err := s.execute(req)
+		res, err := s.execute(state, req)
 		if err != nil {
 			err = errors.Wrap(err, "execute request error")
 			common.HandleError(err, s.ErrChan)
 			return
 		}
 
+		sw, isSwitch := res.(switchTo)
+		if isSwitch {
+			res = resp.OK{}
+		}
+		enc.SetProtocol(state.protocol())
+
 		// write the response
 		if s.WriteTimeout > 0 {
 			if err := conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout)); err != nil {
@@ -290,14 +740,76 @@ func (s *Server) readWriteLoop(cancel func(), d common.Doner, conn net.Conn) {
 			}
 		}
 		if err := enc.Encode(res); err != nil {
+			if isSwitch {
+				sw.remote.Close()
+			}
 			err = errors.Wrap(err, "encode response error")
 			common.HandleError(err, s.ErrChan)
 			return
 		}
+
+		if isSwitch {
+			s.switchConn(ctx, sw, bufferedConn{Conn: conn, r: br})
+			return
+		}
+	}
+}
+
+// replyProtocolError replies to an invalid request with a protocol
+// error, as Redis does before it closes the connection. The write
+// errors are ignored as the connection is closed anyway.
+func (s *Server) replyProtocolError(conn net.Conn, enc *resp.Encoder, err error) {
+	if s.Stats != nil {
+		s.Stats.Add("protocol_errors", 1)
+	}
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	msg := strings.TrimPrefix(err.Error(), "resp: ")
+	enc.Encode(resp.Error("ERR Protocol error: " + msg))
+}
+
+// switchConn forwards the data between the connection and the remote
+// connection of sw, until one end is closed or ctx is done.
+func (s *Server) switchConn(ctx context.Context, sw switchTo, conn net.Conn) {
+	if s.Stats != nil {
+		s.Stats.Add("switched_conns", 1)
+	}
+	// the write timeout does not apply to the forwarded data
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		sw.remote.Close()
+		err = errors.Wrap(err, "set write deadline")
+		common.HandleError(err, s.ErrChan)
+		return
+	}
+	sw.tun.Splice(ctx, conn, sw.remote)
+}
+
+// connState is the state of a connection to the Server.
+type connState struct {
+	// true once the connection is authenticated with AUTH or HELLO
+	authenticated bool
+	// the protocol version set with HELLO, 0 for the default RESP2
+	proto int
+}
+
+// protocol returns the protocol version of the connection.
+func (c *connState) protocol() int {
+	if c == nil || c.proto == 0 {
+		return resp.RESP2
 	}
+	return c.proto
 }
 
-func (s *Server) execute(req []string) (interface{}, error) {
+// protoReply is implemented by the results of the commands that reply
+// with different types depending on the protocol version.
+type protoReply interface {
+	reply(proto int) interface{}
+}
+
+// execute executes the request of a connection in the given state,
+// which may be nil for a new connection.
+func (s *Server) execute(state *connState, req []string) (interface{}, error) {
 	if s.Stats != nil {
 		s.Stats.Add("commands_executed", 1)
 		s.Stats.Add("commands_inprogress", 1)
@@ -314,9 +826,38 @@ func (s *Server) execute(req []string) (interface{}, error) {
 	}
 
 	cmdName := strings.ToLower(req[0])
+	authenticated := state != nil && state.authenticated
+	if s.AuthToken != "" && !authenticated && cmdName != "auth" && cmdName != "ping" && cmdName != "hello" {
+		return resp.Error("NOAUTH Authentication required."), nil
+	}
+
 	cmd, ok := supportedCommands[cmdName]
 	if !ok {
 		return resp.Error(fmt.Sprintf("ERR unknown command %v", cmdName)), nil
 	}
-	return cmd.Execute(cmdName, req, s)
+
+	res, err := cmd.Execute(cmdName, req, s)
+	if cmdName == "auth" && res == (resp.OK{}) && state != nil {
+		state.authenticated = true
+	}
+
+	switch r := res.(type) {
+	case hello:
+		// HELLO may authenticate the connection itself
+		if s.AuthToken != "" && !authenticated && !r.authenticated {
+			return resp.Error("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <token> option can be used"), nil
+		}
+		proto := r.proto
+		if proto == 0 {
+			proto = state.protocol()
+		}
+		if state != nil {
+			state.proto = proto
+			state.authenticated = state.authenticated || r.authenticated
+		}
+		res = r.reply(proto)
+	case protoReply:
+		res = r.reply(state.protocol())
+	}
+	return res, err
 }
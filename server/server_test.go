@@ -274,3 +274,42 @@ func TestEncodeErrorTerminatesConnection(t *testing.T) {
 		t.Errorf("want duration of %v, got %v", want, dur)
 	}
 }
+
+func TestProtocolError(t *testing.T) {
+	cases := []struct {
+		req  string
+		want string
+	}{
+		{"*2000\r\n", "ERR Protocol error: invalid array"},
+		{"*1\r\n*1\r\n$4\r\nPING\r\n", "ERR Protocol error: maximum nesting depth exceeded"},
+		{"*1\r\n$100000\r\n", "ERR Protocol error: invalid bulk string"},
+		{"ping \"a\r\n", "ERR Protocol error: unbalanced quotes in inline request"},
+		{"*1\r\n:1\r\n", "ERR Protocol error: invalid request, must be an array of bulk strings with at least one element"},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		srv := &Server{ErrChan: make(chan error, 10)}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go srv.readWriteLoop(ctx, cancel, wg, server)
+
+		// a valid inline request is served first
+		go client.Write([]byte("ping\r\n" + c.req))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		dec := resp.NewDecoder(client)
+		if v, err := dec.Decode(); err != nil || v != resp.SimpleString("PONG") {
+			t.Errorf("%q: want PONG, got %#v and %v", c.req, v, err)
+		}
+		v, err := dec.Decode()
+		if err != nil || v != resp.Error(c.want) {
+			t.Errorf("%q: want %q, got %#v and %v", c.req, c.want, v, err)
+		}
+
+		// the loop stops after the protocol error
+		wg.Wait()
+		client.Close()
+		server.Close()
+	}
+}
@@ -2,9 +2,17 @@ package server
 
 import (
 	"context"
+	"expvar"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -310,7 +318,7 @@ func TestListenFuncError(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if !strings.Contains(v.(string), theErr.Error()) {
+	if !strings.Contains(string(v.(resp.Error)), theErr.Error()) {
 		t.Errorf("want error value to contain %q, got %q", theErr, err)
 	}
 
@@ -411,7 +419,7 @@ func TestGetTunnelAddrKillTunnel(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to decode third response: %v", err)
 	}
-	if v2 != "OK" {
+	if v2 != resp.SimpleString("OK") {
 		t.Errorf("want response 2 to be OK, got %v", v2)
 	}
 	if v1 == v3 {
@@ -425,3 +433,484 @@ func TestGetTunnelAddrKillTunnel(t *testing.T) {
 		t.Errorf("want Conn.Close to be called once, got %d", n)
 	}
 }
+
+func TestGetTunnelAddrSharesSSHClient(t *testing.T) {
+	var mu sync.Mutex
+	var dials int
+	sshClient := &testutils.MockSSHClient{}
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		return sshClient, nil
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	for _, remote := range []string{"remote:7000", "remote:7001"} {
+		res, err := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", remote})
+		if _, ok := res.(string); !ok || err != nil {
+			t.Fatalf("%s: want address, got %#v and %v", remote, res, err)
+		}
+	}
+
+	// the tunnels connect in the background
+	want := "# Pool\r\nssh_clients:1\r\nclient0:host=root@127.0.0.1:22,tunnels=2,reconnects=0\r\n"
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); got != want && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		res, _ := srv.execute(nil, []string{"info", "pool"})
+		got = string(res.([]byte))
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	mu.Lock()
+	if dials != 1 {
+		t.Errorf("want 1 SSH dial, got %d", dials)
+	}
+	mu.Unlock()
+
+	// the client is closed when the last tunnel is closed
+	srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", "remote:7000"})
+	if n := sshClient.CloseCalls(); n != 0 {
+		t.Errorf("want SSHClient.Close not to be called, got %d", n)
+	}
+	srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", "remote:7001"})
+	if n := sshClient.CloseCalls(); n != 1 {
+		t.Errorf("want SSHClient.Close to be called once, got %d", n)
+	}
+}
+
+func TestGetTunnelAddrJumpChains(t *testing.T) {
+	defer setAndDeferSSHDial(mockSSHDial(&testutils.MockSSHClient{}))()
+	tunnel.SSHDialThroughFunc = func(via tunnel.DialCloser, n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		return &testutils.MockSSHClient{}, nil
+	}
+	defer func() { tunnel.SSHDialThroughFunc = tunnel.DefaultSSHDialThrough }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	// the same SSH server and remote via different jump chains are
+	// different tunnels
+	addrs := make(map[string]bool)
+	for _, jumps := range []string{"jump@10.0.0.1", "jump@10.0.0.2", "jump@10.0.0.1,jump@10.0.0.2"} {
+		res, err := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "JUMP", jumps})
+		local, ok := res.(string)
+		if !ok || err != nil {
+			t.Fatalf("%s: want address, got %#v and %v", jumps, res, err)
+		}
+		addrs[local] = true
+	}
+	if len(addrs) != 3 {
+		t.Errorf("want 3 different tunnels, got %v", addrs)
+	}
+
+	// the same jump chain is the same tunnel
+	res, _ := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "JUMP", "jump@10.0.0.1:22"})
+	if local, _ := res.(string); !addrs[local] || len(srv.listTunnels()) != 3 {
+		t.Errorf("want existing tunnel, got %#v", res)
+	}
+
+	// and the SSH clients, connected in the background, are not shared
+	// across jump chains
+	var keys []string
+	for deadline := time.Now().Add(5 * time.Second); len(keys) < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		keys = keys[:0]
+		for _, stat := range srv.pool.Stats() {
+			keys = append(keys, stat.Key)
+		}
+	}
+	want := []string{
+		"jump@10.0.0.1:22>jump@10.0.0.2:22>root@127.0.0.1:22",
+		"jump@10.0.0.1:22>root@127.0.0.1:22",
+		"jump@10.0.0.2:22>root@127.0.0.1:22",
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("want SSH clients %v, got %v", want, keys)
+	}
+	srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", "remote:7000"})
+}
+
+func TestSwitchTo(t *testing.T) {
+	var dialed string
+	sshClient := &testutils.MockSSHClient{
+		DialFunc: func(i int, n, a string) (net.Conn, error) {
+			dialed = a
+
+			// the remote server echoes the data it receives
+			local, remote := net.Pipe()
+			go func() {
+				io.Copy(remote, remote)
+				remote.Close()
+			}()
+			return local, nil
+		},
+	}
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		return sshClient, nil
+	})()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := new(expvar.Map).Init()
+	srv := &Server{
+		Addr:       l.Addr(),
+		MetaConfig: &MetaConfig{KnownHostsFile: "/dev/null"},
+		Stats:      stats,
+	}
+	go srv.serve(ctx, l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the data sent right after the command must be forwarded too
+	cmd := bufferForResp(t, []string{"switchto", "root@127.0.0.1", "remote:7000"})
+	cmd.WriteString("hello")
+	if _, err := conn.Write(cmd.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "+OK\r\nhello"
+	buf := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if dialed != "remote:7000" {
+		t.Errorf("want remote:7000 to be dialed, got %q", dialed)
+	}
+	if v := stats.Get("switched_conns"); v == nil || v.String() != "1" {
+		t.Errorf("want 1 switched connection, got %v", v)
+	}
+
+	// closing the connection releases the SSH client
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for sshClient.CloseCalls() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want SSHClient.Close to be called once, got %d", sshClient.CloseCalls())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetTunnelAddrUnix(t *testing.T) {
+	sshClient := &testutils.MockSSHClient{}
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		return sshClient, nil
+	})()
+
+	dir, err := ioutil.TempDir("", "tunnels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+	srv.TunnelSocketDir = filepath.Join(dir, "sockets")
+
+	res, err := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "unix"})
+	path, ok := res.(string)
+	if !ok || err != nil {
+		t.Fatalf("want socket path, got %#v and %v", res, err)
+	}
+	if filepath.Dir(path) != srv.TunnelSocketDir {
+		t.Errorf("want socket in %s, got %s", srv.TunnelSocketDir, path)
+	}
+	for _, p := range []string{srv.TunnelSocketDir, path} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm&0077 != 0 {
+			t.Errorf("%s: want owner-only permissions, got %#o", p, perm)
+		}
+	}
+
+	// the TCP tunnel to the same remote is a different one
+	res, _ = srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000"})
+	if res == path {
+		t.Errorf("want TCP address, got %#v", res)
+	}
+
+	// the socket is removed when the tunnel is killed
+	srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", "remote:7000"})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("want socket to be removed, got %v", err)
+	}
+}
+
+func TestPrivateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tunnels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// created
+	created := filepath.Join(dir, "a", "sockets")
+	if err := privateDir(created); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if fi, err := os.Lstat(created); err != nil || !fi.IsDir() || fi.Mode().Perm()&0077 != 0 {
+		t.Errorf("want private directory, got %v and %v", fi, err)
+	}
+	// existing, private
+	if err := os.Chmod(created, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(created); err != nil {
+		t.Errorf("want no error for existing directory, got %v", err)
+	}
+
+	// existing, public: refused and left unchanged
+	public := filepath.Join(dir, "public")
+	if err := os.Mkdir(public, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(public, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(public); err == nil || !strings.Contains(err.Error(), "must have permissions 0700") {
+		t.Errorf("want permissions error, got %v", err)
+	}
+	if fi, _ := os.Stat(public); fi.Mode().Perm() != 0755 {
+		t.Errorf("want permissions unchanged, got %#o", fi.Mode().Perm())
+	}
+
+	// symbolic link to a directory of the user: refused
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(created, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(link); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("want symbolic link error, got %v", err)
+	}
+}
+
+func TestGetTunnelAddrRemoteUnixSocket(t *testing.T) {
+	dialed := make(chan string, 1)
+	sshClient := &testutils.MockSSHClient{
+		DialFunc: func(i int, n, a string) (net.Conn, error) {
+			dialed <- n + " " + a
+			return nil, io.EOF
+		},
+	}
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		return sshClient, nil
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	res, err := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "unix:/var/run/redis.sock"})
+	local, ok := res.(string)
+	if !ok || err != nil {
+		t.Fatalf("want address, got %#v and %v", res, err)
+	}
+
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case got := <-dialed:
+		if want := "unix /var/run/redis.sock"; got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want remote socket to be dialed")
+	}
+}
+
+func TestGetTunnelAddrConcurrent(t *testing.T) {
+	var listens int64
+	defer setAndDeferListenFunc(func(a net.Addr) (net.Listener, int, error) {
+		atomic.AddInt64(&listens, 1)
+		return addr.Listen(a)
+	})()
+
+	defer setAndDeferSSHDial(mockSSHDial(&testutils.MockSSHClient{}))()
+
+	// the identity file of the slow server is a FIFO, its configuration
+	// blocks until the FIFO is opened for writing
+	dir, err := ioutil.TempDir("", "concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "id_slow")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshConfig := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(sshConfig, []byte("Host slow\n  HostName 127.0.0.2\n  IdentityFile "+fifo+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null", SSHConfigFile: sshConfig})
+
+	remotes := []string{"remote:7000", "remote:7001", "remote:7002", "remote:7003", "remote:7004"}
+
+	// concurrent requests for the same tunnels start each one once
+	var wg sync.WaitGroup
+	addrs := make([]interface{}, 200)
+	for i := range addrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addrs[i], _ = srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", remotes[i%len(remotes)]})
+		}(i)
+	}
+	wg.Wait()
+	for i, a := range addrs {
+		if _, ok := a.(string); !ok {
+			t.Fatalf("%d: want address, got %#v", i, a)
+		}
+		if first := addrs[i%len(remotes)]; a != first {
+			t.Errorf("%d: want address %v, got %v", i, first, a)
+		}
+	}
+	if n := atomic.LoadInt64(&listens); n != int64(len(remotes)) {
+		t.Errorf("want %d tunnels started, got %d", len(remotes), n)
+	}
+
+	// a request to a slow SSH server does not block the others
+	slow := make(chan interface{}, 1)
+	go func() {
+		res, _ := srv.execute(nil, []string{"gettunneladdr", "root@slow", "remote:7000"})
+		slow <- res
+	}()
+	for starting := false; !starting; time.Sleep(time.Millisecond) {
+		srv.mu.Lock()
+		starting = len(srv.starts) > 0
+		srv.mu.Unlock()
+	}
+
+	// mix of requests, with kills and lists, for hundreds of requests
+	errs := make(chan error, 300)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			remote := remotes[i%len(remotes)]
+			var res interface{}
+			switch i % 10 {
+			case 0:
+				res, _ = srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", remote})
+				if res != (resp.OK{}) {
+					errs <- errors.Errorf("%d: want OK to KILLTUNNEL, got %#v", i, res)
+				}
+			case 1:
+				res, _ = srv.execute(nil, []string{"listtunnels"})
+				if _, ok := res.([]tunnelInfo); !ok {
+					errs <- errors.Errorf("%d: want tunnels, got %#v", i, res)
+				}
+			default:
+				res, _ = srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", remote})
+				switch res := res.(type) {
+				case string:
+				case resp.Error:
+					// the tunnel may be killed while it is started
+					if !strings.Contains(string(res), errTunnelKilled.Error()) {
+						errs <- errors.Errorf("%d: want address, got %v", i, res)
+					}
+				default:
+					errs <- errors.Errorf("%d: want address, got %#v", i, res)
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("requests blocked by the slow SSH server")
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	select {
+	case res := <-slow:
+		t.Fatalf("want request to slow SSH server to block, got %#v", res)
+	default:
+	}
+	f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if res, ok := (<-slow).(string); !ok {
+		t.Errorf("want address of slow SSH server, got %#v", res)
+	}
+
+	// one tunnel per remote after the kills
+	res, _ := srv.execute(nil, []string{"listtunnels", "*127.0.0.1*"})
+	for _, info := range res.([]tunnelInfo) {
+		if info.State == "closed" {
+			continue
+		}
+		for _, other := range res.([]tunnelInfo) {
+			if other.ID != info.ID && other.SSHServer == info.SSHServer && other.Remote == info.Remote && other.State != "closed" {
+				t.Errorf("want one live tunnel to %s, got %s and %s", info.Remote, info.ID, other.ID)
+			}
+		}
+	}
+
+	// wait for the tunnels to stop before restoring the dial function
+	for _, remote := range remotes {
+		srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", remote})
+	}
+	srv.execute(nil, []string{"killtunnel", "root@slow", "remote:7000"})
+}
+
+func TestIsPermanentDialError(t *testing.T) {
+	hostKeyErr := &HostKeyError{Host: "example.com", Kind: HostKeyChanged}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{hostKeyErr, true},
+		{errors.Wrap(hostKeyErr, "jump host example.com:22"), true},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain"), true},
+		{errAuthChallengeTimeout, true},
+		{errors.New("ssh: handshake failed: EOF"), false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nohost"}}, false},
+	}
+	for _, c := range cases {
+		if got := isPermanentDialError(c.err); got != c.want {
+			t.Errorf("%v: want %t, got %t", c.err, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/harfangapps/regis-companion/resp"
+)
+
+type setPassphraseCmd struct{}
+
+// SETPASSPHRASE identity-file passphrase
+func (c setPassphraseCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if len(req) != 3 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	s.MetaConfig.SetPassphrase(req[1], req[2])
+	return resp.OK{}, nil
+}
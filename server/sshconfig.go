@@ -2,14 +2,17 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"net"
-	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/sshconfig"
+
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // MetaConfig holds configuration options to use to create SSH client
@@ -18,49 +21,202 @@ type MetaConfig struct {
 	KnownHostsFile string
 	SSHDialTimeout time.Duration
 
-	mu    sync.Mutex
-	agent net.Conn
+	// SSHConfigFile is the path to an OpenSSH client configuration file
+	// used to resolve the SSH server addresses. It is ignored if empty
+	// or if the file does not exist.
+	SSHConfigFile string
+
+	// IdentityFiles are the private key files to try for all hosts,
+	// after the SSH agent's keys and the host's identity files.
+	IdentityFiles []string
+	// PassphrasesFile is the path to a file that contains the passphrases
+	// of encrypted identity files, one "identity-file passphrase" pair
+	// per line. It must not be accessible by group or others.
+	PassphrasesFile string
+
+	mu          sync.Mutex
+	agent       net.Conn
+	passphrases map[string]string        // set via SetPassphrase, by identity file
+	authKeys    map[string]authInfo      // key that authenticated, by user@host
+	hostKeys    map[string]ssh.PublicKey // pending unknown host keys, by host
+}
+
+// SSHHost holds the connection parameters of an SSH server, resolved
+// from the requested address and the SSH configuration file.
+type SSHHost struct {
+	// Alias is the host name as requested, before it is resolved.
+	Alias string
+	// User is the user to connect with.
+	User string
+	// Addr is the resolved address of the SSH server.
+	Addr addr.HostPortAddr
+	// IdentityFiles are the private key files to try after the
+	// SSH agent's keys.
+	IdentityFiles []string
+	// Jumps is the chain of jump hosts to go through to reach this
+	// host, in dialing order.
+	Jumps []*SSHHost
+}
+
+// jumpChain returns the canonical form of the chain of jump hosts of h,
+// as a comma-separated list of user@host:port in dialing order, or an
+// empty string if there is none.
+func (h *SSHHost) jumpChain() string {
+	hops := make([]string, len(h.Jumps))
+	for i, jump := range h.Jumps {
+		hops[i] = fmt.Sprintf("%s@%s", jump.User, jump.Addr)
+	}
+	return strings.Join(hops, ",")
+}
+
+// poolKey returns the key of the SSH client of h in the pool of SSH
+// clients. Only the tunnels that would authenticate the same way over
+// the same chain of SSH servers may share a client, so the key is the
+// user@host:port of every hop in dialing order, separated by ">", each
+// followed by its identity files if any, and marked as interactive if
+// the password and keyboard-interactive challenges are relayed to the
+// client.
+func (h *SSHHost) poolKey(interactive bool) string {
+	hopKey := func(hop *SSHHost) string {
+		key := fmt.Sprintf("%s@%s", hop.User, hop.Addr)
+		if len(hop.IdentityFiles) > 0 {
+			key += "(" + strings.Join(hop.IdentityFiles, ";") + ")"
+		}
+		return key
+	}
+
+	hops := make([]string, 0, len(h.Jumps)+1)
+	for _, jump := range h.Jumps {
+		hops = append(hops, hopKey(jump))
+	}
+	key := strings.Join(append(hops, hopKey(h)), ">")
+	if interactive {
+		key += "+interactive"
+	}
+	return key
 }
 
 // ErrNoKnownHostsFile is returned when the KnownHostsFile field is empty.
 var ErrNoKnownHostsFile = errors.New("sshconfig: missing known hosts file")
 
-// WithAgent returns an SSH ClientConfig that authenticates via the
-// SSH agent.
-func (c *MetaConfig) WithAgent(user string) (*ssh.ClientConfig, error) {
-	if c.KnownHostsFile == "" {
-		return nil, ErrNoKnownHostsFile
+// maxJumpHosts is the maximum number of jump hosts in a chain.
+const maxJumpHosts = 16
+
+// ResolveHost parses s, which should have the format [user@]host[:port],
+// and resolves it using the SSHConfigFile. The user and port specified
+// in s take precedence over those in the configuration file.
+//
+// If proxyJump is not empty, it overrides the ProxyJump setting of the
+// configuration file. It has the same format as OpenSSH's ProxyJump, that
+// is a comma-separated list of [user@]host[:port] jump hosts, or "none".
+func (c *MetaConfig) ResolveHost(s, proxyJump string) (*SSHHost, error) {
+	conf := &sshconfig.Config{}
+	if c.SSHConfigFile != "" {
+		var err error
+		if conf, err = sshconfig.ParseFile(c.SSHConfigFile); err != nil {
+			return nil, err
+		}
 	}
-	hostKeyCallback, err := knownhosts.New(c.KnownHostsFile)
+
+	host, settings, err := resolveHost(conf, s)
 	if err != nil {
 		return nil, err
 	}
 
-	auth, err := c.sshAgentAuthMethod()
-	if err != nil {
+	if proxyJump == "" {
+		proxyJump = settings.Get("proxyjump")
+	}
+	if host.Jumps, err = resolveJumps(conf, proxyJump, 0); err != nil {
 		return nil, err
 	}
+	return host, nil
+}
 
-	return &ssh.ClientConfig{
-		User:            user,
-		Timeout:         c.SSHDialTimeout,
-		Auth:            []ssh.AuthMethod{auth},
-		HostKeyCallback: hostKeyCallback,
-	}, nil
+func resolveHost(conf *sshconfig.Config, s string) (*SSHHost, *sshconfig.Host, error) {
+	s = strings.TrimPrefix(s, "ssh://")
+	user, hostAddr, err := addr.ParseSSHUserAddr(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := &SSHHost{Alias: hostAddr.Host, User: user, Addr: hostAddr}
+	settings := conf.Lookup(host.Alias, user)
+
+	if host.User == "" {
+		host.User = settings.Get("user")
+	}
+	host.Addr.Host = strings.ToLower(settings.HostName())
+	if p := settings.Get("port"); p != "" && !hasExplicitPort(s) {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("sshconfig: invalid port %q", p)
+		}
+		host.Addr.Port = port
+	}
+	host.IdentityFiles = settings.IdentityFiles(host.User)
+	return host, settings, nil
 }
 
-func (c *MetaConfig) sshAgentAuthMethod() (ssh.AuthMethod, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// resolveJumps resolves the comma-separated list of jump hosts into a
+// flat chain of hosts, in dialing order. As with OpenSSH, the ProxyJump
+// setting of the first jump host is honored, so that its own jump hosts
+// come first in the chain.
+func resolveJumps(conf *sshconfig.Config, proxyJump string, depth int) ([]*SSHHost, error) {
+	if proxyJump == "" || strings.EqualFold(proxyJump, "none") {
+		return nil, nil
+	}
 
-	if c.agent != nil {
-		return ssh.PublicKeysCallback(agent.NewClient(c.agent).Signers), nil
+	var chain []*SSHHost
+	for i, s := range strings.Split(proxyJump, ",") {
+		jump, settings, err := resolveHost(conf, strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump host %q: %v", s, err)
+		}
+		if i == 0 {
+			if depth >= maxJumpHosts {
+				return nil, errors.New("sshconfig: too many jump hosts")
+			}
+			parents, err := resolveJumps(conf, settings.Get("proxyjump"), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, parents...)
+		}
+		chain = append(chain, jump)
+	}
+	if len(chain) > maxJumpHosts {
+		return nil, errors.New("sshconfig: too many jump hosts")
 	}
+	return chain, nil
+}
 
-	conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+// hasExplicitPort returns true if the [user@]host[:port] address
+// specifies a non-zero port.
+func hasExplicitPort(s string) bool {
+	if i := strings.Index(s, "@"); i > 0 {
+		s = s[i+1:]
+	}
+	_, port, err := net.SplitHostPort(s)
+	return err == nil && port != "" && port != "0"
+}
+
+// WithAgent returns an SSH ClientConfig for host that authenticates via
+// the SSH agent's keys first, and then via the private keys of the host's
+// identity files and of the global IdentityFiles.
+func (c *MetaConfig) WithAgent(host *SSHHost) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	signers, err := c.signersFunc(host)
 	if err != nil {
 		return nil, err
 	}
-	c.agent = conn
-	return ssh.PublicKeysCallback(agent.NewClient(c.agent).Signers), nil
+
+	return &ssh.ClientConfig{
+		User:            host.User,
+		Timeout:         c.SSHDialTimeout,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(signers)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
 }
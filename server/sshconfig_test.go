@@ -0,0 +1,144 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/addr"
+)
+
+func TestResolveHost(t *testing.T) {
+	f, err := ioutil.TempFile("", "ssh_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	conf := `
+Host bastion
+    HostName Bastion.Example.com
+    User admin
+    Port 2222
+`
+	if _, err := f.WriteString(conf); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cases := []struct {
+		in   string
+		user string
+		addr addr.HostPortAddr
+	}{
+		{"bastion", "admin", addr.HostPortAddr{Host: "bastion.example.com", Port: 2222}},
+		{"me@bastion", "me", addr.HostPortAddr{Host: "bastion.example.com", Port: 2222}},
+		{"me@bastion:22", "me", addr.HostPortAddr{Host: "bastion.example.com", Port: 22}},
+		{"bastion:0", "admin", addr.HostPortAddr{Host: "bastion.example.com", Port: 2222}},
+		{"other", "", addr.HostPortAddr{Host: "other", Port: 22}},
+		{"me@Other:23", "me", addr.HostPortAddr{Host: "other", Port: 23}},
+	}
+
+	meta := &MetaConfig{SSHConfigFile: f.Name()}
+	for _, c := range cases {
+		host, err := meta.ResolveHost(c.in, "")
+		if err != nil {
+			t.Errorf("%s: want no error, got %v", c.in, err)
+			continue
+		}
+		if host.User != c.user {
+			t.Errorf("%s: want user %q, got %q", c.in, c.user, host.User)
+		}
+		if host.Addr != c.addr {
+			t.Errorf("%s: want address %v, got %v", c.in, c.addr, host.Addr)
+		}
+	}
+}
+
+func TestResolveHostJumps(t *testing.T) {
+	f, err := ioutil.TempFile("", "ssh_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	conf := `
+Host bastion
+    User admin
+
+Host inner
+    ProxyJump bastion
+
+Host second
+    ProxyJump ignored
+
+Host db
+    ProxyJump inner,jump@second:2022
+
+Host loop
+    ProxyJump loop
+`
+	if _, err := f.WriteString(conf); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cases := []struct {
+		in, proxyJump string
+		want          []string
+	}{
+		{"db", "", []string{"admin@bastion:22", "@inner:22", "jump@second:2022"}},
+		{"db", "none", nil},
+		{"db", "other,ssh://u@bastion:23", []string{"@other:22", "u@bastion:23"}},
+		{"inner", "", []string{"admin@bastion:22"}},
+		{"bastion", "", nil},
+	}
+
+	meta := &MetaConfig{SSHConfigFile: f.Name()}
+	for _, c := range cases {
+		host, err := meta.ResolveHost(c.in, c.proxyJump)
+		if err != nil {
+			t.Errorf("%s: want no error, got %v", c.in, err)
+			continue
+		}
+		var got []string
+		for _, j := range host.Jumps {
+			got = append(got, j.User+"@"+j.Addr.String())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want jumps %v, got %v", c.in, c.want, got)
+		}
+	}
+
+	if _, err := meta.ResolveHost("loop", ""); err == nil {
+		t.Errorf("want error for a ProxyJump loop, got nil")
+	}
+}
+
+func TestSSHHostPoolKey(t *testing.T) {
+	host := func(user, h string, files ...string) *SSHHost {
+		return &SSHHost{User: user, Addr: addr.HostPortAddr{Host: h, Port: 22}, IdentityFiles: files}
+	}
+	withJumps := func(h *SSHHost, jumps ...*SSHHost) *SSHHost {
+		h.Jumps = jumps
+		return h
+	}
+
+	cases := []struct {
+		host        *SSHHost
+		interactive bool
+		want        string
+	}{
+		{host("root", "db"), false, "root@db:22"},
+		{host("root", "db"), true, "root@db:22+interactive"},
+		{host("root", "db", "/a", "/b"), false, "root@db:22(/a;/b)"},
+		{withJumps(host("root", "db"), host("admin", "bastion")), false, "admin@bastion:22>root@db:22"},
+		{withJumps(host("root", "db", "/a"), host("admin", "bastion", "/b"), host("", "inner")), true, "admin@bastion:22(/b)>@inner:22>root@db:22(/a)+interactive"},
+	}
+	for _, c := range cases {
+		if got := c.host.poolKey(c.interactive); got != c.want {
+			t.Errorf("want %q, got %q", c.want, got)
+		}
+	}
+}
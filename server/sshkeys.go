@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// source of the keys provided by the SSH agent.
+const agentSource = "agent"
+
+// authInfo describes the key that authenticated a user to an SSH server.
+type authInfo struct {
+	Host        string // user@host:port
+	Source      string // "agent" or the path of the identity file
+	Fingerprint string
+	At          time.Time
+}
+
+// SetPassphrase sets the passphrase to use to decrypt the identity file.
+// It takes precedence over the PassphrasesFile. An empty passphrase
+// removes it.
+func (c *MetaConfig) SetPassphrase(identityFile, passphrase string) {
+	file := cleanPath(identityFile)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if passphrase == "" {
+		delete(c.passphrases, file)
+		return
+	}
+	if c.passphrases == nil {
+		c.passphrases = make(map[string]string)
+	}
+	c.passphrases[file] = passphrase
+}
+
+// signersFunc returns the function that returns the signers to try to
+// authenticate to host: the SSH agent's keys first, then the host's
+// identity files and the global IdentityFiles. The identity files are
+// loaded immediately, so that an error is returned if no key is available.
+func (c *MetaConfig) signersFunc(host *SSHHost) (func() ([]ssh.Signer, error), error) {
+	files := make([]string, 0, len(host.IdentityFiles)+len(c.IdentityFiles))
+	files = append(files, host.IdentityFiles...)
+	files = append(files, c.IdentityFiles...)
+
+	// errors are only reported if there is no key at all
+	fileSigners, fileErr := c.identityFileSigners(files)
+	agentClient, agentErr := c.agentClient()
+	if agentErr != nil && len(fileSigners) == 0 {
+		if fileErr != nil {
+			return nil, fmt.Errorf("no SSH key available: ssh agent: %v, identity files: %v", agentErr, fileErr)
+		}
+		return nil, errors.Wrap(agentErr, "ssh agent")
+	}
+
+	name := fmt.Sprintf("%s@%s", host.User, host.Addr)
+	return func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		if agentClient != nil {
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				// reconnect to the agent on next call
+				c.resetAgent()
+				if len(fileSigners) == 0 {
+					return nil, err
+				}
+			}
+			for _, s := range agentSigners {
+				signers = append(signers, c.recordingSigner(s, name, agentSource))
+			}
+		}
+		for _, s := range fileSigners {
+			signers = append(signers, c.recordingSigner(s.Signer, name, s.file))
+		}
+		return signers, nil
+	}, nil
+}
+
+type fileSigner struct {
+	ssh.Signer
+	file string
+}
+
+// identityFileSigners returns the signers for the private keys in files.
+// As with OpenSSH, files that do not exist are skipped. Encrypted keys
+// are decrypted using the passphrases set via SetPassphrase or the
+// PassphrasesFile, and are skipped if there is none. The last error
+// encountered is returned along with the valid signers.
+func (c *MetaConfig) identityFileSigners(files []string) ([]fileSigner, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	passphrases, err := c.loadPassphrases()
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []fileSigner
+	var lastErr error
+	for _, file := range files {
+		file = cleanPath(file)
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				lastErr = err
+			}
+			continue
+		}
+
+		var signer ssh.Signer
+		if isEncryptedKey(b) {
+			passphrase, ok := passphrases[file]
+			if !ok {
+				lastErr = fmt.Errorf("%s: missing passphrase", file)
+				continue
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(b)
+		}
+		if err != nil {
+			lastErr = errors.Wrap(err, file)
+			continue
+		}
+		signers = append(signers, fileSigner{Signer: signer, file: file})
+	}
+	return signers, lastErr
+}
+
+// openSSHKeyMagic starts the OpenSSH private key format.
+const openSSHKeyMagic = "openssh-key-v1\x00"
+
+// isEncryptedKey returns true if the PEM-encoded private key is
+// encrypted, either a legacy PEM key with an encryption header, or a
+// key in the OpenSSH format with a cipher other than "none".
+func isEncryptedKey(b []byte) bool {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return false
+	}
+	if block.Type != "OPENSSH PRIVATE KEY" {
+		return strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+	}
+
+	// the magic is followed by the length-prefixed cipher name
+	rest := block.Bytes
+	if !bytes.HasPrefix(rest, []byte(openSSHKeyMagic)) {
+		return false
+	}
+	rest = rest[len(openSSHKeyMagic):]
+	if len(rest) < 4 {
+		return false
+	}
+	n := binary.BigEndian.Uint32(rest)
+	if uint64(len(rest)-4) < uint64(n) {
+		return false
+	}
+	return string(rest[4:4+n]) != "none"
+}
+
+// loadPassphrases returns the passphrases by identity file, those of
+// the PassphrasesFile overridden by those set via SetPassphrase.
+func (c *MetaConfig) loadPassphrases() (map[string]string, error) {
+	passphrases := make(map[string]string)
+	if c.PassphrasesFile != "" {
+		if err := readPassphrasesFile(c.PassphrasesFile, passphrases); err != nil {
+			return nil, errors.Wrap(err, "passphrases file")
+		}
+	}
+
+	c.mu.Lock()
+	for k, v := range c.passphrases {
+		passphrases[k] = v
+	}
+	c.mu.Unlock()
+	return passphrases, nil
+}
+
+func readPassphrasesFile(path string, passphrases map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("permissions %#o for %s are too open", fi.Mode().Perm(), path)
+	}
+	return parsePassphrases(f, passphrases)
+}
+
+// parsePassphrases parses lines of "identity-file passphrase" pairs. The
+// passphrase is the rest of the line after the whitespace that follows
+// the identity file. Blank lines and lines starting with '#' are ignored.
+func parsePassphrases(r io.Reader, passphrases map[string]string) error {
+	s := bufio.NewScanner(r)
+	var lineno int
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return fmt.Errorf("line %d: missing passphrase", lineno)
+		}
+		passphrases[cleanPath(line[:i])] = strings.TrimLeft(line[i:], " \t")
+	}
+	return s.Err()
+}
+
+// cleanPath expands a leading ~ to the home directory and cleans the
+// path so that it can be used as a map key.
+func cleanPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	return filepath.Clean(path)
+}
+
+// recordingSigner returns a Signer that records the source of the key
+// in the authentication info of host when it is used to sign. Public
+// key authentication only signs with keys accepted by the server.
+func (c *MetaConfig) recordingSigner(s ssh.Signer, host, source string) ssh.Signer {
+	return recordingSigner{
+		Signer: s,
+		record: func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			if c.authKeys == nil {
+				c.authKeys = make(map[string]authInfo)
+			}
+			c.authKeys[host] = authInfo{
+				Host:        host,
+				Source:      source,
+				Fingerprint: ssh.FingerprintSHA256(s.PublicKey()),
+				At:          time.Now(),
+			}
+		},
+	}
+}
+
+type recordingSigner struct {
+	ssh.Signer
+	record func()
+}
+
+func (s recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sig, err := s.Signer.Sign(rand, data)
+	if err == nil {
+		s.record()
+	}
+	return sig, err
+}
+
+// authKeysInfo returns the keys that authenticated to SSH servers,
+// sorted by host.
+func (c *MetaConfig) authKeysInfo() []authInfo {
+	c.mu.Lock()
+	infos := make([]authInfo, 0, len(c.authKeys))
+	for _, info := range c.authKeys {
+		infos = append(infos, info)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Host < infos[j].Host
+	})
+	return infos
+}
+
+// agentClient returns a client for the SSH agent listening on
+// SSH_AUTH_SOCK, connecting to it if required.
+func (c *MetaConfig) agentClient() (agent.Agent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.agent != nil {
+		return agent.NewClient(c.agent), nil
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	c.agent = conn
+	return agent.NewClient(c.agent), nil
+}
+
+// resetAgent closes the connection to the SSH agent, so that the next
+// call to agentClient reconnects.
+func (c *MetaConfig) resetAgent() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.agent != nil {
+		c.agent.Close()
+		c.agent = nil
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/addr"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestKeys writes an unencrypted and an encrypted private key
+// in dir, and returns their paths.
+func writeTestKeys(t *testing.T, dir, passphrase string) (plain, encrypted string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := x509.MarshalPKCS1PrivateKey(key)
+
+	plain = filepath.Join(dir, "id_plain")
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(plain, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", der, []byte(passphrase), x509.PEMCipherAES128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted = filepath.Join(dir, "id_encrypted")
+	if err := ioutil.WriteFile(encrypted, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return plain, encrypted
+}
+
+// writeOpenSSHKey writes an ed25519 private key in the OpenSSH format
+// in dir, encrypted if passphrase is not empty, and returns its path.
+func writeOpenSSHKey(t *testing.T, dir, name, passphrase string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIsEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain, encrypted := writeTestKeys(t, dir, "x")
+	cases := map[string]bool{
+		plain:     false,
+		encrypted: true,
+		writeOpenSSHKey(t, dir, "id_ed25519", ""):            false,
+		writeOpenSSHKey(t, dir, "id_ed25519_encrypted", "x"): true,
+	}
+	for file, want := range cases {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isEncryptedKey(b); got != want {
+			t.Errorf("%s: want %t, got %t", filepath.Base(file), want, got)
+		}
+	}
+
+	// truncated OpenSSH keys are not encrypted, their parsing fails
+	b := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: []byte("openssh-key-v1\x00\x00\x00\x00\x10aes")})
+	if isEncryptedKey(b) {
+		t.Errorf("want truncated key not to be encrypted")
+	}
+}
+
+func TestIdentityFileSigners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain, encrypted := writeTestKeys(t, dir, "secret phrase")
+	encryptedOpenSSH := writeOpenSSHKey(t, dir, "id_ed25519", "other phrase")
+	missing := filepath.Join(dir, "id_missing")
+
+	meta := &MetaConfig{}
+	for _, file := range []string{encrypted, encryptedOpenSSH} {
+		signers, err := meta.identityFileSigners([]string{missing, plain, file})
+		if len(signers) != 1 || signers[0].file != plain {
+			t.Errorf("want only the plain key, got %v", signers)
+		}
+		if err == nil || !strings.Contains(err.Error(), "missing passphrase") {
+			t.Errorf("want missing passphrase error, got %v", err)
+		}
+	}
+
+	// passphrase in the passphrases file
+	meta.PassphrasesFile = filepath.Join(dir, "passphrases")
+	content := "# comment\n" + encrypted + " secret phrase\n" + encryptedOpenSSH + " other phrase\n"
+	if err := ioutil.WriteFile(meta.PassphrasesFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := meta.identityFileSigners([]string{encrypted}); err == nil || !strings.Contains(err.Error(), "too open") {
+		t.Errorf("want permissions error, got %v", err)
+	}
+	if err := os.Chmod(meta.PassphrasesFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signers, err := meta.identityFileSigners([]string{encrypted, encryptedOpenSSH})
+	if err != nil || len(signers) != 2 {
+		t.Errorf("want encrypted keys and no error, got %v and %v", signers, err)
+	}
+
+	// SetPassphrase takes precedence over the file
+	meta.SetPassphrase(encrypted, "wrong")
+	if signers, err := meta.identityFileSigners([]string{encrypted}); err == nil || len(signers) != 0 {
+		t.Errorf("want decryption error, got %v and %v", signers, err)
+	}
+	meta.SetPassphrase(encrypted, "")
+	if signers, err := meta.identityFileSigners([]string{encrypted}); err != nil || len(signers) != 1 {
+		t.Errorf("want encrypted key and no error, got %v and %v", signers, err)
+	}
+}
+
+func TestSignersWithoutAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	defer os.Setenv("SSH_AUTH_SOCK", sock)
+
+	plain, _ := writeTestKeys(t, dir, "x")
+	host := &SSHHost{User: "me", Addr: addr.HostPortAddr{Host: "h", Port: 22}}
+
+	meta := &MetaConfig{}
+	if _, err := meta.signersFunc(host); err == nil {
+		t.Errorf("want error without agent and identity files, got nil")
+	}
+
+	meta.IdentityFiles = []string{plain}
+	fn, err := meta.signersFunc(host)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	signers, err := fn()
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("want 1 signer, got %v and %v", signers, err)
+	}
+
+	// signing records the key used for the host
+	if _, err := signers[0].Sign(rand.Reader, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	infos := meta.authKeysInfo()
+	if len(infos) != 1 {
+		t.Fatalf("want 1 auth info, got %v", infos)
+	}
+	want := ssh.FingerprintSHA256(signers[0].PublicKey())
+	if infos[0].Host != "me@h:22" || infos[0].Source != plain || infos[0].Fingerprint != want {
+		t.Errorf("want auth info for %s, got %+v", plain, infos[0])
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+)
+
+type switchToCmd struct{}
+
+// switchTo is the result of a successful SWITCHTO command. Once the
+// +OK reply is sent, the connection stops being a companion connection
+// and is forwarded to remote.
+type switchTo struct {
+	tun    *tunnel.Tunnel
+	remote net.Conn
+}
+
+// SWITCHTO [user@]ssh.server.host[:port] remote.server.host:port|unix:/remote/socket/path [JUMP [user@]jump.host[:port][,...]]
+//
+// Connects to the remote server via the SSH server, and replies +OK
+// once connected. From then on, the companion connection is a
+// transparent tunnel to the remote server, without a local port. The
+// SSH connection is shared with the tunnels to the same SSH server via
+// the same jump hosts.
+//
+// Host key errors are reported as for GETTUNNELADDR.
+func (c switchToCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if len(req) < 3 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	var proxyJump string
+	for i := 3; i < len(req); i++ {
+		switch opt := strings.ToLower(req[i]); opt {
+		case "jump":
+			if i+1 >= len(req) {
+				return resp.Error(fmt.Sprintf("ERR missing value for %v option", opt)), nil
+			}
+			i++
+			proxyJump = req[i]
+		default:
+			return resp.Error(fmt.Sprintf("ERR unknown option %v", opt)), nil
+		}
+	}
+
+	host, err := s.MetaConfig.ResolveHost(req[1], proxyJump)
+	if err != nil {
+		return resp.Error(fmt.Sprintf("ERR invalid SSH server address: %s", err)), nil
+	}
+
+	// remote address, port required unless it is a Unix socket
+	remoteAddr, err := addr.ParseRemoteAddr(req[2])
+	if err != nil {
+		return resp.Error(fmt.Sprintf("ERR invalid remote server address: %s", err)), nil
+	}
+
+	tun, _, err := s.newTunnel(host, remoteAddr, tunnelOptions{})
+	if err != nil {
+		return resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", err)), nil
+	}
+	remote, err := tun.DialRemote()
+	if err != nil {
+		return s.tunnelErrorReply(err), nil
+	}
+	return switchTo{tun: tun, remote: remote}, nil
+}
+
+// bufferedConn is a net.Conn that reads from a buffered reader of the
+// connection, so that the data already buffered is not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
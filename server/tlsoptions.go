@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// tlsOptions are the TLS options of a tunnel, set via the GETTUNNELADDR
+// options. It is a value type so that it can be part of a tunnelKey.
+type tlsOptions struct {
+	// If true, the tunnel connects to the remote server with TLS.
+	enabled bool
+	// The server name to verify the certificate of the remote server
+	// against, and to send in the SNI extension. Defaults to the host
+	// of the remote address.
+	serverName string
+	// The file of the PEM-encoded CA certificates to verify the remote
+	// server's certificate. Defaults to the system's.
+	caCert string
+	// The files of the PEM-encoded client certificate and its key.
+	cert string
+	key  string
+	// If true, the remote server's certificate is not verified.
+	insecure bool
+}
+
+// config returns the TLS configuration for the options, to connect to
+// a remote server on host.
+func (o tlsOptions) config(host string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         o.serverName,
+		InsecureSkipVerify: o.insecure,
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+
+	if o.caCert != "" {
+		b, err := ioutil.ReadFile(cleanPath(o.caCert))
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA certificates")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no CA certificate found in %s", o.caCert)
+		}
+		conf.RootCAs = pool
+	}
+
+	if o.cert != "" || o.key != "" {
+		if o.cert == "" || o.key == "" {
+			return nil, errors.New("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cleanPath(o.cert), cleanPath(o.key))
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/internal/testutils"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTLSEchoServer starts a TLS server with a self-signed certificate
+// for name, that echoes the data it receives. It returns its listener
+// and the path of its PEM-encoded certificate, written in dir.
+func startTLSEchoServer(t *testing.T, dir, name string) (net.Listener, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l, certFile
+}
+
+func TestGetTunnelAddrTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, caCert := startTLSEchoServer(t, dir, "redis.example")
+	defer l.Close()
+
+	// the SSH client connects to the TLS server whatever the address
+	sshClient := &testutils.MockSSHClient{
+		DialFunc: func(i int, n, a string) (net.Conn, error) {
+			return net.Dial("tcp", l.Addr().String())
+		},
+	}
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		return sshClient, nil
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	cases := []struct {
+		opts []string
+		err  string // if empty, the address is expected
+	}{
+		{[]string{"tls"}, "TLS "},
+		{[]string{"cacert", caCert}, "TLS "},
+		{[]string{"cacert", filepath.Join(dir, "none.pem")}, "ERR invalid TLS options"},
+		{[]string{"cert", caCert}, "ERR invalid TLS options"},
+		{[]string{"servername"}, "ERR missing value"},
+		{[]string{"cacert", caCert, "servername", "redis.example"}, ""},
+		{[]string{"insecure"}, ""},
+	}
+
+	for _, c := range cases {
+		// the TLS connection is verified with WAIT
+		req := append([]string{"gettunneladdr", "root@127.0.0.1", "10.0.0.1:6379", "WAIT"}, c.opts...)
+		res, err := srv.execute(nil, req)
+		if err != nil {
+			t.Errorf("%v: want no error, got %v", c.opts, err)
+			continue
+		}
+
+		local, ok := res.(string)
+		if c.err != "" {
+			if e, isErr := res.(resp.Error); !isErr || !strings.HasPrefix(string(e), c.err) {
+				t.Errorf("%v: want error %q, got %#v", c.opts, c.err, res)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%v: want address, got %#v", c.opts, res)
+			continue
+		}
+
+		// the local side of the tunnel is in plain text
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			t.Errorf("%v: want no dial error, got %v", c.opts, err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Errorf("%v: want no write error, got %v", c.opts, err)
+		} else if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("%v: want ping, got %q and %v", c.opts, buf, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+)
+
+// maxTunnelExits is the number of stopped tunnels kept in the history.
+const maxTunnelExits = 100
+
+type tunnelHistoryCmd struct{}
+
+// tunnelExit is a stopped tunnel, with its status when it stopped.
+type tunnelExit struct {
+	id     string
+	key    tunnelKey
+	local  net.Addr
+	status tunnel.TunnelStatus
+	exited time.Time
+}
+
+// failed returns true if the tunnel stopped due to an error, rather
+// than being idle or killed.
+func (e *tunnelExit) failed() bool {
+	return e != nil && (e.status.ExitReason == tunnel.ExitDialError || e.status.ExitReason == tunnel.ExitServeError)
+}
+
+// tunnelExitInfo is the description of a stopped tunnel returned by
+// TUNNELHISTORY. The times are Unix timestamps in seconds.
+type tunnelExitInfo struct {
+	ID        string `resp:"id"`
+	User      string `resp:"user"`
+	SSHServer string `resp:"ssh_server"`
+	Remote    string `resp:"remote"`
+	Local     string `resp:"local"`
+	Reason    string `resp:"reason"`
+	Error     string `resp:"error"`
+	CreatedAt int64  `resp:"created_at"`
+	ExitedAt  int64  `resp:"exited_at"`
+	BytesIn   int64  `resp:"bytes_in"`
+	BytesOut  int64  `resp:"bytes_out"`
+}
+
+// TUNNELHISTORY [count]
+//
+// Replies with an array of the last stopped tunnels, the most recent
+// first, each one a map of its ID, user, SSH server, remote and local
+// addresses, the reason why it stopped (idle, killed, dial error or
+// serve error) and the error it stopped with, its creation and exit
+// times as Unix timestamps, and the numbers of bytes it forwarded. In
+// RESP2, the maps are flat arrays of keys and values.
+//
+// The history keeps the last 100 tunnels, count limits the reply to
+// the most recent ones.
+func (c tunnelHistoryCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if l := len(req); l < 1 || l > 2 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	count := maxTunnelExits
+	if len(req) == 2 {
+		n, err := strconv.Atoi(req[1])
+		if err != nil || n < 0 {
+			return resp.Error("ERR value is out of range, must be positive"), nil
+		}
+		count = n
+	}
+
+	s.mu.Lock()
+	exits := make([]*tunnelExit, 0, len(s.exits))
+	for i := len(s.exits) - 1; i >= 0 && len(exits) < count; i-- {
+		exits = append(exits, s.exits[i])
+	}
+	s.mu.Unlock()
+
+	infos := make([]tunnelExitInfo, 0, len(exits))
+	for _, e := range exits {
+		info := tunnelExitInfo{
+			ID:        e.id,
+			User:      e.key.User,
+			SSHServer: e.key.Server.String(),
+			Remote:    e.key.Remote.String(),
+			Reason:    e.status.ExitReason,
+			CreatedAt: e.status.Created.Unix(),
+			ExitedAt:  e.exited.Unix(),
+			BytesIn:   e.status.BytesIn,
+			BytesOut:  e.status.BytesOut,
+		}
+		if e.local != nil {
+			info.Local = e.local.String()
+		}
+		if e.status.Err != nil {
+			info.Error = e.status.Err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// reapTunnel removes the stopped tunnel with that key and ID from the
+// tunnels of the Server, unless it was already replaced, and records
+// why it stopped in the history.
+func (s *Server) reapTunnel(key tunnelKey, id string, tun *tunnel.Tunnel) {
+	exit := &tunnelExit{id: id, key: key, local: tun.Local, status: tun.Status(), exited: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tunnels[key] == tun {
+		delete(s.tunnels, key)
+		delete(s.hostKeys, key)
+		delete(s.ids, key)
+	}
+	if len(s.exits) == maxTunnelExits {
+		copy(s.exits, s.exits[1:])
+		s.exits = s.exits[:len(s.exits)-1]
+	}
+	s.exits = append(s.exits, exit)
+}
+
+// lastTunnelExit returns the last stopped tunnel with that key, or nil
+// if there is none in the history.
+func (s *Server) lastTunnelExit(key tunnelKey) *tunnelExit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.exits) - 1; i >= 0; i-- {
+		if s.exits[i].key == key {
+			return s.exits[i]
+		}
+	}
+	return nil
+}
+
+// withPreviousFailure appends the reason why the previous tunnel failed
+// to the reply if it is a generic error, so that the client knows why
+// the tunnel it used stopped.
+func withPreviousFailure(reply interface{}, prev *tunnelExit) interface{} {
+	e, ok := reply.(resp.Error)
+	if !ok || !prev.failed() || !strings.HasPrefix(string(e), "ERR ") {
+		return reply
+	}
+	return resp.Error(fmt.Sprintf("%s (previous tunnel %s stopped on %s: %v)", e, prev.id, prev.status.ExitReason, prev.status.Err))
+}
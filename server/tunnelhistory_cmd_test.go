@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/internal/testutils"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/pkg/errors"
+)
+
+func TestTunnelHistory(t *testing.T) {
+	defer setAndDeferSSHDial(mockSSHDial(&testutils.MockSSHClient{}))()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+	srv.TunnelIdleTimeout = 20 * time.Millisecond
+
+	history := func() []tunnelExitInfo {
+		res, err := srv.execute(nil, []string{"tunnelhistory"})
+		exits, ok := res.([]tunnelExitInfo)
+		if !ok || err != nil {
+			t.Fatalf("want history, got %#v and %v", res, err)
+		}
+		return exits
+	}
+	if exits := history(); len(exits) != 0 {
+		t.Fatalf("want empty history, got %#v", exits)
+	}
+
+	// killed tunnel
+	if res, _ := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000"}); res == nil {
+		t.Fatal("want address, got nil")
+	}
+	srv.execute(nil, []string{"killtunnel", "root@127.0.0.1", "remote:7000"})
+	res, _ := srv.execute(nil, []string{"listtunnels"})
+	if infos := res.([]tunnelInfo); len(infos) != 0 {
+		t.Errorf("want killed tunnel to be removed, got %#v", infos)
+	}
+	exits := history()
+	if len(exits) != 1 || exits[0].ID != "1" || exits[0].Remote != "remote:7000" || exits[0].Reason != tunnel.ExitKilled {
+		t.Errorf("want killed tunnel 1, got %#v", exits)
+	}
+
+	// idle tunnel
+	srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7001"})
+	deadline := time.Now().Add(time.Second)
+	for len(history()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	exits = history()
+	if len(exits) != 2 || exits[0].ID != "2" || exits[0].Reason != tunnel.ExitIdle {
+		t.Errorf("want idle tunnel 2 first, got %#v", exits)
+	}
+	res, _ = srv.execute(nil, []string{"listtunnels"})
+	if infos := res.([]tunnelInfo); len(infos) != 0 {
+		t.Errorf("want idle tunnel to be removed, got %#v", infos)
+	}
+
+	// limited by count
+	res, _ = srv.execute(nil, []string{"tunnelhistory", "1"})
+	if exits := res.([]tunnelExitInfo); len(exits) != 1 || exits[0].ID != "2" {
+		t.Errorf("want tunnel 2 only, got %#v", exits)
+	}
+	res, _ = srv.execute(nil, []string{"tunnelhistory", "-1"})
+	if _, ok := res.(resp.Error); !ok {
+		t.Errorf("want error for negative count, got %#v", res)
+	}
+}
+
+func TestTunnelHistoryDialError(t *testing.T) {
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		return nil, errors.New("connection refused")
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	// INTERACTIVE waits for the SSH connection and reports its errors
+	req := []string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "INTERACTIVE"}
+	res, _ := srv.execute(nil, req)
+	if e, ok := res.(resp.Error); !ok || !strings.Contains(string(e), "connection refused") || strings.Contains(string(e), "previous") {
+		t.Errorf("want dial error, got %#v", res)
+	}
+
+	// the next request reports why the previous tunnel failed
+	res, _ = srv.execute(nil, req)
+	want := "(previous tunnel 1 stopped on dial error: connection refused)"
+	if e, ok := res.(resp.Error); !ok || !strings.HasSuffix(string(e), want) {
+		t.Errorf("want error ending with %q, got %#v", want, res)
+	}
+
+	res, _ = srv.execute(nil, []string{"tunnelhistory"})
+	exits := res.([]tunnelExitInfo)
+	if len(exits) != 2 || exits[0].Reason != tunnel.ExitDialError || exits[0].Error != "connection refused" {
+		t.Errorf("want dial errors, got %#v", exits)
+	}
+}
+
+func TestTunnelHistoryBounded(t *testing.T) {
+	srv := newStartedServer(context.Background(), &MetaConfig{})
+	key := tunnelKey{User: "root", Remote: addr.HostPortAddr{Host: "remote", Port: 7000}}
+	for i := 1; i <= maxTunnelExits+10; i++ {
+		srv.reapTunnel(key, strconv.Itoa(i), &tunnel.Tunnel{})
+	}
+
+	res, _ := srv.execute(nil, []string{"tunnelhistory"})
+	exits := res.([]tunnelExitInfo)
+	if len(exits) != maxTunnelExits {
+		t.Fatalf("want %d tunnels, got %d", maxTunnelExits, len(exits))
+	}
+	if first, last := exits[0].ID, exits[len(exits)-1].ID; first != strconv.Itoa(maxTunnelExits+10) || last != "11" {
+		t.Errorf("want tunnels %d to 11, got %s to %s", maxTunnelExits+10, first, last)
+	}
+	if prev := srv.lastTunnelExit(key); prev == nil || prev.id != strconv.Itoa(maxTunnelExits+10) {
+		t.Errorf("want last tunnel, got %#v", prev)
+	}
+}
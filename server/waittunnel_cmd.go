@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/harfangapps/regis-companion/addr"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+
+	"github.com/pkg/errors"
+)
+
+// defaultWaitTimeout is the timeout of WAIT and WAITTUNNEL without an
+// explicit one.
+const defaultWaitTimeout = 30 * time.Second
+
+type waitTunnelCmd struct{}
+
+// WAITTUNNEL [user@]ssh.server.host[:port] remote.server.host:port|unix:/remote/socket/path [timeout]
+// WAITTUNNEL id [timeout]
+//
+// Waits until the tunnels to the remote server via the SSH server, with
+// any options, or the tunnel with that ID as returned by LISTTUNNELS,
+// are ready: their SSH connection is established and a test connection
+// to the remote server succeeds. The reply is the local address of the
+// tunnel, the most recent one if there are several, or an error in the
+// form:
+//
+//	category reason
+//
+// where category is AUTH if the SSH authentication failed, NETWORK if
+// the SSH server could not be reached, and REMOTE if the remote server
+// could not be reached via the SSH server. Host key and TLS errors are
+// reported as by GETTUNNELADDR.
+//
+// The timeout is in seconds, 30 by default, and 0 waits indefinitely.
+// A timeout is reported as a NETWORK error if the SSH connection is not
+// established, as a REMOTE error otherwise.
+func (c waitTunnelCmd) Execute(cmdName string, req []string, s *Server) (interface{}, error) {
+	if l := len(req); l < 2 || l > 4 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for %v", cmdName)), nil
+	}
+
+	// WAITTUNNEL id timeout has the same number of arguments as
+	// WAITTUNNEL server remote, but the remote address is never a number
+	args, timeout := req[1:], defaultWaitTimeout
+	if len(args) == 3 || (len(args) == 2 && isNumber(args[1])) {
+		var err error
+		if timeout, err = parseTimeout(args[len(args)-1]); err != nil {
+			return resp.Error(fmt.Sprintf("ERR %v", err)), nil
+		}
+		args = args[:len(args)-1]
+	}
+
+	var entries []tunnelEntry
+	if len(args) == 1 {
+		for _, e := range s.listTunnels() {
+			if e.id == args[0] {
+				entries = append(entries, e)
+			}
+		}
+		if len(entries) == 0 {
+			return resp.Error(fmt.Sprintf("ERR no tunnel with ID %v", args[0])), nil
+		}
+	} else {
+		host, err := s.MetaConfig.ResolveHost(args[0], "")
+		if err != nil {
+			return resp.Error(fmt.Sprintf("ERR invalid SSH server address: %s", err)), nil
+		}
+		remoteAddr, err := addr.ParseRemoteAddr(args[1])
+		if err != nil {
+			return resp.Error(fmt.Sprintf("ERR invalid remote server address: %s", err)), nil
+		}
+		for _, e := range s.listTunnels() {
+			if e.key.User == host.User && e.key.Server == host.Addr && e.key.Remote == remoteAddr {
+				entries = append(entries, e)
+			}
+		}
+		if len(entries) == 0 {
+			return resp.Error(fmt.Sprintf("ERR no tunnel to %v via %v", args[1], args[0])), nil
+		}
+	}
+
+	// the entries are sorted by ID, the most recent is last
+	var reply interface{}
+	for _, e := range entries {
+		s.mu.Lock()
+		check := s.hostKeys[e.key]
+		s.mu.Unlock()
+
+		reply = s.waitReady(e.tun, check, timeout)
+		if _, ok := reply.(resp.Error); ok {
+			break
+		}
+	}
+	return reply, nil
+}
+
+// isNumber returns true if s is a decimal number.
+func isNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// parseTimeout parses a timeout in seconds, that may have a decimal
+// part.
+func parseTimeout(s string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || secs < 0 || math.IsInf(secs, 0) || math.IsNaN(secs) || secs > math.MaxInt64/float64(time.Second) {
+		return 0, errors.New("timeout is not a float or out of range")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// waitReady waits until the SSH connection of tun is established and a
+// test connection to its remote server succeeds, for at most timeout if
+// it is not 0. The verification of the host keys is reported to check.
+// It returns the reply to send to the client: the tunnel's local
+// address, or a categorized error.
+func (s *Server) waitReady(tun *tunnel.Tunnel, check *hostKeyCheck, timeout time.Duration) interface{} {
+	done := make(chan struct{})
+	defer close(done)
+
+	var dialed int32
+	ready := make(chan interface{}, 1)
+	go func() {
+		if err := tun.WaitDialed(done); err != nil {
+			if herr := check.hostKeyError(); herr != nil {
+				ready <- s.hostKeyErrorReply(herr)
+				return
+			}
+			ready <- s.readyErrorReply(err, "NETWORK")
+			return
+		}
+		atomic.StoreInt32(&dialed, 1)
+
+		// open a test connection to the remote server
+		conn, err := tun.DialRemote()
+		if err != nil {
+			ready <- s.readyErrorReply(err, "REMOTE")
+			return
+		}
+		conn.Close()
+		ready <- tun.Local.String()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case reply := <-ready:
+		return reply
+	case <-expired:
+		category := "NETWORK"
+		if atomic.LoadInt32(&dialed) == 1 {
+			category = "REMOTE"
+		}
+		return resp.Error(fmt.Sprintf("%s timeout after %v waiting for the tunnel", category, timeout))
+	}
+}
+
+// readyErrorReply returns the error reply for a tunnel that is not ready
+// due to err, in the category unless it is an authentication, host key
+// or TLS error.
+func (s *Server) readyErrorReply(err error, category string) resp.Error {
+	switch cause := errors.Cause(err).(type) {
+	case *HostKeyError:
+		return s.hostKeyErrorReply(cause)
+	case *tunnel.TLSError:
+		return resp.Error(fmt.Sprintf("TLS %v", cause.Err))
+	case net.Error:
+		// keep the category, network errors on the remote server side
+		// are remote errors
+	default:
+		if cause == tunnel.ErrWaitAborted {
+			return resp.Error(fmt.Sprintf("ERR failed to start tunnel: %v", err))
+		}
+		if isAuthError(cause) {
+			category = "AUTH"
+		}
+	}
+	return resp.Error(fmt.Sprintf("%s %v", category, err))
+}
+
+// isAuthError returns true if err is an SSH authentication failure.
+func isAuthError(err error) bool {
+	// the ssh package does not export a type for those errors
+	return err == errAuthChallengeTimeout || strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/internal/testutils"
+	"github.com/harfangapps/regis-companion/resp"
+	"github.com/harfangapps/regis-companion/tunnel"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/pkg/errors"
+)
+
+func TestWaitTunnelReady(t *testing.T) {
+	sshClient := &testutils.MockSSHClient{
+		DialFunc: func(i int, n, addr string) (net.Conn, error) {
+			return &testutils.MockConn{}, nil
+		},
+	}
+	defer setAndDeferSSHDial(mockSSHDial(sshClient))()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	res, _ := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "WAIT"})
+	addr, ok := res.(string)
+	if !ok {
+		t.Fatalf("want address, got %#v", res)
+	}
+	if n := sshClient.DialCalls(); n != 1 {
+		t.Errorf("want a test connection to the remote server, got %d", n)
+	}
+
+	cases := [][]string{
+		{"waittunnel", "1"},
+		{"waittunnel", "1", "0.5"},
+		{"waittunnel", "root@127.0.0.1", "remote:7000"},
+		{"waittunnel", "root@127.0.0.1", "remote:7000", "0"},
+		{"gettunneladdr", "root@127.0.0.1", "remote:7000", "wait", "1"},
+	}
+	for _, c := range cases {
+		if res, _ := srv.execute(nil, c); res != addr {
+			t.Errorf("%v: want %v, got %#v", c, addr, res)
+		}
+	}
+}
+
+func TestWaitTunnelErrors(t *testing.T) {
+	authErr := errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain")
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nohost"}}
+
+	cases := []struct {
+		dialErr   error // error of the SSH dial
+		remoteErr error // error of the test connection
+		want      string
+	}{
+		{dialErr: authErr, want: "AUTH " + authErr.Error()},
+		{dialErr: dnsErr, want: "NETWORK " + dnsErr.Error()},
+		{dialErr: errors.New("ssh: handshake failed: EOF"), want: "NETWORK ssh: handshake failed: EOF"},
+		{remoteErr: &ssh.OpenChannelError{Reason: ssh.ConnectionFailed, Message: "Connection refused"}, want: "REMOTE ssh: rejected: connect failed (Connection refused)"},
+		{remoteErr: &tunnel.TLSError{Err: errors.New("bad certificate")}, want: "TLS bad certificate"},
+	}
+	for _, c := range cases {
+		t.Run(c.want, func(t *testing.T) {
+			sshClient := &testutils.MockSSHClient{
+				DialFunc: func(i int, n, addr string) (net.Conn, error) {
+					if c.remoteErr != nil {
+						return nil, c.remoteErr
+					}
+					return &testutils.MockConn{}, nil
+				},
+			}
+			defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+				if c.dialErr != nil {
+					return nil, c.dialErr
+				}
+				return sshClient, nil
+			})()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+			res, _ := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "WAIT"})
+			if res != resp.Error(c.want) {
+				t.Errorf("want %q, got %#v", c.want, res)
+			}
+		})
+	}
+}
+
+func TestWaitTunnelTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (tunnel.DialCloser, error) {
+		<-release
+		return nil, errors.New("released")
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	start := time.Now()
+	res, _ := srv.execute(nil, []string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "WAIT", "0.05"})
+	want := "NETWORK timeout after 50ms waiting for the tunnel"
+	if res != resp.Error(want) {
+		t.Errorf("want %q, got %#v", want, res)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("want timeout of 50ms, got %v", d)
+	}
+
+	// the tunnel is still starting, it can be waited for again
+	res, _ = srv.execute(nil, []string{"waittunnel", "1", "0.01"})
+	want = "NETWORK timeout after 10ms waiting for the tunnel"
+	if res != resp.Error(want) {
+		t.Errorf("want %q, got %#v", want, res)
+	}
+
+	// wait for the tunnel to stop before restoring the dial function
+	close(release)
+	srv.execute(nil, []string{"killtunnel", "1"})
+}
+
+func TestWaitTunnelInvalid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newStartedServer(ctx, &MetaConfig{KnownHostsFile: "/dev/null"})
+
+	cases := []struct {
+		req  []string
+		want string
+	}{
+		{[]string{"waittunnel"}, "ERR wrong number of arguments for waittunnel"},
+		{[]string{"waittunnel", "a", "b", "c", "d"}, "ERR wrong number of arguments for waittunnel"},
+		{[]string{"waittunnel", "1"}, "ERR no tunnel with ID 1"},
+		{[]string{"waittunnel", "1", "-1"}, "ERR timeout is not a float or out of range"},
+		{[]string{"waittunnel", "root@127.0.0.1", "remote:7000", "x"}, "ERR timeout is not a float or out of range"},
+		{[]string{"waittunnel", "root@127.0.0.1", "remote:7000"}, "ERR no tunnel to remote:7000 via root@127.0.0.1"},
+		{[]string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "wait", "inf"}, "ERR timeout is not a float or out of range"},
+		{[]string{"gettunneladdr", "root@127.0.0.1", "remote:7000", "interactive", "wait"}, "ERR WAIT and INTERACTIVE options are mutually exclusive"},
+	}
+	for _, c := range cases {
+		if res, _ := srv.execute(nil, c.req); res != resp.Error(c.want) {
+			t.Errorf("%v: want %q, got %#v", c.req, c.want, res)
+		}
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{"0", 0, false},
+		{"1", time.Second, false},
+		{"0.25", 250 * time.Millisecond, false},
+		{"-1", 0, true},
+		{"NaN", 0, true},
+		{"1e300", 0, true},
+		{"abc", 0, true},
+	}
+	for _, c := range cases {
+		got, err := parseTimeout(c.in)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("%s: want %v and error %t, got %v and %v", c.in, c.want, c.err, got, err)
+		}
+	}
+}
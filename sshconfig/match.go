@@ -0,0 +1,124 @@
+package sshconfig
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// patternList is a list of host patterns, some of which may be negated
+// with a leading '!'. It matches if at least one non-negated pattern
+// matches and none of the negated ones do.
+type patternList []string
+
+func (l patternList) matches(s string) bool {
+	var found bool
+	for _, p := range l {
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+		if !matchPattern(strings.ToLower(p), strings.ToLower(s)) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// matchPattern matches s against a pattern that may contain the '*' and
+// '?' wildcards.
+func matchPattern(pattern, s string) bool {
+	// path.Match supports more than '*' and '?', escape the rest.
+	r := strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`)
+	ok, err := path.Match(r.Replace(pattern), s)
+	if err != nil {
+		return false
+	}
+	// path.Match does not let '*' match a '/', which is not valid in a
+	// host name anyway.
+	return ok
+}
+
+// hostCondition is the condition of a Host block, the patterns are
+// matched against the original host name.
+type hostCondition patternList
+
+func (c hostCondition) match(ctx *matchContext) bool {
+	return patternList(c).matches(ctx.originalHost)
+}
+
+// matchCondition is the condition of a Match block, all criteria must
+// match.
+type matchCondition []matchCriterion
+
+func (c matchCondition) match(ctx *matchContext) bool {
+	for _, crit := range c {
+		if crit.match(ctx) == crit.negated {
+			return false
+		}
+	}
+	return true
+}
+
+type matchCriterion struct {
+	name     string
+	negated  bool
+	patterns patternList
+}
+
+func (c matchCriterion) match(ctx *matchContext) bool {
+	switch c.name {
+	case "all", "final":
+		// there is a single pass over the configuration, so it is
+		// always the final one.
+		return true
+	case "host":
+		return c.patterns.matches(ctx.host)
+	case "originalhost":
+		return c.patterns.matches(ctx.originalHost)
+	case "user":
+		return c.patterns.matches(ctx.user)
+	case "localuser":
+		return c.patterns.matches(os.Getenv("USER"))
+	default:
+		// canonical never matches as host names are not canonicalized,
+		// and exec is not supported so it never matches either.
+		return false
+	}
+}
+
+// parseMatch parses the arguments of a Match directive.
+func parseMatch(args []string) (matchCondition, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing Match criteria")
+	}
+
+	var cond matchCondition
+	for i := 0; i < len(args); i++ {
+		crit := matchCriterion{name: strings.ToLower(args[i])}
+		if strings.HasPrefix(crit.name, "!") {
+			crit.negated = true
+			crit.name = crit.name[1:]
+		}
+
+		switch crit.name {
+		case "all", "canonical", "final":
+			// no argument
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing argument for Match %s", crit.name)
+			}
+			i++
+			crit.patterns = patternList(strings.Split(args[i], ","))
+		default:
+			return nil, fmt.Errorf("unsupported Match criteria %q", args[i])
+		}
+		cond = append(cond, crit)
+	}
+	return cond, nil
+}
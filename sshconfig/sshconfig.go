@@ -0,0 +1,380 @@
+// Package sshconfig implements a parser for OpenSSH client configuration
+// files, as described in ssh_config(5).
+//
+// Only the subset of the format required to resolve host aliases is
+// supported: Host and Match blocks, Include directives and the standard
+// "first obtained value wins" evaluation rule. Keywords are not validated,
+// they are stored as-is and can be queried on the resolved Host.
+package sshconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth is the maximum nesting of Include directives, as in
+// OpenSSH.
+const maxIncludeDepth = 16
+
+// multiValued lists the keywords that accumulate their values instead
+// of keeping only the first obtained one.
+var multiValued = map[string]bool{
+	"identityfile":    true,
+	"certificatefile": true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"dynamicforward":  true,
+	"sendenv":         true,
+	"setenv":          true,
+}
+
+// Config is a parsed OpenSSH client configuration.
+type Config struct {
+	blocks []*block
+}
+
+// a block is a list of options that apply if all its conditions match.
+type block struct {
+	conds []condition
+	opts  []option
+}
+
+type option struct {
+	key  string
+	args []string
+}
+
+// condition is a Host or Match criterion.
+type condition interface {
+	match(ctx *matchContext) bool
+}
+
+// matchContext holds the values against which conditions are evaluated.
+type matchContext struct {
+	originalHost string
+	host         string
+	user         string
+}
+
+// ParseFile parses the OpenSSH client configuration file at path. Include
+// directives with a relative path are resolved relative to the directory
+// of that file. A missing file is not an error, it returns an empty
+// configuration.
+func ParseFile(path string) (*Config, error) {
+	var c Config
+	p := parser{dir: filepath.Dir(path)}
+	if err := p.parseFile(&c, path, nil, 0, true); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Parse parses an OpenSSH client configuration from r. Include directives
+// with a relative path are resolved relative to the current directory.
+func Parse(r io.Reader) (*Config, error) {
+	var c Config
+	p := parser{dir: "."}
+	if err := p.parse(&c, r, "", nil, 0); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+type parser struct {
+	dir string
+}
+
+func (p *parser) parseFile(c *Config, path string, conds []condition, depth int, ignoreMissing bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if ignoreMissing && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return p.parse(c, f, path, conds, depth)
+}
+
+func (p *parser) parse(c *Config, r io.Reader, name string, conds []condition, depth int) error {
+	cur := &block{conds: conds}
+	c.blocks = append(c.blocks, cur)
+
+	s := bufio.NewScanner(r)
+	var lineno int
+	for s.Scan() {
+		lineno++
+		key, args, err := splitLine(s.Text())
+		if err != nil {
+			return fmt.Errorf("sshconfig: %s:%d: %v", name, lineno, err)
+		}
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			if len(args) == 0 {
+				return fmt.Errorf("sshconfig: %s:%d: missing Host pattern", name, lineno)
+			}
+			cur = &block{conds: withCondition(conds, hostCondition(args))}
+			c.blocks = append(c.blocks, cur)
+
+		case "match":
+			cond, err := parseMatch(args)
+			if err != nil {
+				return fmt.Errorf("sshconfig: %s:%d: %v", name, lineno, err)
+			}
+			cur = &block{conds: withCondition(conds, cond)}
+			c.blocks = append(c.blocks, cur)
+
+		case "include":
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("sshconfig: %s:%d: too many nested includes", name, lineno)
+			}
+			for _, arg := range args {
+				if err := p.include(c, arg, cur.conds, depth+1); err != nil {
+					return err
+				}
+			}
+			// options after the Include still belong to the current block,
+			// but must come after the included ones.
+			cur = &block{conds: cur.conds}
+			c.blocks = append(c.blocks, cur)
+
+		default:
+			cur.opts = append(cur.opts, option{key: key, args: args})
+		}
+	}
+	return s.Err()
+}
+
+func (p *parser) include(c *Config, pattern string, conds []condition, depth int) error {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.dir, pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := p.parseFile(c, file, conds, depth, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func withCondition(conds []condition, cond condition) []condition {
+	res := make([]condition, len(conds), len(conds)+1)
+	copy(res, conds)
+	return append(res, cond)
+}
+
+// splitLine splits a configuration line into its lowercased keyword and
+// its arguments. It returns an empty keyword for blank lines and comments.
+func splitLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	// the keyword may be separated from its arguments by whitespace
+	// and/or a single '='.
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	key := strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	args, err := splitArgs(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, args, nil
+}
+
+// splitArgs splits s on whitespace, honoring double-quoted arguments.
+// A '#' starting an argument begins a trailing comment.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" || s[0] == '#' {
+			return args, nil
+		}
+
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted argument")
+			}
+			args = append(args, s[1:end+1])
+			s = s[end+2:]
+			continue
+		}
+
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		args = append(args, s[:end])
+		s = s[end:]
+	}
+}
+
+// Lookup returns the settings that apply to the host alias, with user
+// being the user explicitly requested for the connection, if any.
+func (c *Config) Lookup(alias, user string) *Host {
+	h := &Host{Alias: alias, values: make(map[string][]string)}
+
+	ctx := &matchContext{originalHost: alias, host: alias, user: user}
+	for _, b := range c.blocks {
+		if !b.matches(ctx) {
+			continue
+		}
+		for _, opt := range b.opts {
+			h.set(opt.key, opt.args)
+
+			// Match conditions that follow see the values obtained so far
+			switch opt.key {
+			case "hostname":
+				ctx.host = h.HostName()
+			case "user":
+				if user == "" {
+					ctx.user = h.Get("user")
+				}
+			}
+		}
+	}
+	return h
+}
+
+func (b *block) matches(ctx *matchContext) bool {
+	for _, cond := range b.conds {
+		if !cond.match(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// Host holds the settings that apply to a host alias.
+type Host struct {
+	// Alias is the host name as requested, before HostName is applied.
+	Alias string
+
+	values map[string][]string
+}
+
+func (h *Host) set(key string, args []string) {
+	if multiValued[key] {
+		h.values[key] = append(h.values[key], strings.Join(args, " "))
+		return
+	}
+	if _, ok := h.values[key]; ok {
+		return
+	}
+	h.values[key] = []string{strings.Join(args, " ")}
+}
+
+// Get returns the value of the keyword, or an empty string if it is not set.
+// The keyword is case-insensitive.
+func (h *Host) Get(key string) string {
+	vals := h.values[strings.ToLower(key)]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// GetAll returns all values of a multi-valued keyword such as IdentityFile.
+// The keyword is case-insensitive.
+func (h *Host) GetAll(key string) []string {
+	return h.values[strings.ToLower(key)]
+}
+
+// HostName returns the real host name to connect to, which is the
+// HostName setting with the %h token expanded, or the Alias if HostName
+// is not set.
+func (h *Host) HostName() string {
+	hn := h.Get("hostname")
+	if hn == "" {
+		return h.Alias
+	}
+	return expandTokens(hn, map[byte]string{'h': h.Alias})
+}
+
+// IdentityFiles returns the paths of the identity files, with ~ and the
+// %d, %h, %r, %u and %% tokens expanded. The user is the remote user
+// name to use for %r.
+func (h *Host) IdentityFiles(user string) []string {
+	files := h.GetAll("identityfile")
+	if len(files) == 0 {
+		return nil
+	}
+
+	home, _ := os.UserHomeDir() // ignore error, expands to empty
+	tokens := map[byte]string{
+		'd': home,
+		'h': h.HostName(),
+		'r': user,
+		'u': os.Getenv("USER"),
+	}
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.EqualFold(f, "none") {
+			continue
+		}
+		res = append(res, expandHome(expandTokens(f, tokens)))
+	}
+	return res
+}
+
+// expandTokens replaces the %x tokens in s with their value in tokens.
+// %% is replaced by a single %, and unknown tokens are left untouched.
+func expandTokens(s string, tokens map[byte]string) string {
+	if strings.IndexByte(s, '%') < 0 {
+		return s
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i == len(s)-1 {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		if s[i] == '%' {
+			buf.WriteByte('%')
+			continue
+		}
+		if v, ok := tokens[s[i]]; ok {
+			buf.WriteString(v)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,183 @@
+package sshconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+# global comment
+Host bastion
+    HostName 10.0.0.1
+    User admin
+    Port 2222
+    IdentityFile ~/.ssh/bastion_key
+
+Host *.internal !db.internal
+    User internal
+    IdentityFile=%d/.ssh/%r@%h
+
+Host alias-*
+    HostName %h.example.com
+
+Match host *.example.com
+    Port 2200
+
+Match originalhost alias-b user bob
+    User carol
+
+Host "quoted"
+    HostName "10.0.0.2"   # trailing comment
+
+Host *
+    User default
+    IdentityFile ~/.ssh/id_rsa
+`
+
+func TestLookup(t *testing.T) {
+	conf, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		alias, user string
+		hostName    string
+		wantUser    string
+		port        string
+		identities  int
+	}{
+		{"bastion", "", "10.0.0.1", "admin", "2222", 2},
+		{"bastion", "me", "10.0.0.1", "admin", "2222", 2},
+		{"web.internal", "", "web.internal", "internal", "", 2},
+		{"db.internal", "", "db.internal", "default", "", 1},
+		{"alias-a", "", "alias-a.example.com", "default", "2200", 1},
+		{"alias-b", "bob", "alias-b.example.com", "carol", "2200", 1},
+		{"alias-b", "alice", "alias-b.example.com", "default", "2200", 1},
+		{"quoted", "", "10.0.0.2", "default", "", 1},
+		{"other", "", "other", "default", "", 1},
+	}
+
+	for _, c := range cases {
+		h := conf.Lookup(c.alias, c.user)
+		if got := h.HostName(); got != c.hostName {
+			t.Errorf("%s: want HostName %q, got %q", c.alias, c.hostName, got)
+		}
+		if got := h.Get("user"); got != c.wantUser {
+			t.Errorf("%s: want User %q, got %q", c.alias, c.wantUser, got)
+		}
+		if got := h.Get("Port"); got != c.port {
+			t.Errorf("%s: want Port %q, got %q", c.alias, c.port, got)
+		}
+		if got := h.IdentityFiles(c.user); len(got) != c.identities {
+			t.Errorf("%s: want %d identity files, got %v", c.alias, c.identities, got)
+		}
+	}
+}
+
+func TestIdentityFilesTokens(t *testing.T) {
+	conf, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	h := conf.Lookup("web.internal", "")
+	got := h.IdentityFiles("bob")
+	want := []string{
+		filepath.Join(home, ".ssh/bob@web.internal"),
+		filepath.Join(home, ".ssh/id_rsa"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config": `
+Host inc
+    Include conf.d/*.conf
+    Port 22
+
+Host *
+    Port 1234
+`,
+		"conf.d/a.conf": `
+HostName included.example.com
+Host other
+    HostName other.example.com
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf, err := ParseFile(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := conf.Lookup("inc", "")
+	if got := h.HostName(); got != "included.example.com" {
+		t.Errorf("want included HostName, got %q", got)
+	}
+	if got := h.Get("port"); got != "22" {
+		t.Errorf("want Port 22, got %q", got)
+	}
+
+	// the Host block of the included file only applies within the
+	// enclosing Host block.
+	h = conf.Lookup("other", "")
+	if got := h.HostName(); got != "other" {
+		t.Errorf("want HostName other, got %q", got)
+	}
+	if got := h.Get("port"); got != "1234" {
+		t.Errorf("want Port 1234, got %q", got)
+	}
+}
+
+func TestParseFileMissing(t *testing.T) {
+	conf, err := ParseFile("/does/not/exist")
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if got := conf.Lookup("a", "").HostName(); got != "a" {
+		t.Errorf("want HostName a, got %q", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []string{
+		"Host",
+		"Match",
+		"Match host",
+		"Match unknown x",
+		`User "unterminated`,
+	}
+	for _, c := range cases {
+		if _, err := Parse(strings.NewReader(c)); err == nil {
+			t.Errorf("%q: want error, got nil", c)
+		}
+	}
+}
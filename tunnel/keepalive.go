@@ -0,0 +1,388 @@
+package tunnel
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	keepaliveRequest = "keepalive@openssh.com"
+
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+
+	// maximum duration a Dial waits for the SSH client to reconnect
+	reconnectDialWait = 30 * time.Second
+)
+
+var (
+	errKeepaliveTimeout = errors.New("keepalive timeout")
+	errConnClosed       = errors.New("ssh connection closed")
+	errReconnecting     = errors.New("ssh connection is reconnecting")
+	errClientClosed     = errors.New("ssh client closed")
+)
+
+// keepaliveTicker returns the channel of the ticks of the keepalive
+// requests sent every d, and the function that stops them. It is a
+// variable so that it can be mocked for tests.
+var keepaliveTicker = func(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// reconnectAfter returns a channel that receives once the backoff d
+// before the next reconnection attempt has elapsed. It is a variable so
+// that it can be mocked for tests.
+var reconnectAfter = time.After
+
+// requestSender is implemented by the SSH clients that can send global
+// requests, such as *ssh.Client.
+type requestSender interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+}
+
+// waiter is implemented by the SSH clients that can wait for their
+// connection to terminate, such as *ssh.Client.
+type waiter interface {
+	Wait() error
+}
+
+// failer is implemented by the SSH clients that can fail permanently,
+// such as the liveClient that stops reconnecting.
+type failer interface {
+	// Failed returns a channel that is closed when the client failed.
+	Failed() <-chan struct{}
+	// Err returns the error of the client, once it failed.
+	Err() error
+}
+
+// ClientStatus describes the health of an SSH client.
+type ClientStatus struct {
+	// Reconnects is the number of times the SSH client was reconnected.
+	Reconnects int
+	// LastFailure is the error that caused the last reconnection or
+	// reconnection attempt, if any.
+	LastFailure error
+	// LastFailureAt is the time of the LastFailure.
+	LastFailureAt time.Time
+}
+
+// liveClient is a DialCloser that monitors its SSH client with keepalive
+// requests, and redials it with backoff when its connection is dead.
+// Dials wait for the reconnection, so that it is transparent to the
+// listener of the Tunnel.
+type liveClient struct {
+	dial      func(ctx context.Context) (DialCloser, error)
+	interval  time.Duration
+	countMax  int
+	permanent func(err error) bool
+	stats     *expvar.Map
+
+	// the context of the dials, cancelled on Close
+	ctx    context.Context
+	cancel func()
+	closed chan struct{}
+	failed chan struct{} // closed when the reconnection failed permanently
+	wg     sync.WaitGroup
+
+	// protects the following fields
+	mu       sync.Mutex
+	client   DialCloser    // nil while reconnecting
+	gen      int           // incremented each time client is set
+	ready    chan struct{} // closed when client is set
+	broken   chan error    // signals that client is dead
+	err      error         // the permanent failure, once failed is closed
+	isClosed bool
+	status   ClientStatus
+}
+
+// newLiveClient dials the SSH client and starts monitoring it. If
+// interval is zero, no keepalive is sent and the connection is only
+// considered dead when it is closed. The context passed to dial is
+// cancelled when the liveClient is closed. If permanent is not nil and
+// returns true for a reconnection error, the liveClient stops
+// reconnecting and fails with that error.
+func newLiveClient(dial func(ctx context.Context) (DialCloser, error), interval time.Duration, countMax int, permanent func(err error) bool, stats *expvar.Map) (*liveClient, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := dial(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if countMax < 1 {
+		countMax = 1
+	}
+
+	c := &liveClient{
+		dial:      dial,
+		interval:  interval,
+		countMax:  countMax,
+		permanent: permanent,
+		stats:     stats,
+		ctx:       ctx,
+		cancel:    cancel,
+		closed:    make(chan struct{}),
+		failed:    make(chan struct{}),
+		ready:     make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.setClient(client)
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+// setClient sets the connected client. The lock must be held.
+func (c *liveClient) setClient(client DialCloser) {
+	c.client = client
+	c.gen++
+	c.broken = make(chan error, 1)
+	close(c.ready)
+}
+
+// current returns the connected client and its generation, waiting for
+// the reconnection if necessary.
+func (c *liveClient) current() (DialCloser, int, error) {
+	c.mu.Lock()
+	client, gen, ready, closed, failure := c.client, c.gen, c.ready, c.isClosed, c.err
+	c.mu.Unlock()
+
+	if closed {
+		return nil, 0, errClientClosed
+	}
+	if failure != nil {
+		return nil, 0, failure
+	}
+	if client != nil {
+		return client, gen, nil
+	}
+
+	select {
+	case <-ready:
+		return c.current()
+	case <-c.failed:
+		return c.current()
+	case <-c.closed:
+		return nil, 0, errClientClosed
+	case <-time.After(reconnectDialWait):
+		return nil, 0, errReconnecting
+	}
+}
+
+func (c *liveClient) Dial(n, addr string) (net.Conn, error) {
+	client, gen, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial(n, addr)
+	if err != nil {
+		// if the client was replaced in the meantime, try the new one
+		if next, ngen, nerr := c.current(); nerr == nil && ngen != gen {
+			return next.Dial(n, addr)
+		}
+	}
+	return conn, err
+}
+
+func (c *liveClient) Close() error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.isClosed = true
+	client := c.client
+	close(c.closed)
+	c.mu.Unlock()
+
+	// abort a reconnection in progress
+	c.cancel()
+
+	var err error
+	if client != nil {
+		err = client.Close()
+	}
+	c.wg.Wait()
+	return err
+}
+
+// Failed returns a channel that is closed when the liveClient stops
+// reconnecting due to a permanent error, returned by Err.
+func (c *liveClient) Failed() <-chan struct{} {
+	return c.failed
+}
+
+// Err returns the permanent error of the reconnection, once Failed is
+// closed.
+func (c *liveClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Status returns the health of the SSH client.
+func (c *liveClient) Status() ClientStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// run monitors the client until it is dead and reconnects it, until
+// the liveClient is closed.
+func (c *liveClient) run() {
+	defer c.wg.Done()
+
+	for {
+		c.mu.Lock()
+		client, broken := c.client, c.broken
+		c.mu.Unlock()
+
+		cause := c.monitor(client, broken)
+		if cause == nil {
+			// closed
+			return
+		}
+		if !c.reconnect(client, cause) {
+			return
+		}
+	}
+}
+
+// monitor returns the reason why the client's connection is dead, or
+// nil if the liveClient is closed.
+func (c *liveClient) monitor(client DialCloser, broken chan error) error {
+	inner := client
+	if chain, ok := client.(chainClient); ok {
+		// the last client's connection depends on the previous ones
+		inner = chain[len(chain)-1]
+	}
+
+	if w, ok := inner.(waiter); ok {
+		go func() {
+			err := w.Wait()
+			if err == nil {
+				err = errConnClosed
+			}
+			select {
+			case broken <- err:
+			default:
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	rs, ok := inner.(requestSender)
+	if ok && c.interval > 0 {
+		var stop func()
+		tick, stop = keepaliveTicker(c.interval)
+		defer stop()
+	}
+
+	var missed int
+	for {
+		select {
+		case <-c.closed:
+			return nil
+		case err := <-broken:
+			return err
+		case <-tick:
+			if err := c.keepalive(rs); err != nil {
+				missed++
+				if missed >= c.countMax {
+					return errors.Wrapf(err, "%d keepalive requests failed", missed)
+				}
+				continue
+			}
+			missed = 0
+		}
+	}
+}
+
+// keepalive sends a keepalive request and waits for its reply for at
+// most the keepalive interval.
+func (c *liveClient) keepalive(rs requestSender) error {
+	res := make(chan error, 1)
+	go func() {
+		// any reply, even a failure, means that the server is alive
+		_, _, err := rs.SendRequest(keepaliveRequest, true, nil)
+		res <- err
+	}()
+
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(c.interval):
+		return errKeepaliveTimeout
+	case <-c.closed:
+		return nil
+	}
+}
+
+// reconnect closes the dead client and dials a new one with backoff.
+// It returns false if the liveClient was closed in the meantime, or if
+// it failed with a permanent error.
+func (c *liveClient) reconnect(dead DialCloser, cause error) bool {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return false
+	}
+	c.client = nil
+	c.ready = make(chan struct{})
+	c.status.LastFailure = cause
+	c.status.LastFailureAt = time.Now()
+	c.mu.Unlock()
+
+	dead.Close()
+
+	backoff := minReconnectBackoff
+	for {
+		client, err := c.dial(c.ctx)
+		if err == nil {
+			c.mu.Lock()
+			if c.isClosed {
+				c.mu.Unlock()
+				client.Close()
+				return false
+			}
+			c.status.Reconnects++
+			c.setClient(client)
+			c.mu.Unlock()
+
+			if c.stats != nil {
+				c.stats.Add("ssh_reconnects", 1)
+			}
+			return true
+		}
+
+		failed := c.permanent != nil && c.permanent(err)
+		c.mu.Lock()
+		c.status.LastFailure = err
+		c.status.LastFailureAt = time.Now()
+		if failed {
+			// the Dials waiting for the reconnection fail with err
+			c.err = err
+			close(c.failed)
+		}
+		c.mu.Unlock()
+		if failed {
+			return false
+		}
+
+		select {
+		case <-c.closed:
+			return false
+		case <-reconnectAfter(backoff):
+		}
+		if backoff *= 2; backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package tunnel
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/harfangapps/regis-companion/internal/testutils"
+
+	"github.com/pkg/errors"
+)
+
+// keepaliveClient is a mock SSH client that supports keepalive requests
+// and waiting for the connection to terminate.
+type keepaliveClient struct {
+	testutils.MockSSHClient
+
+	// Error to return when SendRequest is called.
+	RequestErr error
+	// If set, Wait returns when the channel is closed.
+	WaitChan chan struct{}
+}
+
+func (c *keepaliveClient) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	return false, nil, c.RequestErr
+}
+
+func (c *keepaliveClient) Wait() error {
+	if c.WaitChan == nil {
+		select {}
+	}
+	<-c.WaitChan
+	return io.EOF
+}
+
+// sequenceDial returns a dial function that returns the clients in
+// order, and the function that returns the number of dials.
+func sequenceDial(clients ...DialCloser) (func(ctx context.Context) (DialCloser, error), func() int) {
+	var mu sync.Mutex
+	var i int
+	dial := func(ctx context.Context) (DialCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		c := clients[i]
+		i++
+		return c, nil
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return i
+	}
+	return dial, count
+}
+
+func TestLiveClientKeepaliveReconnects(t *testing.T) {
+	ticks := make(chan time.Time)
+	backoffs := make(chan time.Duration)
+	elapsed := make(chan time.Time)
+	defer func(ticker func(time.Duration) (<-chan time.Time, func()), after func(time.Duration) <-chan time.Time) {
+		keepaliveTicker, reconnectAfter = ticker, after
+	}(keepaliveTicker, reconnectAfter)
+	keepaliveTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		return ticks, func() {}
+	}
+	reconnectAfter = func(d time.Duration) <-chan time.Time {
+		backoffs <- d
+		return elapsed
+	}
+
+	dead := &keepaliveClient{RequestErr: io.EOF}
+	alive := &keepaliveClient{}
+	alive.DialFunc = func(i int, n, a string) (net.Conn, error) {
+		return &testutils.MockConn{}, nil
+	}
+	// the first reconnection attempt fails
+	dialErr := errors.New("connection refused")
+	seqDial, count := sequenceDial(dead, nil, alive)
+	attempts, release := make(chan struct{}), make(chan struct{})
+	dial := func(ctx context.Context) (DialCloser, error) {
+		if count() > 0 {
+			attempts <- struct{}{}
+			<-release
+		}
+		client, _ := seqDial(ctx)
+		if client == nil {
+			return nil, dialErr
+		}
+		return client, nil
+	}
+
+	stats := new(expvar.Map).Init()
+	// the keepalive requests never time out
+	c, err := newLiveClient(dial, time.Hour, 3, nil, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the dead client is detected after 3 failed keepalive requests
+	for i := 0; i < 3; i++ {
+		ticks <- time.Time{}
+	}
+	<-attempts
+	if n := dead.CloseCalls(); n != 1 {
+		t.Errorf("want dead client to be closed once, got %d", n)
+	}
+	if err := c.Status().LastFailure; err == nil || !strings.Contains(err.Error(), "3 keepalive requests failed") {
+		t.Errorf("want keepalive failure, got %v", err)
+	}
+
+	// dial waits for the reconnection
+	res := make(chan error, 1)
+	go func() {
+		_, err := c.Dial("tcp", "remote:80")
+		res <- err
+	}()
+
+	release <- struct{}{}
+	if d := <-backoffs; d != minReconnectBackoff {
+		t.Errorf("want backoff of %v, got %v", minReconnectBackoff, d)
+	}
+	if err := c.Status().LastFailure; err != dialErr {
+		t.Errorf("want %v, got %v", dialErr, err)
+	}
+	select {
+	case err := <-res:
+		t.Fatalf("want dial to wait for the reconnection, got %v", err)
+	default:
+	}
+
+	elapsed <- time.Time{}
+	<-attempts
+	release <- struct{}{}
+	if err := <-res; err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("want 3 dials, got %d", n)
+	}
+	if n := alive.DialCalls(); n != 1 {
+		t.Errorf("want 1 dial on alive client, got %d", n)
+	}
+
+	if n := c.Status().Reconnects; n != 1 {
+		t.Errorf("want 1 reconnect, got %d", n)
+	}
+	if v := stats.Get("ssh_reconnects"); v == nil || v.String() != "1" {
+		t.Errorf("want 1 ssh_reconnects, got %v", v)
+	}
+}
+
+func TestLiveClientReconnectsClosedConn(t *testing.T) {
+	first := &keepaliveClient{WaitChan: make(chan struct{})}
+	second := &keepaliveClient{}
+	dial, count := sequenceDial(first, second)
+
+	c, err := newLiveClient(dial, 0, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(first.WaitChan)
+	deadline := time.Now().Add(time.Second)
+	for c.Status().Reconnects == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("want 2 dials, got %d", n)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+	if n := second.CloseCalls(); n != 1 {
+		t.Errorf("want client to be closed once, got %d", n)
+	}
+	if _, err := c.Dial("tcp", "remote:80"); err != errClientClosed {
+		t.Errorf("want %v, got %v", errClientClosed, err)
+	}
+}
+
+func TestLiveClientCloseAbortsReconnect(t *testing.T) {
+	first := &keepaliveClient{WaitChan: make(chan struct{})}
+	seqDial, count := sequenceDial(first)
+	dialing := make(chan struct{})
+	aborted := make(chan error, 1)
+	dial := func(ctx context.Context) (DialCloser, error) {
+		if count() == 0 {
+			return seqDial(ctx)
+		}
+		// the reconnection is stuck until it is aborted
+		close(dialing)
+		<-ctx.Done()
+		aborted <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	c, err := newLiveClient(dial, 0, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(first.WaitChan)
+	<-dialing
+	if err := c.Close(); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+	if err := <-aborted; err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestLiveClientPermanentError(t *testing.T) {
+	defer func(after func(time.Duration) <-chan time.Time) {
+		reconnectAfter = after
+	}(reconnectAfter)
+	reconnectAfter = func(d time.Duration) <-chan time.Time {
+		t.Errorf("want no retry after a permanent error, got backoff of %v", d)
+		return nil
+	}
+
+	first := &keepaliveClient{WaitChan: make(chan struct{})}
+	seqDial, count := sequenceDial(first)
+	authErr := errors.New("ssh: unable to authenticate")
+	dial := func(ctx context.Context) (DialCloser, error) {
+		if count() == 0 {
+			return seqDial(ctx)
+		}
+		return nil, authErr
+	}
+
+	c, err := newLiveClient(dial, 0, 0, func(err error) bool { return err == authErr }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	close(first.WaitChan)
+	<-c.Failed()
+	if err := c.Err(); err != authErr {
+		t.Errorf("want %v, got %v", authErr, err)
+	}
+	if err := c.Status().LastFailure; err != authErr {
+		t.Errorf("want last failure %v, got %v", authErr, err)
+	}
+	if _, err := c.Dial("tcp", "remote:80"); err != authErr {
+		t.Errorf("want %v, got %v", authErr, err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("want 1 successful dial, got %d", n)
+	}
+}
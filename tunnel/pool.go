@@ -0,0 +1,182 @@
+package tunnel
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// Pool is a pool of SSH clients that can be shared by Tunnels to the
+// same SSH server, so that they use one multiplexed SSH connection.
+// The clients are reference-counted by the Tunnels that use them, and
+// closed when the last one releases its client. The zero value is
+// ready to use.
+type Pool struct {
+	mu      sync.Mutex
+	clients map[string]*poolEntry
+}
+
+// PoolStat describes an SSH client of a Pool.
+type PoolStat struct {
+	// Key is the key of the SSH client in the Pool.
+	Key string
+	// Refs is the number of users of the SSH client.
+	Refs int
+	// The health of the SSH client.
+	ClientStatus
+}
+
+type poolEntry struct {
+	ready  chan struct{} // closed when the dial is complete
+	client DialCloser
+	err    error
+
+	refs int // protected by the Pool's mu
+}
+
+// Get returns the SSH client for key, calling dial to connect it if the
+// Pool has none or if its client failed permanently. If the client is
+// being connected by a concurrent call, Get waits for that connection
+// instead. The returned DialCloser must be closed to release the client.
+func (p *Pool) Get(key string, dial func() (DialCloser, error)) (DialCloser, error) {
+	p.mu.Lock()
+	if p.clients == nil {
+		p.clients = make(map[string]*poolEntry)
+	}
+	e := p.clients[key]
+	if e != nil && e.failed() {
+		// replaced for the next users, the current ones release the
+		// failed client
+		e = nil
+	}
+	if e == nil {
+		e = &poolEntry{ready: make(chan struct{})}
+		e.refs++
+		p.clients[key] = e
+		p.mu.Unlock()
+
+		e.client, e.err = dial()
+		if e.err != nil {
+			p.remove(key, e)
+		}
+		close(e.ready)
+	} else {
+		e.refs++
+		p.mu.Unlock()
+		<-e.ready
+	}
+
+	if e.err != nil {
+		return nil, e.err
+	}
+	return &pooledClient{p: p, key: key, e: e}, nil
+}
+
+// Stats returns the statistics of the connected SSH clients of the Pool,
+// sorted by key.
+func (p *Pool) Stats() []PoolStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]PoolStat, 0, len(p.clients))
+	for key, e := range p.clients {
+		select {
+		case <-e.ready:
+			stat := PoolStat{Key: key, Refs: e.refs}
+			if c, ok := e.client.(interface{ Status() ClientStatus }); ok {
+				stat.ClientStatus = c.Status()
+			}
+			stats = append(stats, stat)
+		default:
+			// still connecting
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+// failed returns true if the client of e is connected and failed
+// permanently since.
+func (e *poolEntry) failed() bool {
+	select {
+	case <-e.ready:
+	default:
+		return false
+	}
+	f, ok := e.client.(failer)
+	if !ok {
+		return false
+	}
+	select {
+	case <-f.Failed():
+		return true
+	default:
+		return false
+	}
+}
+
+// remove removes e from the Pool if it is still the entry for key.
+func (p *Pool) remove(key string, e *poolEntry) {
+	p.mu.Lock()
+	if p.clients[key] == e {
+		delete(p.clients, key)
+	}
+	p.mu.Unlock()
+}
+
+// release releases a reference to e, and closes its client if it was
+// the last one.
+func (p *Pool) release(key string, e *poolEntry) error {
+	p.mu.Lock()
+	e.refs--
+	last := e.refs == 0
+	if last && p.clients[key] == e {
+		delete(p.clients, key)
+	}
+	p.mu.Unlock()
+
+	if last {
+		return e.client.Close()
+	}
+	return nil
+}
+
+// pooledClient is the DialCloser returned by Pool.Get. Closing it
+// releases the shared client.
+type pooledClient struct {
+	p    *Pool
+	key  string
+	e    *poolEntry
+	once sync.Once
+}
+
+func (c *pooledClient) Dial(n, addr string) (net.Conn, error) {
+	return c.e.client.Dial(n, addr)
+}
+
+// Failed returns the Failed channel of the shared client, or nil if it
+// cannot fail.
+func (c *pooledClient) Failed() <-chan struct{} {
+	if f, ok := c.e.client.(failer); ok {
+		return f.Failed()
+	}
+	return nil
+}
+
+// Err returns the error of the shared client, if it failed.
+func (c *pooledClient) Err() error {
+	if f, ok := c.e.client.(failer); ok {
+		return f.Err()
+	}
+	return nil
+}
+
+func (c *pooledClient) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.p.release(c.key, c.e)
+	})
+	return err
+}
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/harfangapps/regis-companion/internal/testutils"
+)
+
+func TestPoolSharesClient(t *testing.T) {
+	var pool Pool
+	sshClient := &testutils.MockSSHClient{
+		DialFunc: func(i int, n, a string) (net.Conn, error) {
+			return &testutils.MockConn{}, nil
+		},
+	}
+
+	var mu sync.Mutex
+	var dials int
+	ready := make(chan struct{})
+	dial := func() (DialCloser, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		<-ready
+		return sshClient, nil
+	}
+
+	// concurrent calls share the same dial
+	const n = 10
+	clients := make(chan DialCloser, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := pool.Get("me@host:22", dial)
+			if err != nil {
+				t.Errorf("want no error, got %v", err)
+				return
+			}
+			clients <- c
+		}()
+	}
+	close(ready)
+	wg.Wait()
+	close(clients)
+
+	if dials != 1 {
+		t.Errorf("want 1 dial, got %d", dials)
+	}
+	if stats := pool.Stats(); len(stats) != 1 || stats[0].Key != "me@host:22" || stats[0].Refs != n {
+		t.Errorf("want 1 client with %d refs, got %v", n, stats)
+	}
+
+	var i int
+	for c := range clients {
+		if _, err := c.Dial("tcp", "remote:80"); err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+		// closing twice releases only once
+		c.Close()
+		c.Close()
+		i++
+
+		want := 0
+		if i == n {
+			want = 1
+		}
+		if got := sshClient.CloseCalls(); got != want {
+			t.Errorf("after %d releases, want %d close calls, got %d", i, want, got)
+		}
+	}
+	if stats := pool.Stats(); len(stats) != 0 {
+		t.Errorf("want no client, got %v", stats)
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	var pool Pool
+	if _, err := pool.Get("key", func() (DialCloser, error) { return nil, io.EOF }); err != io.EOF {
+		t.Errorf("want %v, got %v", io.EOF, err)
+	}
+
+	// errors are not kept
+	sshClient := &testutils.MockSSHClient{}
+	c, err := pool.Get("key", func() (DialCloser, error) { return sshClient, nil })
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+	if got := sshClient.CloseCalls(); got != 1 {
+		t.Errorf("want 1 close call, got %d", got)
+	}
+}
+
+// failingClient is a mock SSH client that fails when its channel is
+// closed.
+type failingClient struct {
+	testutils.MockSSHClient
+	failed chan struct{}
+}
+
+func (c *failingClient) Failed() <-chan struct{} { return c.failed }
+func (c *failingClient) Err() error              { return io.EOF }
+
+func TestPoolReplacesFailedClient(t *testing.T) {
+	var pool Pool
+	failed := &failingClient{failed: make(chan struct{})}
+	c1, err := pool.Get("key", func() (DialCloser, error) { return failed, nil })
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if f, ok := c1.(failer); !ok || f.Failed() != failed.failed {
+		t.Fatalf("want pooled client to report the failure of its client")
+	}
+
+	close(failed.failed)
+	next := &testutils.MockSSHClient{}
+	c2, err := pool.Get("key", func() (DialCloser, error) { return next, nil })
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if stats := pool.Stats(); len(stats) != 1 || stats[0].Refs != 1 {
+		t.Errorf("want 1 client with 1 ref, got %v", stats)
+	}
+
+	// the failed client is closed when its last user releases it
+	c1.Close()
+	if n := failed.CloseCalls(); n != 1 {
+		t.Errorf("want failed client to be closed once, got %d", n)
+	}
+	if stats := pool.Stats(); len(stats) != 1 {
+		t.Errorf("want the new client to stay in the pool, got %v", stats)
+	}
+	c2.Close()
+	if n := next.CloseCalls(); n != 1 {
+		t.Errorf("want new client to be closed once, got %d", n)
+	}
+}
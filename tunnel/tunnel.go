@@ -2,10 +2,12 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
 	"expvar"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -24,12 +26,71 @@ func DefaultSSHDial(n, addr string, config *ssh.ClientConfig) (DialCloser, error
 	return ssh.Dial(n, addr, config)
 }
 
+// SSHDialThroughFunc is a variable that references the function to use
+// to dial an SSH server through an already connected SSH client, so that
+// it can be mocked for tests.
+var SSHDialThroughFunc = DefaultSSHDialThrough
+
+// DefaultSSHDialThrough is the default implementation to use to dial an
+// SSH server through the via SSH client (a jump host).
+func DefaultSSHDialThrough(via DialCloser, n, addr string, config *ssh.ClientConfig) (DialCloser, error) {
+	conn, err := via.Dial(n, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
 // DialCloser defines the required functions implemented by an SSH Client.
 type DialCloser interface {
 	Dial(n, addr string) (net.Conn, error)
 	Close() error
 }
 
+// Hop is an SSH server (a jump host) to connect through to reach the
+// SSH server of a Tunnel.
+type Hop struct {
+	// The address of the SSH server.
+	SSH net.Addr
+	// Config is the configuration to use to dial to the SSH server.
+	Config *ssh.ClientConfig
+}
+
+// CopyFunc copies the data from src to dst until either EOF is reached
+// on src or an error occurs, like io.Copy.
+type CopyFunc func(dst io.Writer, src io.Reader) (int64, error)
+
+// Filter creates the functions that copy the data of the connections
+// forwarded by a Tunnel, so that the data can be inspected or modified.
+type Filter interface {
+	// NewConn returns the functions to use for a new connection, to copy
+	// the data from the local to the remote connection (toRemote), and
+	// from the remote to the local connection (toLocal).
+	NewConn() (toRemote, toLocal CopyFunc)
+}
+
+// TLSError is returned when the TLS handshake with the remote address
+// fails, e.g. because its certificate cannot be verified.
+type TLSError struct {
+	Err error
+}
+
+func (e *TLSError) Error() string {
+	return "tls handshake: " + e.Err.Error()
+}
+
+// maximum duration of the TLS handshake with the remote address
+const tlsHandshakeTimeout = 30 * time.Second
+
+// ErrWaitAborted is returned by WaitDialed if the wait is aborted before
+// the connection to the SSH server completes.
+var ErrWaitAborted = errors.New("tunnel: wait aborted")
+
 // various states of the Tunnel
 const (
 	none = iota
@@ -38,6 +99,56 @@ const (
 	closed
 )
 
+var stateNames = [...]string{
+	none:     "new",
+	prepared: "prepared",
+	started:  "started",
+	closed:   "closed",
+}
+
+// The reasons why a Tunnel stopped serving, as reported by its status.
+const (
+	// ExitIdle is reported if the Tunnel stopped after its IdleTimeout
+	// without activity.
+	ExitIdle = "idle"
+	// ExitKilled is reported if the context of the Tunnel was cancelled,
+	// typically via KillFunc.
+	ExitKilled = "killed"
+	// ExitDialError is reported if the Tunnel failed to connect to the
+	// SSH server, or to reconnect to it with a permanent error.
+	ExitDialError = "dial error"
+	// ExitServeError is reported if the Tunnel failed to accept the
+	// local connections.
+	ExitServeError = "serve error"
+)
+
+// TunnelStatus describes the state and the activity of a Tunnel.
+type TunnelStatus struct {
+	// State is the state of the Tunnel: "new", "prepared" (for
+	// serving), "started" or "closed".
+	State string
+	// Created is the time the Tunnel was prepared for serving.
+	Created time.Time
+	// LastActivity is the time of the last forwarded connection or data,
+	// or of the last Touch. It is Created if there was none.
+	LastActivity time.Time
+	// IdleRemaining is the duration before the Tunnel closes if there
+	// is no more activity, 0 if there is no IdleTimeout.
+	IdleRemaining time.Duration
+	// Conns is the number of forwarded connections.
+	Conns int
+	// BytesIn is the number of bytes received from the local
+	// connections and forwarded to Remote, BytesOut the number of bytes
+	// received from Remote and forwarded to the local connections.
+	BytesIn  int64
+	BytesOut int64
+
+	// ExitReason is the reason why the Tunnel stopped, one of the Exit
+	// constants, once it is closed. Err is the error returned by Serve.
+	ExitReason string
+	Err        error
+}
+
 // Tunnel represents an SSH tunnel that connects to Remote via the
 // Dialer (an SSH connection) and forwards the data between Remote
 // and Local addresses.
@@ -46,12 +157,45 @@ type Tunnel struct {
 	SSH net.Addr
 	// Config is the configuration to use to dial to the SSH server.
 	Config *ssh.ClientConfig
+	// Jumps is the chain of jump hosts to go through to reach the SSH
+	// server, in order. The first one is dialed directly, and each
+	// subsequent one is dialed through the previous one.
+	Jumps []Hop
+
+	// Pool is the pool of SSH clients to get the connection to the SSH
+	// server from. If not nil, the Tunnels with the same PoolKey share
+	// the same SSH client. Otherwise, the Tunnel has its own.
+	Pool    *Pool
+	PoolKey string
+
+	// KeepaliveInterval is the interval between the keepalive requests
+	// sent to the SSH server. If zero, no keepalive request is sent.
+	KeepaliveInterval time.Duration
+	// KeepaliveCountMax is the number of consecutive keepalive requests
+	// that may fail before the SSH connection is considered dead and is
+	// reconnected.
+	KeepaliveCountMax int
+	// IsPermanentError, if not nil, returns true if an error to
+	// reconnect to the SSH server cannot be fixed by dialing again, such
+	// as an authentication or a host key error. The SSH client then
+	// stops reconnecting, and the Tunnels that use it stop with
+	// ExitDialError and that error.
+	IsPermanentError func(err error) bool
 
 	// The local address on which the tunnel is exposed.
 	Local net.Addr
 	// The remote address to connect to via the SSH connection.
 	Remote net.Addr
 
+	// TLSConfig, if not nil, is the configuration of the TLS client
+	// connections to Remote. The data is then encrypted between the
+	// SSH server and Remote, and in plain text on the Local side.
+	TLSConfig *tls.Config
+
+	// Filter, if not nil, creates the functions to use to copy the data
+	// of the forwarded connections. Otherwise the data is copied as-is.
+	Filter Filter
+
 	// The duration after which the tunnel is closed if there is no
 	// activity.
 	IdleTimeout time.Duration
@@ -66,14 +210,28 @@ type Tunnel struct {
 
 	// The function to cancel the context of the Tunnel.
 	KillFunc func()
+	// ExitFunc, if not nil, is called when the Tunnel stops serving,
+	// once its status is final and before KillAndWait returns.
+	ExitFunc func()
 
 	server common.RetryServer
 	client DialCloser
 
+	// the activity, updated atomically
+	lastActivity int64 // UnixNano
+	conns        int64
+	bytesIn      int64
+	bytesOut     int64
+
 	// protects the following private fields
-	mu     sync.Mutex
-	killed chan struct{} // closed when tunnel is closed
-	state  int
+	mu      sync.Mutex
+	killed  chan struct{} // closed when tunnel is closed
+	dialed  chan struct{} // closed when the SSH connection is established or failed
+	dialErr error
+	state   int
+	created time.Time
+	exit    string // the reason why it stopped, once closed
+	exitErr error
 }
 
 // KillAndWait stops the tunnel by cancelling its context using KillFunc
@@ -86,6 +244,33 @@ func (t *Tunnel) KillAndWait() {
 	<-t.killed
 }
 
+// WaitDialed waits until the connection to the SSH server is either
+// established or failed, and returns the dial error, if any. It returns
+// ErrWaitAborted if done is closed or the Tunnel is closed before the
+// connection completes. The Tunnel must be prepared for serving.
+func (t *Tunnel) WaitDialed(done <-chan struct{}) error {
+	t.mu.Lock()
+	dialed, killed := t.dialed, t.killed
+	t.mu.Unlock()
+
+	select {
+	case <-dialed:
+	case <-killed:
+		// the dial may have completed too
+		select {
+		case <-dialed:
+		default:
+			return ErrWaitAborted
+		}
+	case <-done:
+		return ErrWaitAborted
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dialErr
+}
+
 // Touch generates activity on the tunnel to prevent it from closing
 // due to inactivity. It returns true if the tunnel was active when
 // this was called, false otherwise.
@@ -103,10 +288,39 @@ func (t *Tunnel) Touch() bool {
 	}
 	t.server.IdleTracker.Touch()
 	t.mu.Unlock()
+	t.touchActivity()
 
 	return true
 }
 
+func (t *Tunnel) touchActivity() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+// Status returns the state and the activity of the Tunnel.
+func (t *Tunnel) Status() TunnelStatus {
+	t.mu.Lock()
+	st := TunnelStatus{
+		State:        stateNames[t.state],
+		Created:      t.created,
+		LastActivity: t.created,
+		ExitReason:   t.exit,
+		Err:          t.exitErr,
+	}
+	if t.state == started {
+		st.IdleRemaining = t.server.IdleTracker.Remaining()
+	}
+	t.mu.Unlock()
+
+	if last := atomic.LoadInt64(&t.lastActivity); last != 0 {
+		st.LastActivity = time.Unix(0, last)
+	}
+	st.Conns = int(atomic.LoadInt64(&t.conns))
+	st.BytesIn = atomic.LoadInt64(&t.bytesIn)
+	st.BytesOut = atomic.LoadInt64(&t.bytesOut)
+	return st
+}
+
 // PrepareForServe prepares the Tunnel for serving connections. It must
 // be called before Serve, which typically runs in a separate goroutine.
 func (t *Tunnel) PrepareForServe() error {
@@ -126,15 +340,18 @@ func (t *Tunnel) PrepareForServe() error {
 	t.server.IdleTracker.IdleTimeout = t.IdleTimeout
 	t.server.Dispatch = t.forward
 	t.state = prepared
+	t.created = time.Now()
 	t.killed = make(chan struct{})
+	t.dialed = make(chan struct{})
 	t.mu.Unlock()
 
 	return nil
 }
 
 // Serve starts the tunnel's server on the local address. It is a blocking
-// call that always returns an error.
-func (t *Tunnel) Serve(ctx context.Context, l net.Listener) error {
+// call that always returns an error. The reason why it returned is then
+// reported by Status.
+func (t *Tunnel) Serve(ctx context.Context, l net.Listener) (err error) {
 	t.mu.Lock()
 	switch t.state {
 	case none:
@@ -159,6 +376,7 @@ func (t *Tunnel) Serve(ctx context.Context, l net.Listener) error {
 		t.Stats.Add("total_tunnels", 1)
 	}
 
+	exit := ExitServeError
 	defer func() {
 		if t.Stats != nil {
 			t.Stats.Add("active_tunnels", -1)
@@ -166,22 +384,268 @@ func (t *Tunnel) Serve(ctx context.Context, l net.Listener) error {
 
 		t.mu.Lock()
 		t.state = closed
-		close(t.killed)
+		t.exit = exit
+		t.exitErr = err
 		t.mu.Unlock()
+
+		if t.ExitFunc != nil {
+			t.ExitFunc()
+		}
+		close(t.killed)
 	}()
 
 	// connect to the SSH server and store the dialCloser
-	client, err := SSHDialFunc(t.SSH.Network(), t.SSH.String(), t.Config)
+	client, err := t.dialSSH()
+	t.mu.Lock()
+	t.dialErr = err
+	close(t.dialed)
+	t.mu.Unlock()
 	if err != nil {
+		exit = ExitDialError
 		return err
 	}
 	t.client = client
 	defer client.Close()
 
-	return t.server.Serve(ctx)
+	// stop serving if the SSH client fails permanently
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failed := make(chan error, 1)
+	if f, ok := client.(failer); ok {
+		go func() {
+			select {
+			case <-f.Failed():
+				failed <- f.Err()
+				cancel()
+			case <-serveCtx.Done():
+			}
+		}()
+	}
+
+	err = t.server.Serve(serveCtx)
+	switch {
+	case ctx.Err() != nil:
+		exit = ExitKilled
+	case t.server.IdleTracker.Expired():
+		exit = ExitIdle
+	default:
+		select {
+		case ferr := <-failed:
+			exit = ExitDialError
+			err = ferr
+		default:
+		}
+	}
+	return err
+}
+
+// dialSSH returns the client connected to the SSH server, from the Pool
+// if the Tunnel has one. The client is reconnected when its connection
+// is dead.
+func (t *Tunnel) dialSSH() (DialCloser, error) {
+	dial := func() (DialCloser, error) {
+		return newLiveClient(t.dialChain, t.KeepaliveInterval, t.KeepaliveCountMax, t.IsPermanentError, t.Stats)
+	}
+	if t.Pool != nil {
+		return t.Pool.Get(t.PoolKey, dial)
+	}
+	return dial()
+}
+
+// dialChain connects to the SSH server through the chain of jump hosts,
+// if any. Closing the returned DialCloser closes all connections of
+// the chain. If the host key callback of a server fails, the error is
+// the one returned by the callback. The dial is aborted when ctx is
+// done.
+func (t *Tunnel) dialChain(ctx context.Context) (DialCloser, error) {
+	hops := make([]Hop, 0, len(t.Jumps)+1)
+	hops = append(hops, t.Jumps...)
+	hops = append(hops, Hop{SSH: t.SSH, Config: t.Config})
+
+	var chain chainClient
+	for i, hop := range hops {
+		config, hostKeyErr := keepHostKeyError(hop.Config)
+
+		client, err := dialHop(ctx, chain, hop.SSH, config)
+		if err != nil {
+			if *hostKeyErr != nil {
+				// the SSH package only keeps the error message
+				err = *hostKeyErr
+			}
+			// closing the chain also closes the connection of a hop
+			// that is still being dialed through it
+			chain.Close()
+			if i < len(hops)-1 {
+				return nil, errors.Wrapf(err, "jump host %s", hop.SSH)
+			}
+			return nil, err
+		}
+		chain = append(chain, client)
+	}
+	return chain, nil
+}
+
+// dialHop dials the SSH server at addr, through the last client of
+// chain if there is one. The dial includes the SSH handshake, so that
+// it is bounded by the Timeout of config, if any, for all the hops,
+// while the SSH package only applies it to the direct TCP connections.
+// When ctx is done or the timeout expires, the dial is abandoned and
+// its client is closed if it connects later.
+func dialHop(ctx context.Context, chain chainClient, addr net.Addr, config *ssh.ClientConfig) (DialCloser, error) {
+	type result struct {
+		client DialCloser
+		err    error
+	}
+	// the dial functions are read before the dial may be abandoned
+	dial, dialThrough := SSHDialFunc, SSHDialThroughFunc
+	res := make(chan result, 1)
+	go func() {
+		var r result
+		if len(chain) == 0 {
+			r.client, r.err = dial(addr.Network(), addr.String(), config)
+		} else {
+			r.client, r.err = dialThrough(chain[len(chain)-1], addr.Network(), addr.String(), config)
+		}
+		res <- r
+	}()
+
+	var expired <-chan time.Time
+	if config != nil && config.Timeout > 0 {
+		timer := time.NewTimer(config.Timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case r := <-res:
+		return r.client, r.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+		err = errors.Errorf("ssh: dial timeout after %v", config.Timeout)
+	}
+	go func() {
+		if r := <-res; r.err == nil {
+			r.client.Close()
+		}
+	}()
+	return nil, err
+}
+
+// keepHostKeyError returns a copy of config with a host key callback
+// that stores its error in the returned error pointer.
+func keepHostKeyError(config *ssh.ClientConfig) (*ssh.ClientConfig, *error) {
+	var hostKeyErr error
+	if config == nil || config.HostKeyCallback == nil {
+		return config, &hostKeyErr
+	}
+
+	conf := *config
+	conf.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := config.HostKeyCallback(hostname, remote, key)
+		if err != nil {
+			hostKeyErr = err
+		}
+		return err
+	}
+	return &conf, &hostKeyErr
+}
+
+// chainClient is a chain of SSH clients, each one connected through
+// the previous one. It dials through the last client of the chain.
+type chainClient []DialCloser
+
+func (c chainClient) Dial(n, addr string) (net.Conn, error) {
+	return c[len(c)-1].Dial(n, addr)
+}
+
+// Close closes all clients of the chain, from last to first, and returns
+// the first error encountered, if any.
+func (c chainClient) Close() error {
+	var err error
+	for i := len(c) - 1; i >= 0; i-- {
+		if cerr := c[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// DialRemote connects to Remote via the SSH server, without serving the
+// Tunnel: the SSH client is connected, from the Pool if the Tunnel has
+// one, for this connection only. Closing the returned connection
+// releases the SSH client. The connection is typically forwarded with
+// Splice.
+func (t *Tunnel) DialRemote() (net.Conn, error) {
+	client, err := t.dialSSH()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := t.dialRemote(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &remoteConn{Conn: remote, client: client}, nil
+}
+
+// dialRemote connects to Remote via client, and establishes the TLS
+// session if the Tunnel has a TLSConfig.
+func (t *Tunnel) dialRemote(client DialCloser) (net.Conn, error) {
+	conn, err := client.Dial(t.Remote.Network(), t.Remote.String())
+	if err != nil || t.TLSConfig == nil {
+		return conn, err
+	}
+
+	// the SSH channels do not support deadlines
+	timer := time.AfterFunc(tlsHandshakeTimeout, func() {
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	tlsConn := tls.Client(conn, t.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &TLSError{Err: err}
+	}
+	return tlsConn, nil
+}
+
+// remoteConn is a connection returned by DialRemote.
+type remoteConn struct {
+	net.Conn
+	client DialCloser
+}
+
+func (c *remoteConn) Close() error {
+	err := c.Conn.Close()
+	if cerr := c.client.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Splice forwards the data between local and remote, a connection
+// returned by DialRemote, as if local was accepted by the Tunnel. It
+// blocks until one end fails to forward its data or ctx is done, and
+// closes both connections.
+func (t *Tunnel) Splice(ctx context.Context, local, remote net.Conn) {
+	t.splice(ctx, local, func() (net.Conn, error) {
+		return remote, nil
+	})
 }
 
 func (t *Tunnel) forward(ctx context.Context, d common.Doner, local net.Conn) {
+	defer d.Done() // notify parent that this connection is done
+
+	t.splice(ctx, local, func() (net.Conn, error) {
+		// connect to the remote address via the Dialer
+		return t.dialRemote(t.client)
+	})
+}
+
+func (t *Tunnel) splice(ctx context.Context, local net.Conn, dial func() (net.Conn, error)) {
 	copyBytesWg := &sync.WaitGroup{}
 	ctx, cancel := context.WithCancel(ctx)
 	done := ctx.Done()
@@ -190,6 +654,8 @@ func (t *Tunnel) forward(ctx context.Context, d common.Doner, local net.Conn) {
 		t.Stats.Add("active_tunnel_conns", 1)
 		t.Stats.Add("total_tunnel_conns", 1)
 	}
+	atomic.AddInt64(&t.conns, 1)
+	t.touchActivity()
 
 	defer func() {
 		local.Close()      // the connection must be closed on exit
@@ -199,12 +665,10 @@ func (t *Tunnel) forward(ctx context.Context, d common.Doner, local net.Conn) {
 		if t.Stats != nil {
 			t.Stats.Add("active_tunnel_conns", -1)
 		}
-
-		d.Done() // notify parent that this connection is done
+		atomic.AddInt64(&t.conns, -1)
 	}()
 
-	// connect to the remote address via the Dialer
-	remote, err := t.client.Dial(t.Remote.Network(), t.Remote.String())
+	remote, err := dial()
 	if err != nil {
 		common.HandleError(errors.Wrap(err, "remote dial error"), t.ErrChan)
 		return
@@ -215,25 +679,49 @@ func (t *Tunnel) forward(ctx context.Context, d common.Doner, local net.Conn) {
 	case <-done:
 		// was stopped while connecting, will exit
 	default:
+		toRemote, toLocal := CopyFunc(io.Copy), CopyFunc(io.Copy)
+		if t.Filter != nil {
+			toRemote, toLocal = t.Filter.NewConn()
+		}
+
 		// keep track of sub-goroutines
 		copyBytesWg.Add(2)
-		go t.copyBytes(cancel, copyBytesWg, local, remote)
-		go t.copyBytes(cancel, copyBytesWg, remote, local)
+		go t.copyBytes(cancel, copyBytesWg, t.countingWriter(local, &t.bytesOut), remote, toLocal)
+		go t.copyBytes(cancel, copyBytesWg, t.countingWriter(remote, &t.bytesIn), local, toRemote)
 	}
 
 	// block waiting for the stop signal
 	<-done
 }
 
-func (t *Tunnel) copyBytes(cancel func(), d common.Doner, dst io.Writer, src io.Reader) {
+func (t *Tunnel) copyBytes(cancel func(), d common.Doner, dst io.Writer, src io.Reader, copyFn CopyFunc) {
 	defer func() {
 		cancel() // if one end can't forward bytes, must cancel the connection
 		d.Done()
 	}()
 
-	if _, err := io.Copy(dst, src); err != nil {
+	if _, err := copyFn(dst, src); err != nil {
 		err = errors.Wrap(err, "copy bytes error")
 		common.HandleError(err, t.ErrChan)
 		return
 	}
 }
+
+// countingWriter returns a writer that adds the number of bytes written
+// to w to n, and records the activity of the Tunnel.
+func (t *Tunnel) countingWriter(w io.Writer, n *int64) io.Writer {
+	return &countWriter{w: w, n: n, t: t}
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+	t *Tunnel
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	c.t.touchActivity()
+	return n, err
+}
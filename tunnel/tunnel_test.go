@@ -73,6 +73,9 @@ func TestStartWithCancelledContext(t *testing.T) {
 	if ok := tun.Touch(); ok {
 		t.Errorf("want false, got %v", ok)
 	}
+	if st := tun.Status(); st.ExitReason != ExitKilled || st.Err == nil {
+		t.Errorf("want exit reason %q with error, got %q and %v", ExitKilled, st.ExitReason, st.Err)
+	}
 }
 
 // Stopping a started Tunnel returns the error returned from Listener.Accept.
@@ -298,6 +301,9 @@ func TestAcceptErrorUnblockConnection(t *testing.T) {
 	if n := listener.AcceptCalls(); n != 2 {
 		t.Errorf("want Listener.Accept to be called twice, got %v", n)
 	}
+	if st := tun.Status(); st.ExitReason != ExitServeError || errors.Cause(st.Err) != io.EOF {
+		t.Errorf("want exit reason %q with io.EOF, got %q and %v", ExitServeError, st.ExitReason, st.Err)
+	}
 }
 
 // An error returned by the SSH Dial fails in the call to Serve.
@@ -334,6 +340,44 @@ func TestSSHDialError(t *testing.T) {
 	if n := listener.AcceptCalls(); n != 0 {
 		t.Errorf("want Listener.Accept to be called 0 times, got %v", n)
 	}
+	if st := tun.Status(); st.ExitReason != ExitDialError || errors.Cause(st.Err) != io.EOF {
+		t.Errorf("want exit reason %q with io.EOF, got %q and %v", ExitDialError, st.ExitReason, st.Err)
+	}
+}
+
+// A Tunnel without activity stops after its IdleTimeout.
+func TestIdleExit(t *testing.T) {
+	sshClient := &testutils.MockSSHClient{}
+	defer setAndDeferSSHDial(mockSSHDial(sshClient))()
+
+	closeListener := make(chan struct{})
+	listener := &testutils.MockListener{
+		AcceptFunc: func(i int) (net.Conn, error) {
+			<-closeListener
+			return nil, io.EOF
+		},
+		CloseChan: closeListener,
+	}
+
+	tun := &Tunnel{Local: tcpAddr, SSH: tcpAddr, IdleTimeout: 10 * time.Millisecond}
+	if err := tun.PrepareForServe(); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if st := tun.Status(); st.ExitReason != "" {
+		t.Errorf("want no exit reason, got %q", st.ExitReason)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tun.Serve(ctx, listener); err == nil {
+		t.Errorf("want error, got nil")
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("want tunnel to stop before its context, got %v", ctx.Err())
+	}
+	if st := tun.Status(); st.State != "closed" || st.ExitReason != ExitIdle {
+		t.Errorf("want closed with exit reason %q, got %q and %q", ExitIdle, st.State, st.ExitReason)
+	}
 }
 
 // An error returned by the server SSH client Dial call closes the local
@@ -484,6 +528,18 @@ func TestRecordForwarding(t *testing.T) {
 	if s := buf.String(); s != want {
 		t.Errorf("want %q, got: %q", want, s)
 	}
+
+	// and that the bytes were counted in both directions
+	st := tun.Status()
+	if st.State != "closed" || st.Conns != 0 {
+		t.Errorf("want closed tunnel without connection, got %s with %d", st.State, st.Conns)
+	}
+	if n := int64(len(message)); st.BytesIn != n || st.BytesOut != n {
+		t.Errorf("want %d bytes in and out, got %d and %d", n, st.BytesIn, st.BytesOut)
+	}
+	if st.Created.IsZero() || st.LastActivity.Before(st.Created) {
+		t.Errorf("want activity after creation at %v, got %v", st.Created, st.LastActivity)
+	}
 }
 
 func TestServeAlreadyServing(t *testing.T) {
@@ -724,3 +780,204 @@ func TestKillUnblockConnection(t *testing.T) {
 		t.Errorf("want sshClient.Dial to be called once, got %v", n)
 	}
 }
+
+func setAndDeferSSHDialThrough(fn func(via DialCloser, n, a string, conf *ssh.ClientConfig) (DialCloser, error)) func() {
+	SSHDialThroughFunc = fn
+	return func() {
+		SSHDialThroughFunc = DefaultSSHDialThrough
+	}
+}
+
+// Jump hosts are dialed in order, each through the previous one, and
+// all clients are closed when the tunnel stops.
+func TestJumpHosts(t *testing.T) {
+	clients := []*testutils.MockSSHClient{{}, {}, {}}
+	defer setAndDeferSSHDial(mockSSHDial(clients[0]))()
+
+	var dialed []string
+	defer setAndDeferSSHDialThrough(func(via DialCloser, n, a string, conf *ssh.ClientConfig) (DialCloser, error) {
+		i := len(dialed) + 1
+		if via != clients[i-1] {
+			t.Errorf("want dial %d through client %d", i, i-1)
+		}
+		dialed = append(dialed, a)
+		return clients[i], nil
+	})()
+
+	closeChan := make(chan struct{})
+	listener := &testutils.MockListener{
+		AcceptFunc: func(i int) (net.Conn, error) {
+			<-closeChan
+			return nil, io.EOF
+		},
+		CloseChan: closeChan,
+	}
+
+	jump1 := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8001}
+	jump2 := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8002}
+	tun := &Tunnel{
+		Local:  tcpAddr,
+		SSH:    tcpAddr,
+		Remote: tcpAddr,
+		Config: &ssh.ClientConfig{},
+		Jumps:  []Hop{{SSH: jump1, Config: &ssh.ClientConfig{}}, {SSH: jump2, Config: &ssh.ClientConfig{}}},
+	}
+	if err := tun.PrepareForServe(); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tun.Serve(ctx, listener); errors.Cause(err) != io.EOF {
+		t.Errorf("want io.EOF, got %v", err)
+	}
+
+	want := []string{jump2.String(), tcpAddr.String()}
+	if strings.Join(dialed, ",") != strings.Join(want, ",") {
+		t.Errorf("want dialed addresses %v, got %v", want, dialed)
+	}
+	for i, c := range clients {
+		if n := c.CloseCalls(); n != 1 {
+			t.Errorf("want client %d Close to be called once, got %v", i, n)
+		}
+	}
+}
+
+// An error dialing a jump host closes the already connected clients.
+func TestJumpHostDialError(t *testing.T) {
+	first := &testutils.MockSSHClient{}
+	defer setAndDeferSSHDial(mockSSHDial(first))()
+	defer setAndDeferSSHDialThrough(func(via DialCloser, n, a string, conf *ssh.ClientConfig) (DialCloser, error) {
+		return nil, io.EOF
+	})()
+
+	tun := &Tunnel{
+		Local:  tcpAddr,
+		SSH:    tcpAddr,
+		Remote: tcpAddr,
+		Config: &ssh.ClientConfig{},
+		Jumps:  []Hop{{SSH: tcpAddr, Config: &ssh.ClientConfig{}}, {SSH: tcpAddr, Config: &ssh.ClientConfig{}}},
+	}
+	if err := tun.PrepareForServe(); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+
+	err := tun.Serve(context.Background(), &testutils.MockListener{})
+	if errors.Cause(err) != io.EOF {
+		t.Errorf("want io.EOF, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "jump host") {
+		t.Errorf("want error to mention the jump host, got %v", err)
+	}
+	if n := first.CloseCalls(); n != 1 {
+		t.Errorf("want first client Close to be called once, got %v", n)
+	}
+}
+
+// A jump host that does not answer is abandoned after the dial timeout
+// or when the dial is aborted, and the connection being dialed through
+// the previous hop is closed.
+func TestJumpHostDialAbandoned(t *testing.T) {
+	first := &testutils.MockSSHClient{}
+	defer setAndDeferSSHDial(mockSSHDial(first))()
+	late := &testutils.MockSSHClient{}
+	dialing, release := make(chan struct{}, 2), make(chan struct{})
+	defer setAndDeferSSHDialThrough(func(via DialCloser, n, a string, conf *ssh.ClientConfig) (DialCloser, error) {
+		dialing <- struct{}{}
+		<-release
+		return late, nil
+	})()
+
+	newTunnel := func(timeout time.Duration) *Tunnel {
+		return &Tunnel{
+			Local:  tcpAddr,
+			SSH:    tcpAddr,
+			Remote: tcpAddr,
+			Config: &ssh.ClientConfig{Timeout: timeout},
+			Jumps:  []Hop{{SSH: tcpAddr, Config: &ssh.ClientConfig{}}},
+		}
+	}
+
+	if _, err := newTunnel(10 * time.Millisecond).dialChain(context.Background()); err == nil || !strings.Contains(err.Error(), "dial timeout") {
+		t.Errorf("want dial timeout, got %v", err)
+	}
+	if n := first.CloseCalls(); n != 1 {
+		t.Errorf("want first client Close to be called once, got %v", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-dialing
+		<-dialing
+		cancel()
+	}()
+	if _, err := newTunnel(0).dialChain(ctx); err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+	if n := first.CloseCalls(); n != 2 {
+		t.Errorf("want first client Close to be called twice, got %v", n)
+	}
+
+	// the clients that connect after their dial was abandoned are closed
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for late.CloseCalls() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := late.CloseCalls(); n != 2 {
+		t.Errorf("want late client Close to be called twice, got %v", n)
+	}
+}
+
+// A Tunnel stops with a dial error when its SSH client fails to
+// reconnect with a permanent error.
+func TestPermanentReconnectError(t *testing.T) {
+	first := &keepaliveClient{WaitChan: make(chan struct{})}
+	hostKeyErr := errors.New("changed host key")
+	var dials int
+	defer setAndDeferSSHDial(func(n, a string, conf *ssh.ClientConfig) (DialCloser, error) {
+		dials++
+		if dials == 1 {
+			return first, nil
+		}
+		return nil, hostKeyErr
+	})()
+
+	closeChan := make(chan struct{})
+	listener := &testutils.MockListener{
+		AcceptFunc: func(i int) (net.Conn, error) {
+			<-closeChan
+			return nil, io.EOF
+		},
+		CloseChan: closeChan,
+	}
+	tun := &Tunnel{
+		Local:            tcpAddr,
+		SSH:              tcpAddr,
+		Remote:           tcpAddr,
+		Config:           &ssh.ClientConfig{},
+		IsPermanentError: func(err error) bool { return err == hostKeyErr },
+	}
+	if err := tun.PrepareForServe(); err != nil {
+		t.Fatalf("want nil, got %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- tun.Serve(context.Background(), listener)
+	}()
+	if err := tun.WaitDialed(nil); err != nil {
+		t.Fatalf("want no dial error, got %v", err)
+	}
+
+	close(first.WaitChan)
+	if err := <-served; err != hostKeyErr {
+		t.Errorf("want %v, got %v", hostKeyErr, err)
+	}
+	if st := tun.Status(); st.ExitReason != ExitDialError || st.Err != hostKeyErr {
+		t.Errorf("want exit on dial error %v, got %s and %v", hostKeyErr, st.ExitReason, st.Err)
+	}
+	if dials != 2 {
+		t.Errorf("want 2 dials, got %d", dials)
+	}
+}